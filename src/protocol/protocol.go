@@ -10,6 +10,10 @@ type Protocol struct {
 	Key string `json:"key"`
 	Val string `json:"val,omitempty"`
 	Exp string `json:"exp,omitempty"`
+	// params of the commands which take any number of params
+	Args []string `json:"args,omitempty"`
+	// the patterns of the command are regular expressions instead of globs
+	Regexp bool `json:"regexp,omitempty"`
 }
 
 func (p *Protocol) GetJsonBytes() ([]byte, error) {
@@ -46,3 +50,100 @@ func GetKeys(data []byte) ([]string, error) {
 	}
 	return k.Keys, nil
 }
+
+// ScanDatagram is a step of SCAN, the iteration
+// goes on from Cursor until it is "0".
+type ScanDatagram struct {
+	Cursor string   `json:"cursor"`
+	Keys   []string `json:"keys"`
+}
+
+// RangeDatagram is a batch of the keys streamed by RANGE and PREFIX,
+// one JSON line per batch. The last batch has Done set.
+type RangeDatagram struct {
+	Keys []string `json:"keys"`
+	Done bool     `json:"done,omitempty"`
+}
+
+func (r *RangeDatagram) GetJsonLine() ([]byte, error) {
+	jsonBytes, err := json.Marshal(*r)
+	if err != nil {
+		return nil, err
+	}
+	return append(jsonBytes, '\n'), nil
+}
+
+// IndexesDatagram lists the secondary indexes of a database.
+type IndexesDatagram struct {
+	Indexes []tailor.IndexInfo `json:"indexes"`
+}
+
+// SaveDatagram tells when the last snapshot was saved.
+type SaveDatagram struct {
+	Stats tailor.SaveStats `json:"stats"`
+}
+
+// LoadDatagram counts the keys of a snapshot by what LOAD did with them.
+type LoadDatagram struct {
+	Result tailor.LoadResult `json:"result"`
+}
+
+// ExportDatagram is a line of the progress of EXPORT and IMPORT, the
+// last line has Progress.Done set, or Error if it failed.
+type ExportDatagram struct {
+	Progress tailor.ExportProgress `json:"progress"`
+	Error    string                `json:"error,omitempty"`
+}
+
+// PopDatagram is the element popped by a blocking pop.
+type PopDatagram struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
+}
+
+const (
+	PushEvent        = "event"
+	PushMessageKind  = "message"
+	PushSubscribe    = "subscribe"
+	PushPSubscribe   = "psubscribe"
+	PushUnsubscribe  = "unsubscribe"
+	PushPUnsubscribe = "punsubscribe"
+	PushError        = "error"
+	PushEnd          = "end"
+)
+
+// PushMessage is written by the server as one JSON line
+// per message while the connection is in push mode.
+type PushMessage struct {
+	Kind   string `json:"kind"`
+	Event  string `json:"event,omitempty"`
+	Key    string `json:"key,omitempty"`
+	NewKey string `json:"newKey,omitempty"`
+	// channel of a message, or the channel or pattern
+	// of a subscription confirmation
+	Channel string `json:"channel,omitempty"`
+	// the pattern which matched the channel of a message
+	Pattern string `json:"pattern,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	// channels and patterns subscribed after a confirmation
+	Count int `json:"count,omitempty"`
+	// unix time in milliseconds
+	Time int64 `json:"time,omitempty"`
+}
+
+func (m *PushMessage) GetJsonLine() ([]byte, error) {
+	jsonBytes, err := json.Marshal(*m)
+	if err != nil {
+		return nil, err
+	}
+	return append(jsonBytes, '\n'), nil
+}
+
+func GetPushMessage(data []byte) (*PushMessage, error) {
+	var m PushMessage
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
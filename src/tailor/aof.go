@@ -0,0 +1,729 @@
+package tailor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The append-only file starts with aofMagic, followed by frames made of
+// the kind (1 byte), the length of the payload (4 bytes), the CRC-32 of
+// the payload (4 bytes) and the payload, a gob encoded aofRecord. A gob
+// stream sends each type once, before the first value of the type, so a
+// frame of kind aofStreamStart begins a new stream, which happens every
+// time the file is opened or rewritten. With snapshot keys, the payload
+// of each frame is encrypted as the snapshots are, see keyring.encrypt.
+//
+// A write is logged as the state of its key after it, which replays the
+// same whatever was logged before. List pushes and pops are logged as
+// ops instead: the state of a list is as long as the list, so logging
+// it on every push would grow the file with the square of its length.
+// Strings and counters are no longer than the ops which write them. As
+// ops do not replay the same twice, the copy of a rewrite is taken on
+// the executor, where no write is halfway logged.
+var aofMagic = []byte("TKVAOF1\n")
+
+const aofFrameHeader = 9
+
+const (
+	aofStreamStart byte = iota + 1
+	aofStreamNext
+)
+
+const (
+	aofPut byte = iota
+	aofDel
+	aofFlushDB
+	aofFlushAll
+	aofSwapDB
+	aofPush
+	aofPop
+)
+
+// aofRecord is the state of a key after a write, an op on a list or
+// an op on whole databases. Replaying the records in order restores
+// the keys.
+type aofRecord struct {
+	Op   byte
+	DB   int
+	Key  string
+	Item Item
+	// the other database of aofSwapDB
+	Other int
+	// the values of aofPush, and the end of the list aofPush and aofPop
+	// write, the Item of aofPush holds the expiration of the list
+	Vals []interface{}
+	Left bool
+}
+
+type FsyncPolicy byte
+
+const (
+	// fsync after every write, which then waits until it is synced
+	FsyncAlways FsyncPolicy = iota
+	// fsync once a second in the background
+	FsyncEverySec
+	// leave it to the operating system
+	FsyncNo
+)
+
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch s {
+	case "always":
+		return FsyncAlways, nil
+	case "everysec":
+		return FsyncEverySec, nil
+	case "no":
+		return FsyncNo, nil
+	default:
+		return 0, fmt.Errorf("invalid fsync policy '%s', it must be always, everysec or no", s)
+	}
+}
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncAlways:
+		return "always"
+	case FsyncEverySec:
+		return "everysec"
+	default:
+		return "no"
+	}
+}
+
+type AOFOptions struct {
+	Fsync FsyncPolicy
+	// the file is rewritten in the background once it is RewritePercentage
+	// larger than after the last rewrite and at least RewriteMinSize bytes.
+	// A percentage not greater than zero turns it off.
+	RewritePercentage int
+	RewriteMinSize    int64
+}
+
+func DefaultAOFOptions() AOFOptions {
+	return AOFOptions{
+		Fsync:             FsyncEverySec,
+		RewritePercentage: 100,
+		RewriteMinSize:    64 << 20,
+	}
+}
+
+type AOFStats struct {
+	Filename string `json:"filename"`
+	Fsync    string `json:"fsync"`
+	// the size of the file, and its size after the last rewrite
+	Size     int64 `json:"size"`
+	BaseSize int64 `json:"baseSize"`
+	// records appended since the file was opened
+	Records uint64 `json:"records"`
+	// records replayed when the file was opened, and the bytes of
+	// a torn record at the end which were cut off
+	Replayed       int   `json:"replayed"`
+	TruncatedBytes int64 `json:"truncatedBytes"`
+	Rewrites       int   `json:"rewrites"`
+	Rewriting      bool  `json:"rewriting"`
+	// unix time (second) of the last rewrite which succeeded
+	LastRewrite      int64  `json:"lastRewrite,omitempty"`
+	LastRewriteError string `json:"lastRewriteError,omitempty"`
+	WriteErrors      uint64 `json:"writeErrors"`
+	LastWriteError   string `json:"lastWriteError,omitempty"`
+}
+
+// aofEncoder encodes the records of one gob stream into frames.
+type aofEncoder struct {
+	buf     bytes.Buffer
+	enc     *gob.Encoder
+	keys    *keyring
+	started bool
+}
+
+func newAOFEncoder(keys *keyring) *aofEncoder {
+	e := &aofEncoder{keys: keys}
+	e.enc = gob.NewEncoder(&e.buf)
+	return e
+}
+
+// reset starts a new stream, the next frame sends the types again.
+func (e *aofEncoder) reset() {
+	e.buf.Reset()
+	e.enc = gob.NewEncoder(&e.buf)
+	e.started = false
+}
+
+// frame appends the frame of rec to dst. A record which cannot be
+// encoded starts a new stream, as the encoder may have sent its types.
+func (e *aofEncoder) frame(dst []byte, rec *aofRecord) (res []byte, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("error encoding the record of '%s'", rec.Key)
+		}
+		if err != nil {
+			e.reset()
+			res = dst
+		}
+	}()
+	if rec.Item.Data != nil {
+		if err = registerGob(rec.Item.Data); err != nil {
+			return dst, err
+		}
+	}
+	for _, val := range rec.Vals {
+		if val != nil {
+			if err = registerGob(val); err != nil {
+				return dst, err
+			}
+		}
+	}
+	e.buf.Reset()
+	if err = e.enc.Encode(rec); err != nil {
+		return dst, err
+	}
+	payload, err := e.keys.encrypt(e.buf.Bytes())
+	if err != nil {
+		return dst, err
+	}
+	kind := aofStreamNext
+	if !e.started {
+		kind = aofStreamStart
+		e.started = true
+	}
+	var header [aofFrameHeader]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[5:9], crc32.ChecksumIEEE(payload))
+	dst = append(dst, header[:]...)
+	return append(dst, payload...), nil
+}
+
+// appendOnlyFile logs every write of all the databases.
+type appendOnlyFile struct {
+	mu       sync.Mutex
+	dbs      []*database
+	exec     *executor
+	keys     *keyring
+	file     *os.File
+	filename string
+	opts     AOFOptions
+	enc      *aofEncoder
+	size     int64
+	baseSize int64
+	dirty    bool
+	stop     chan struct{}
+	done     chan struct{}
+	// rewrite is the encoder of the records written while a rewrite
+	// runs, which are appended to the new file once it is ready
+	pending    bool
+	rewrite    *aofEncoder
+	rewriteBuf []byte
+	rewriteErr error
+
+	records        uint64
+	replayed       int
+	truncated      int64
+	rewrites       int
+	lastRewrite    int64
+	lastRewriteErr string
+	writeErrs      uint64
+	lastWriteErr   string
+}
+
+func newAppendOnlyFile(dbs []*database, keys *keyring, exec *executor) *appendOnlyFile {
+	return &appendOnlyFile{dbs: dbs, keys: keys, exec: exec}
+}
+
+// syncsEveryWrite reports whether the file is open with FsyncAlways.
+func (a *appendOnlyFile) syncsEveryWrite() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file != nil && a.opts.Fsync == FsyncAlways
+}
+
+// log appends the records, it does nothing unless the file is open.
+func (a *appendOnlyFile) log(recs ...aofRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return
+	}
+	var data []byte
+	for i := range recs {
+		var err error
+		if data, err = a.enc.frame(data, &recs[i]); err != nil {
+			a.writeFailed(err)
+			continue
+		}
+		if a.rewrite != nil {
+			if a.rewriteBuf, err = a.rewrite.frame(a.rewriteBuf, &recs[i]); err != nil {
+				a.rewriteErr = err
+			}
+		}
+		a.records++
+	}
+	if len(data) == 0 {
+		return
+	}
+	if _, err := a.file.Write(data); err != nil {
+		// the frames written in part are cut off, and the
+		// stream starts again as they are not in the file
+		a.writeFailed(err)
+		_ = a.file.Truncate(a.size)
+		a.enc = newAOFEncoder(a.keys)
+		return
+	}
+	a.size += int64(len(data))
+	if a.opts.Fsync == FsyncAlways {
+		if err := a.file.Sync(); err != nil {
+			a.writeFailed(err)
+		}
+	} else {
+		a.dirty = true
+	}
+	if !a.pending && a.opts.RewritePercentage > 0 && a.size >= a.opts.RewriteMinSize &&
+		a.size >= a.baseSize+a.baseSize*int64(a.opts.RewritePercentage)/100 {
+		a.pending = true
+		go a.rewriteFile()
+	}
+}
+
+// logKeys appends the current state of the keys of db.
+func (a *appendOnlyFile) logKeys(db *database, keys []string) {
+	if !a.isOpen() {
+		return
+	}
+	recs := make([]aofRecord, len(keys))
+	for i, key := range keys {
+		item, found := db.item(key)
+		if found {
+			recs[i] = aofRecord{Op: aofPut, DB: db.index, Key: key, Item: item}
+		} else {
+			recs[i] = aofRecord{Op: aofDel, DB: db.index, Key: key}
+		}
+	}
+	a.log(recs...)
+}
+
+func (a *appendOnlyFile) isOpen() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file != nil
+}
+
+// writeFailed is called under the lock.
+func (a *appendOnlyFile) writeFailed(err error) {
+	a.writeErrs++
+	a.lastWriteErr = err.Error()
+}
+
+func (a *appendOnlyFile) open(filename string, opts AOFOptions) error {
+	// a rewrite which did not finish before a crash is dropped
+	_ = os.Remove(filename + ".rewrite")
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	replayed, good, err := a.replay(file)
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("cannot replay '%s': %v", filename, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	// a record torn by a crash is cut off
+	truncated := info.Size() - good
+	if truncated > 0 {
+		err = file.Truncate(good)
+	}
+	if err == nil && good == 0 {
+		_, err = file.WriteAt(aofMagic, 0)
+		good = int64(len(aofMagic))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	file, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	a.file = file
+	a.filename = filename
+	a.opts = opts
+	a.enc = newAOFEncoder(a.keys)
+	a.size, a.baseSize = good, good
+	a.records = 0
+	a.replayed, a.truncated = replayed, truncated
+	if opts.Fsync == FsyncEverySec {
+		a.stop, a.done = make(chan struct{}), make(chan struct{})
+		go a.syncEverySecond(a.stop, a.done)
+	}
+	return nil
+}
+
+// replay applies the records of file to the databases, it returns how many
+// records it applied and the size of the file up to the last whole record.
+func (a *appendOnlyFile) replay(file *os.File) (int, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(file)
+	magic := make([]byte, len(aofMagic))
+	if n, err := io.ReadFull(r, magic); err != nil {
+		if n == 0 && err == io.EOF {
+			return 0, 0, nil
+		}
+		return 0, 0, errors.New("not an append-only file")
+	}
+	if !bytes.Equal(magic, aofMagic) {
+		return 0, 0, errors.New("not an append-only file")
+	}
+
+	offset := int64(len(aofMagic))
+	replayed := 0
+	var stream bytes.Buffer
+	var dec *gob.Decoder
+	header := make([]byte, aofFrameHeader)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return replayed, offset, nil
+			}
+			return replayed, offset, err
+		}
+		kind := header[0]
+		n := binary.BigEndian.Uint32(header[1:5])
+		if offset+aofFrameHeader+int64(n) > info.Size() {
+			return replayed, offset, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return replayed, offset, err
+		}
+		if (kind != aofStreamStart && kind != aofStreamNext) ||
+			crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[5:9]) {
+			// only the last record may be torn
+			if _, err := r.Peek(1); err == io.EOF {
+				return replayed, offset, nil
+			}
+			return replayed, offset, fmt.Errorf("record at offset %d is corrupted", offset)
+		}
+		if kind == aofStreamStart {
+			stream.Reset()
+			dec = gob.NewDecoder(&stream)
+		} else if dec == nil {
+			return replayed, offset, fmt.Errorf("record at offset %d is corrupted", offset)
+		}
+		// the frames written before the keys were set are plain
+		if payload, err = a.keys.decrypt(payload); err != nil {
+			return replayed, offset, fmt.Errorf("record at offset %d: %v", offset, err)
+		}
+		stream.Write(payload)
+		var rec aofRecord
+		if err := dec.Decode(&rec); err != nil {
+			return replayed, offset, fmt.Errorf("record at offset %d: %v", offset, err)
+		}
+		if err := a.apply(&rec); err != nil {
+			return replayed, offset, fmt.Errorf("record at offset %d: %v", offset, err)
+		}
+		replayed++
+		offset += aofFrameHeader + int64(n)
+	}
+}
+
+// apply writes rec to the databases, without logging it again.
+func (a *appendOnlyFile) apply(rec *aofRecord) error {
+	if rec.DB < 0 || rec.DB >= len(a.dbs) || rec.Other < 0 || rec.Other >= len(a.dbs) {
+		return fmt.Errorf("database index is out of range 0-%d", len(a.dbs)-1)
+	}
+	db := a.dbs[rec.DB]
+	switch rec.Op {
+	case aofPut:
+		db.discard(rec.Key)
+		if rec.Item.Expired() {
+			return nil
+		}
+		if rec.Item.Expiration < 0 {
+			db.neCache.put(rec.Key, rec.Item)
+		} else {
+			db.exCache.put(rec.Key, rec.Item)
+		}
+	case aofDel:
+		db.discard(rec.Key)
+	case aofFlushDB:
+		db.flush()
+	case aofFlushAll:
+		for _, db := range a.dbs {
+			db.flush()
+		}
+	case aofSwapDB:
+		if rec.DB != rec.Other {
+			db.swap(a.dbs[rec.Other])
+		}
+	case aofPush:
+		return db.replayPush(rec.Key, rec.Vals, rec.Left, rec.Item.Expiration)
+	case aofPop:
+		_, _, err := db.pop(rec.Key, rec.Left)
+		return err
+	default:
+		return fmt.Errorf("unknown op %d", rec.Op)
+	}
+	return nil
+}
+
+func (a *appendOnlyFile) syncEverySecond(stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.sync()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sync does not hold the lock while the file is synced,
+// a rewrite may close the file meanwhile.
+func (a *appendOnlyFile) sync() {
+	a.mu.Lock()
+	file, dirty := a.file, a.dirty
+	a.dirty = false
+	a.mu.Unlock()
+	if file == nil || !dirty {
+		return
+	}
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		a.mu.Lock()
+		a.writeFailed(err)
+		a.mu.Unlock()
+	}
+}
+
+func (a *appendOnlyFile) close() error {
+	a.mu.Lock()
+	file, stop, done := a.file, a.stop, a.done
+	a.file, a.stop, a.done = nil, nil, nil
+	a.mu.Unlock()
+	if file == nil {
+		return nil
+	}
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	err := file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// startRewrite returns an error if the file is not open or a rewrite runs.
+func (a *appendOnlyFile) startRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return errors.New("append-only file is not open")
+	}
+	if a.pending {
+		return errors.New("append-only file is being rewritten")
+	}
+	a.pending = true
+	go a.rewriteFile()
+	return nil
+}
+
+// rewriteFile writes the keys as they are into a new file, which replaces
+// the log once the records written meanwhile are appended to it.
+func (a *appendOnlyFile) rewriteFile() {
+	tmp := a.filename + ".rewrite"
+	err := a.writeKeys(tmp)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err == nil && a.file == nil {
+		err = errors.New("append-only file was closed")
+	}
+	if err == nil {
+		err = a.rewriteErr
+	}
+	if err == nil {
+		err = a.replaceFile(tmp)
+	}
+	a.pending = false
+	a.rewrite, a.rewriteBuf, a.rewriteErr = nil, nil, nil
+	if err != nil {
+		_ = os.Remove(tmp)
+		a.lastRewriteErr = err.Error()
+		return
+	}
+	a.rewrites++
+	a.lastRewrite = time.Now().Unix()
+	a.lastRewriteErr = ""
+}
+
+func (a *appendOnlyFile) writeKeys(filename string) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	newJob := &job{
+		op:   aofrewrite,
+		val:  a,
+		done: make(chan struct{}),
+	}
+	a.exec.execute(newJob)
+	<-newJob.done
+	snap := newJob.res.value.([]map[string]Item)
+
+	w := bufio.NewWriter(file)
+	if _, err = w.Write(aofMagic); err != nil {
+		return err
+	}
+	enc := newAOFEncoder(a.keys)
+	var data []byte
+	for i, items := range snap {
+		for key, item := range items {
+			if item.Expired() {
+				continue
+			}
+			rec := aofRecord{Op: aofPut, DB: i, Key: key, Item: item}
+			if data, err = enc.frame(data[:0], &rec); err != nil {
+				return err
+			}
+			if _, err = w.Write(data); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// beginRewrite runs on the executor, between two writes. It copies the
+// keys, and the records written from then on go to the new file as well.
+func (a *appendOnlyFile) beginRewrite() []map[string]Item {
+	a.mu.Lock()
+	a.rewrite, a.rewriteBuf, a.rewriteErr = newAOFEncoder(a.keys), nil, nil
+	a.mu.Unlock()
+	snap := make([]map[string]Item, len(a.dbs))
+	for i, db := range a.dbs {
+		snap[i] = make(map[string]Item)
+		for _, ch := range db.caches() {
+			ch.copyItems(snap[i])
+		}
+		// the writes logged from now on must not change the
+		// lists and documents of the copy while it is written
+		copyValues(snap[i])
+	}
+	return snap
+}
+
+// replaceFile is called under the lock. The new file is kept open across
+// the rename, so the log goes on in it without opening it again, which
+// could fail once the old file is renamed over. Until the rename, the
+// log goes on in the old file.
+func (a *appendOnlyFile) replaceFile(tmp string) error {
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(a.rewriteBuf)
+	if err == nil {
+		err = file.Sync()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+	if err == nil {
+		err = os.Rename(tmp, a.filename)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	syncDir(filepath.Dir(a.filename))
+	_ = a.file.Close()
+	a.file = file
+	// the records go on in the stream of the records written meanwhile
+	a.enc = a.rewrite
+	a.size, a.baseSize = info.Size(), info.Size()
+	a.dirty = false
+	return nil
+}
+
+// syncDir makes a rename in dir durable, where the system supports it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		_ = d.Close()
+	}
+}
+
+func (a *appendOnlyFile) stats() (AOFStats, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return AOFStats{}, false
+	}
+	return AOFStats{
+		Filename:         a.filename,
+		Fsync:            a.opts.Fsync.String(),
+		Size:             a.size,
+		BaseSize:         a.baseSize,
+		Records:          a.records,
+		Replayed:         a.replayed,
+		TruncatedBytes:   a.truncated,
+		Rewrites:         a.rewrites,
+		Rewriting:        a.pending,
+		LastRewrite:      a.lastRewrite,
+		LastRewriteError: a.lastRewriteErr,
+		WriteErrors:      a.writeErrs,
+		LastWriteError:   a.lastWriteErr,
+	}, true
+}
+
+// OpenAOF replays the append-only file into the databases, then appends
+// the state of every key written from then on to it, and the flushes and
+// swaps of the databases. It is meant to be called once at startup,
+// before the cache is used. The file is created if it does not exist.
+// A record torn by a crash at the end of the file is cut off.
+func (c *Cache) OpenAOF(filename string, opts AOFOptions) error {
+	c.aof.mu.Lock()
+	defer c.aof.mu.Unlock()
+	if c.aof.file != nil {
+		return fmt.Errorf("append-only file '%s' is open already", c.aof.filename)
+	}
+	return c.aof.open(filename, opts)
+}
+
+// RewriteAOF rewrites the append-only file in the background, into one
+// record per key. The writes go on while it runs, Stats shows its state.
+func (c *Cache) RewriteAOF() error {
+	return c.aof.startRewrite()
+}
+
+// CloseAOF syncs and closes the append-only file, Close closes it as well.
+func (c *Cache) CloseAOF() error {
+	return c.aof.close()
+}
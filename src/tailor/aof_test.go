@@ -0,0 +1,537 @@
+package tailor
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openTestAOF(t *testing.T, filename string) *Cache {
+	c := newTestCache(time.Minute, 2)
+	opts := DefaultAOFOptions()
+	opts.Fsync = FsyncAlways
+	if err := c.OpenAOF(filename, opts); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+type unexported struct {
+	x int
+}
+
+func TestAOFRecordNotEncodable(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	c.Set("bad", unexported{1})
+	c.Set("good", "v")
+	c.WaitWrites()
+	if stats, _ := c.aof.stats(); stats.WriteErrors != 1 {
+		t.Fatalf("write errors = %d, want 1", stats.WriteErrors)
+	}
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	if v, _ := c.Get("good"); v != "v" {
+		t.Fatalf("good = %v, want v", v)
+	}
+	if _, found := c.Get("bad"); found {
+		t.Fatal("bad was replayed")
+	}
+}
+
+func TestAOFFlushOrder(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	for i := 0; i < 100; i++ {
+		c.Set("before", i)
+		c.FlushDB()
+		c.Set("after", i)
+		c.FlushAll()
+	}
+	c.Set("after", "live")
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	if _, found := c.Get("before"); found {
+		t.Fatal("before survived the flush")
+	}
+	if v, _ := c.Get("after"); v != "live" {
+		t.Fatalf("after = %v, want live", v)
+	}
+}
+
+func TestAOFFsyncAlwaysWaits(t *testing.T) {
+	c := openTestAOF(t, filepath.Join(tempDir(t), "test.aof"))
+	defer c.Close()
+	for i, write := range []func(){
+		func() { c.Set("a", 1) },
+		func() { c.Setex("b", 2, time.Minute) },
+		func() { c.Del("a") },
+		func() { c.Unlink("b") },
+	} {
+		write()
+		// no WaitWrites, the write is logged once it returns
+		if stats, _ := c.aof.stats(); stats.Records != uint64(i+1) {
+			t.Fatalf("records = %d after write %d", stats.Records, i)
+		}
+	}
+}
+
+func TestAOFEncrypted(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	oldKey := SnapshotKey{ID: "old", Key: bytes.Repeat([]byte{1}, 32)}
+	newKey := SnapshotKey{ID: "new", Key: bytes.Repeat([]byte{2}, 16)}
+
+	// written plain, then with the old key
+	c := openTestAOF(t, filename)
+	c.Set("plain", "p")
+	if err := c.SetSnapshotKeys(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("secret", "s3cr3t")
+	c.Close()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("s3cr3t")) {
+		t.Fatal("the value is in plain text")
+	}
+
+	// without the key it does not replay
+	c = newTestCache(time.Minute, 2)
+	if err := c.OpenAOF(filename, DefaultAOFOptions()); err == nil {
+		t.Fatal("replayed without the key")
+	}
+	c.Close()
+
+	// the plain records are rejected with keys
+	c = newTestCache(time.Minute, 2)
+	if err := c.SetSnapshotKeys(newKey, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OpenAOF(filename, DefaultAOFOptions()); err == nil {
+		t.Fatal("replayed the plain records")
+	}
+	c.Close()
+
+	// rotated, the rewrite encrypts everything by the new key
+	c = newTestCache(time.Minute, 2)
+	if err := c.SetSnapshotKeys(newKey, oldKey); err != nil {
+		t.Fatal(err)
+	}
+	c.AcceptPlainFiles(true)
+	if err := c.OpenAOF(filename, DefaultAOFOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if stats, _ := c.aof.stats(); stats.Rewrites == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the rewrite did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Close()
+
+	c = newTestCache(time.Minute, 2)
+	defer c.Close()
+	if err := c.SetSnapshotKeys(newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OpenAOF(filename, DefaultAOFOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"plain": "p", "secret": "s3cr3t"} {
+		if v, _ := c.Get(key); v != want {
+			t.Fatalf("%s = %v, want %s", key, v, want)
+		}
+	}
+}
+
+func TestAOFReplay(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	db1, _ := c.Select(1)
+	for _, write := range []func(){
+		func() { c.Set("set", "v") },
+		func() { c.Set("overwritten", "old") },
+		func() { c.Set("overwritten", "new") },
+		func() { c.Setex("expiring", "v", time.Hour) },
+		func() { c.Setex("expired", "v", time.Nanosecond) },
+		func() { c.Set("deleted", "v") },
+		func() { c.Del("deleted") },
+		func() { c.Set("unlinked", "v") },
+		func() { c.Unlink("unlinked") },
+		func() { c.Set("n", "1") },
+		func() { _ = c.Incr("n") },
+		func() { c.Set("old", "renamed") },
+		func() { _ = c.Rename("old", "new") },
+		func() { _, _ = c.RPush("list", "a", "b") },
+		func() { db1.Set("flushed", "v") },
+		func() { db1.FlushDB() },
+		func() { db1.Set("swapped", "from 1") },
+		func() { _ = c.SwapDB(0, 1) },
+		func() { _ = c.SwapDB(0, 1) },
+	} {
+		write()
+	}
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	db1, _ = c.Select(1)
+	for _, tc := range []struct {
+		db    *Cache
+		key   string
+		want  interface{}
+		found bool
+	}{
+		{c, "set", "v", true},
+		{c, "overwritten", "new", true},
+		{c, "expiring", "v", true},
+		{c, "expired", nil, false},
+		{c, "deleted", nil, false},
+		{c, "unlinked", nil, false},
+		{c, "n", "2", true},
+		{c, "old", nil, false},
+		{c, "new", "renamed", true},
+		{db1, "flushed", nil, false},
+		{db1, "swapped", "from 1", true},
+		{c, "swapped", nil, false},
+	} {
+		v, found := tc.db.Get(tc.key)
+		if found != tc.found || (found && v != tc.want) {
+			t.Errorf("db %d %s = %v, %v, want %v, %v", tc.db.DB(), tc.key, v, found, tc.want, tc.found)
+		}
+	}
+	if n, _ := c.LLen("list"); n != 2 {
+		t.Errorf("list has %d elements, want 2", n)
+	}
+	if ttl, _ := c.Ttl("expiring"); ttl <= 0 {
+		t.Errorf("expiring has a ttl of %v", ttl)
+	}
+}
+
+func TestAOFTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// tear changes the file of which last is the last record
+		tear func(data []byte, last int) []byte
+		// whether the last record survives, and the bytes cut off
+		keepLast  bool
+		truncated func(last int) int
+		fails     bool
+	}{
+		{
+			name:      "cut in the payload",
+			tear:      func(data []byte, last int) []byte { return data[:len(data)-1] },
+			truncated: func(last int) int { return last - 1 },
+		},
+		{
+			name:      "cut in the header",
+			tear:      func(data []byte, last int) []byte { return data[:len(data)-last+4] },
+			truncated: func(last int) int { return 4 },
+		},
+		{
+			name: "bad checksum",
+			tear: func(data []byte, last int) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			truncated: func(last int) int { return last },
+		},
+		{
+			name:      "partial header after it",
+			tear:      func(data []byte, last int) []byte { return append(data, 1, 0, 0) },
+			keepLast:  true,
+			truncated: func(last int) int { return 3 },
+		},
+		{
+			name: "bad checksum before it",
+			tear: func(data []byte, last int) []byte {
+				data[len(aofMagic)+aofFrameHeader] ^= 0xff
+				return data
+			},
+			fails: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(tempDir(t), "test.aof")
+			c := openTestAOF(t, filename)
+			c.Set("first", "v")
+			before, _ := c.aof.stats()
+			c.Set("last", "v")
+			after, _ := c.aof.stats()
+			c.Close()
+			last := int(after.Size - before.Size)
+
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = tc.tear(data, last)
+			if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			c = newTestCache(time.Minute, 2)
+			err = c.OpenAOF(filename, DefaultAOFOptions())
+			if tc.fails {
+				c.Close()
+				if err == nil {
+					t.Fatal("replayed a corrupted record")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, _ := c.aof.stats()
+			if stats.TruncatedBytes != int64(tc.truncated(last)) {
+				t.Errorf("cut off %d bytes, want %d", stats.TruncatedBytes, tc.truncated(last))
+			}
+			if _, found := c.Get("last"); found != tc.keepLast {
+				t.Errorf("last found = %v", found)
+			}
+			// the log goes on after the cut
+			c.Set("next", "v")
+			c.Close()
+
+			c = openTestAOF(t, filename)
+			defer c.Close()
+			for _, key := range []string{"first", "next"} {
+				if _, found := c.Get(key); !found {
+					t.Errorf("%s was not replayed", key)
+				}
+			}
+			if stats, _ := c.aof.stats(); stats.TruncatedBytes != 0 {
+				t.Errorf("cut off %d bytes the second time", stats.TruncatedBytes)
+			}
+		})
+	}
+}
+
+// The writes made while the file is rewritten go to both files, and
+// the log goes on in the stream of the new file after the handover.
+func TestAOFRewriteHandover(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	for i := 0; i < 20000; i++ {
+		c.Set("key"+strconv.Itoa(i%5000), i)
+	}
+	before, _ := c.aof.stats()
+	if err := c.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	meanwhile := 0
+	for deadline := time.Now().Add(10 * time.Second); ; meanwhile++ {
+		stats, _ := c.aof.stats()
+		if stats.Rewrites == 1 {
+			break
+		}
+		if stats.LastRewriteError != "" {
+			t.Fatal(stats.LastRewriteError)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the rewrite did not finish")
+		}
+		c.Set("meanwhile", meanwhile)
+		c.Del("key" + strconv.Itoa(meanwhile%5000))
+	}
+	// one record per key is left of the 20000 records
+	if stats, _ := c.aof.stats(); stats.BaseSize >= before.Size/2 {
+		t.Fatalf("size %d after the rewrite, %d before it", stats.BaseSize, before.Size)
+	}
+	c.Set("after", "v")
+	c.Del("key4999")
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	if v, _ := c.Get("meanwhile"); meanwhile > 0 && v != meanwhile-1 {
+		t.Errorf("meanwhile = %v, want %d", v, meanwhile-1)
+	}
+	if v, _ := c.Get("after"); v != "v" {
+		t.Errorf("after = %v", v)
+	}
+	for i := 0; i < 5000; i++ {
+		key := "key" + strconv.Itoa(i)
+		v, found := c.Get(key)
+		deleted := i < meanwhile || i == 4999
+		if found == deleted || (found && v != 15000+i) {
+			t.Fatalf("%s = %v, %v", key, v, found)
+		}
+	}
+}
+
+// A failed rewrite leaves the log in the old file.
+func TestAOFRewriteFails(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	c.Set("before", "v")
+	// the new file cannot be created where a directory is
+	if err := os.Mkdir(filename+".rewrite", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		stats, _ := c.aof.stats()
+		if stats.LastRewriteError != "" {
+			break
+		}
+		if stats.Rewrites > 0 || time.Now().After(deadline) {
+			t.Fatal("the rewrite did not fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.Set("after", "v")
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	for _, key := range []string{"before", "after"} {
+		if v, _ := c.Get(key); v != "v" {
+			t.Errorf("%s = %v, want v", key, v)
+		}
+	}
+}
+
+// popAll pops the list of key from the head.
+func popAll(c *Cache, key string) []interface{} {
+	var vals []interface{}
+	for {
+		v, found, _ := c.LPop(key)
+		if !found {
+			return vals
+		}
+		vals = append(vals, v)
+	}
+}
+
+// The pushes and pops are logged as ops, not as the whole list.
+func TestAOFListOps(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	size := func() int64 {
+		stats, _ := c.aof.stats()
+		return stats.Size
+	}
+	start := size()
+	for i := 0; i < 100; i++ {
+		_, _ = c.RPush("long", strconv.Itoa(i))
+	}
+	first := size() - start
+	for i := 100; i < 1000; i++ {
+		_, _ = c.RPush("long", strconv.Itoa(i))
+	}
+	start = size()
+	for i := 1000; i < 1100; i++ {
+		_, _ = c.RPush("long", strconv.Itoa(i))
+	}
+	if last := size() - start; last > first*2 {
+		t.Fatalf("100 pushes onto 1000 elements take %d bytes, onto none %d", last, first)
+	}
+
+	_, _ = c.RPush("list", "b", "c")
+	_, _ = c.LPush("list", "a", "0")
+	_, _ = c.RPush("list", "d")
+	_, _, _ = c.LPop("list")
+	_, _, _ = c.RPop("list")
+	_, _, _ = c.BRPop([]string{"list"}, time.Second, nil)
+	_, _ = c.RPush("emptied", "v")
+	_, _, _ = c.LPop("emptied")
+	// the push served a blocked pop, which took one of its values
+	popped := make(chan struct{})
+	go func() {
+		defer close(popped)
+		_, _, _ = c.BLPop([]string{"served"}, 0, nil)
+	}()
+	waitBlocked(t, c, "served", 1)
+	_, _ = c.RPush("served", "x", "y")
+	<-popped
+	list := &LinkedList{}
+	list.AddLast("e")
+	c.Setex("expiring", list, time.Hour)
+	_, _ = c.RPush("expiring", "f")
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	if n, _ := c.LLen("long"); n != 1100 {
+		t.Errorf("long has %d elements", n)
+	}
+	for _, tc := range []struct {
+		key  string
+		want []interface{}
+	}{
+		{"list", []interface{}{"a", "b"}},
+		{"emptied", nil},
+		{"served", []interface{}{"y"}},
+		{"expiring", []interface{}{"e", "f"}},
+	} {
+		if tc.key == "expiring" {
+			if ttl, _ := c.Ttl("expiring"); ttl <= 0 {
+				t.Errorf("expiring has a ttl of %v", ttl)
+			}
+		}
+		if vals := popAll(c, tc.key); !reflect.DeepEqual(vals, tc.want) {
+			t.Errorf("%s = %v, want %v", tc.key, vals, tc.want)
+		}
+	}
+}
+
+// The lists pushed while a rewrite runs are neither in the copy and
+// in the records written meanwhile, nor in none of them.
+func TestAOFRewriteLists(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "test.aof")
+	c := openTestAOF(t, filename)
+	// the list is long, so the pushes go on while it is written
+	pushed := 0
+	for ; pushed < 2000; pushed++ {
+		_, _ = c.RPush("list", pushed)
+	}
+	if err := c.RewriteAOF(); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; pushed++ {
+		stats, _ := c.aof.stats()
+		if stats.Rewrites == 1 {
+			break
+		}
+		if stats.LastRewriteError != "" {
+			t.Fatal(stats.LastRewriteError)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the rewrite did not finish")
+		}
+		_, _ = c.RPush("list", pushed)
+	}
+	c.Close()
+
+	c = openTestAOF(t, filename)
+	defer c.Close()
+	vals := popAll(c, "list")
+	if len(vals) != pushed {
+		t.Fatalf("list has %d elements, want %d", len(vals), pushed)
+	}
+	for i, v := range vals {
+		if v != i {
+			t.Fatalf("element %d is %v", i, v)
+		}
+	}
+}
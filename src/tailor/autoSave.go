@@ -0,0 +1,224 @@
+package tailor
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a snapshot which failed is not retried by the policies sooner than this
+const saveRetryDelay = 5 * time.Second
+
+// SavePolicy saves a snapshot once at least Changes writes were made
+// and at least Seconds passed since the last snapshot, like the save
+// directive of Redis.
+type SavePolicy struct {
+	Seconds int
+	Changes uint64
+}
+
+type SaveStats struct {
+	// writes since the last snapshot which succeeded
+	Dirty uint64 `json:"dirty"`
+	// unix time (second) of the last snapshot which succeeded, 0 if none
+	LastSave int64 `json:"lastSave"`
+	// how long the last snapshot took (millisecond)
+	LastSaveMillis int64  `json:"lastSaveMillis"`
+	LastError      string `json:"lastError,omitempty"`
+	// a background snapshot is being written
+	InProgress bool `json:"inProgress"`
+	Saves      int  `json:"saves"`
+}
+
+// saver counts the writes since the last snapshot and
+// saves snapshots by the policies in the background.
+type saver struct {
+	dirty uint64
+
+	mu         sync.Mutex
+	inProgress bool
+	// the policies count from the last snapshot, or from the start
+	since      time.Time
+	lastSave   time.Time
+	lastTry    time.Time
+	lastFailed bool
+	lastErr    string
+	lastTook   time.Duration
+	saves      int
+	filename   string
+	interval   time.Duration
+	policies   []SavePolicy
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func newSaver() *saver {
+	return &saver{since: time.Now()}
+}
+
+func (s *saver) changed(n int) {
+	atomic.AddUint64(&s.dirty, uint64(n))
+}
+
+// saved subtracts the n writes a snapshot saved, down to zero at
+// most, since Save and a background save may both have counted them.
+func (s *saver) saved(n uint64) {
+	for {
+		dirty := atomic.LoadUint64(&s.dirty)
+		left := uint64(0)
+		if dirty > n {
+			left = dirty - n
+		}
+		if atomic.CompareAndSwapUint64(&s.dirty, dirty, left) {
+			return
+		}
+	}
+}
+
+// begin returns false if a background snapshot is being written.
+func (s *saver) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inProgress {
+		return false
+	}
+	s.inProgress = true
+	return true
+}
+
+// save writes the snapshot, the writes made while it is
+// written are still counted as not saved afterwards.
+func (s *saver) save(c *Cache, filename string, background bool) error {
+	dirty := atomic.LoadUint64(&s.dirty)
+	start := time.Now()
+	err := c.saveFile(filename)
+	end := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if background {
+		s.inProgress = false
+	}
+	s.lastTry = end
+	s.lastFailed = err != nil
+	if err != nil {
+		s.lastErr = err.Error()
+		return err
+	}
+	s.saved(dirty)
+	s.since, s.lastSave = start, end
+	s.lastTook = end.Sub(start)
+	s.lastErr = ""
+	s.saves++
+	return nil
+}
+
+// due reports whether a policy or the interval asks for a snapshot.
+func (s *saver) due(now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inProgress || (s.lastFailed && now.Sub(s.lastTry) < saveRetryDelay) {
+		return "", false
+	}
+	dirty := atomic.LoadUint64(&s.dirty)
+	elapsed := now.Sub(s.since)
+	for _, p := range s.policies {
+		if dirty >= p.Changes && elapsed >= time.Duration(p.Seconds)*time.Second {
+			return s.filename, true
+		}
+	}
+	if s.interval > 0 && dirty > 0 && elapsed >= s.interval {
+		return s.filename, true
+	}
+	return "", false
+}
+
+func (s *saver) run(c *Cache, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if filename, ok := s.due(now); ok && s.begin() {
+				_ = s.save(c, filename, true)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// configure replaces the policies, and starts or stops the loop.
+func (s *saver) configure(c *Cache, filename string, interval time.Duration, policies []SavePolicy) {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.filename, s.interval, s.policies = filename, interval, policies
+	s.stop, s.done = nil, nil
+	if interval > 0 || len(policies) > 0 {
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+		go s.run(c, s.stop, s.done)
+	}
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (s *saver) stats() SaveStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := SaveStats{
+		Dirty:          atomic.LoadUint64(&s.dirty),
+		LastSaveMillis: int64(s.lastTook / time.Millisecond),
+		LastError:      s.lastErr,
+		InProgress:     s.inProgress,
+		Saves:          s.saves,
+	}
+	if !s.lastSave.IsZero() {
+		stats.LastSave = s.lastSave.Unix()
+	}
+	return stats
+}
+
+// SetAutoSave saves snapshots into filename in the background, whenever any
+// of the policies is met or, if interval is greater than zero, once interval
+// has passed since the last snapshot and anything was written. No policies
+// and no interval turn it off.
+func (c *Cache) SetAutoSave(filename string, interval time.Duration, policies ...SavePolicy) error {
+	for _, p := range policies {
+		if p.Seconds < 0 || p.Changes == 0 {
+			return fmt.Errorf("invalid save policy of %d seconds and %d changes, it needs at least one change",
+				p.Seconds, p.Changes)
+		}
+	}
+	c.saves.configure(c, filename, interval, policies)
+	return nil
+}
+
+// BgSave saves a snapshot into filename in the background,
+// SaveStats tells when it is done and whether it succeeded.
+func (c *Cache) BgSave(filename string) error {
+	if !c.saves.begin() {
+		return errors.New("a background save is in progress")
+	}
+	go func() {
+		_ = c.saves.save(c, filename, true)
+	}()
+	return nil
+}
+
+// LastSave returns when the last snapshot which succeeded was
+// saved, the zero time if none was saved since the start.
+func (c *Cache) LastSave() time.Time {
+	c.saves.mu.Lock()
+	defer c.saves.mu.Unlock()
+	return c.saves.lastSave
+}
+
+func (c *Cache) SaveStats() SaveStats {
+	return c.saves.stats()
+}
@@ -0,0 +1,84 @@
+package tailor
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSaverSaved(t *testing.T) {
+	for _, tc := range []struct {
+		changed   int
+		saved     []uint64
+		wantDirty uint64
+	}{
+		{10, []uint64{4}, 6},
+		{10, []uint64{10}, 0},
+		{10, []uint64{10, 10}, 0},
+		{10, []uint64{6, 6}, 0},
+		{0, []uint64{1}, 0},
+	} {
+		s := newSaver()
+		s.changed(tc.changed)
+		for _, n := range tc.saved {
+			s.saved(n)
+		}
+		if dirty := s.stats().Dirty; dirty != tc.wantDirty {
+			t.Errorf("%d changed, %v saved: dirty = %d, want %d", tc.changed, tc.saved, dirty, tc.wantDirty)
+		}
+	}
+}
+
+func TestSaveWithBgSave(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	dir := tempDir(t)
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 100; i++ {
+			c.Set(strconv.Itoa(i), i)
+		}
+		c.WaitWrites()
+		if err := c.BgSave(filepath.Join(dir, "bg.tkv")); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SaveFile(filepath.Join(dir, "fg.tkv")); err != nil {
+			t.Fatal(err)
+		}
+		for c.SaveStats().InProgress {
+			time.Sleep(time.Millisecond)
+		}
+		if dirty := c.SaveStats().Dirty; dirty != 0 {
+			t.Fatalf("round %d: dirty = %d after both saves", round, dirty)
+		}
+	}
+}
+
+func TestSaveToChan(t *testing.T) {
+	c := NewCache(0, time.Minute, time.Second, 4, map[string]Item{
+		"k": {Data: "v", Expiration: -1},
+	})
+	defer c.Close()
+	dir := tempDir(t)
+	for _, tc := range []struct {
+		filename string
+		ok       bool
+	}{
+		{filepath.Join(dir, "saved.tkv"), true},
+		{filepath.Join(dir, "missing", "saved.tkv"), false},
+	} {
+		ok := make(chan bool, 2)
+		c.Save(tc.filename, ok)
+		if <-ok != tc.ok || <-ok != tc.ok {
+			t.Errorf("%s: want %v twice", tc.filename, tc.ok)
+		}
+	}
+	loaded := NewCache(0, time.Minute, time.Second, 4, nil)
+	defer loaded.Close()
+	if err := loaded.Load(filepath.Join(dir, "saved.tkv")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := loaded.Get("k"); v != "v" {
+		t.Fatalf("k = %v, want v", v)
+	}
+}
@@ -0,0 +1,151 @@
+package tailor
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	waiting int32 = iota
+	// the waiter has been claimed by a pusher or by its owner,
+	// whoever claims it first decides how it ends.
+	claimed
+)
+
+// waiter is a blocked pop on one or more lists.
+type waiter struct {
+	keys  []string
+	left  bool
+	state int32
+	// res receives the popped element once a pusher claims the waiter,
+	// or nil if the list expired before the element was popped.
+	res chan *KV
+}
+
+func (w *waiter) claim() bool {
+	return atomic.CompareAndSwapInt32(&w.state, waiting, claimed)
+}
+
+// waitRegistry keeps the blocked pops of each list in arrival order.
+// Waiters are registered and served by the serial write path of the
+// executor, so an element is never pushed between a failed pop and
+// the registration of its waiter.
+type waitRegistry struct {
+	mu     sync.Mutex
+	queues map[string][]*waiter
+}
+
+func newWaitRegistry() *waitRegistry {
+	return &waitRegistry{
+		queues: make(map[string][]*waiter),
+	}
+}
+
+func (r *waitRegistry) register(w *waiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range w.keys {
+		r.queues[key] = append(r.queues[key], w)
+	}
+}
+
+// remove drops w from the queues of all its keys.
+func (r *waitRegistry) remove(w *waiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range w.keys {
+		queue := r.queues[key]
+		for i := range queue {
+			if queue[i] == w {
+				queue = append(queue[:i], queue[i+1:]...)
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(r.queues, key)
+		} else {
+			r.queues[key] = queue
+		}
+	}
+}
+
+// next claims the oldest waiter of key which is still waiting,
+// the waiters which gave up meanwhile are dropped on the way.
+func (r *waitRegistry) next(key string) *waiter {
+	r.mu.Lock()
+	var w *waiter
+	for len(r.queues[key]) > 0 {
+		head := r.queues[key][0]
+		r.queues[key] = r.queues[key][1:]
+		if head.claim() {
+			w = head
+			break
+		}
+	}
+	if len(r.queues[key]) == 0 {
+		delete(r.queues, key)
+	}
+	r.mu.Unlock()
+	if w != nil {
+		r.remove(w)
+	}
+	return w
+}
+
+// keys returns the keys which have blocked pops.
+func (r *waitRegistry) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]string, 0, len(r.queues))
+	for key := range r.queues {
+		res = append(res, key)
+	}
+	return res
+}
+
+func (r *waitRegistry) blocked(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queues[key]) > 0
+}
+
+// serveWaiters hands the elements of the list of key
+// to its waiters, one element per waiter, oldest first.
+func (c *Cache) serveWaiters(key string) {
+	for c.waits.blocked(key) {
+		if n, _ := c.llen(key); n == 0 {
+			return
+		}
+		w := c.waits.next(key)
+		if w == nil {
+			return
+		}
+		val, found, _ := c.pop(key, w.left)
+		if !found {
+			w.res <- nil
+			return
+		}
+		w.res <- &KV{key, val}
+	}
+}
+
+// bpop pops from the first non-empty list of keys,
+// or registers a waiter if all of them are empty.
+func (c *Cache) bpop(keys []string, left bool) (KV, *waiter, error) {
+	for _, key := range keys {
+		val, found, err := c.pop(key, left)
+		if err != nil {
+			return KV{}, nil, err
+		}
+		if found {
+			return KV{key, val}, nil, nil
+		}
+	}
+	w := &waiter{
+		keys: keys,
+		left: left,
+		res:  make(chan *KV, 1),
+	}
+	c.waits.register(w)
+	return KV{}, w, nil
+}
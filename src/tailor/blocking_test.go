@@ -0,0 +1,148 @@
+package tailor
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until n pops are blocked on key.
+func waitBlocked(t *testing.T, c *Cache, key string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.waits.mu.Lock()
+		blocked := len(c.waits.queues[key])
+		c.waits.mu.Unlock()
+		if blocked == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d pops are blocked on %s, want %d", blocked, key, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBlockingPopFIFO(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	const n = 5
+	got := make([]chan interface{}, n)
+	for i := range got {
+		got[i] = make(chan interface{}, 1)
+		go func(res chan<- interface{}) {
+			kv, ok, err := c.BLPop([]string{"list"}, 0, nil)
+			if err != nil || !ok {
+				res <- fmt.Sprint("not popped: ", err)
+				return
+			}
+			res <- kv.Val()
+		}(got[i])
+		// the pops are blocked in this order
+		waitBlocked(t, c, "list", i+1)
+	}
+	vals := make([]interface{}, n)
+	for i := range vals {
+		vals[i] = i
+	}
+	if _, err := c.RPush("list", vals...); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if v := <-got[i]; v != i {
+			t.Errorf("pop %d got %v", i, v)
+		}
+	}
+	if n, _ := c.LLen("list"); n != 0 {
+		t.Errorf("%d elements are left", n)
+	}
+}
+
+func TestBlockingPopTimeout(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	start := time.Now()
+	_, ok, err := c.BRPop([]string{"a", "b"}, 50*time.Millisecond, nil)
+	if err != nil || ok {
+		t.Fatalf("ok = %v, err = %v", ok, err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("returned after %v", d)
+	}
+	waitBlocked(t, c, "a", 0)
+	waitBlocked(t, c, "b", 0)
+
+	// a pushed element is not taken by the pop which timed out
+	c.RPush("a", "v")
+	if n, _ := c.LLen("a"); n != 1 {
+		t.Errorf("a has %d elements", n)
+	}
+}
+
+func TestBlockingPopCancel(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+
+	t.Run("blocked", func(t *testing.T) {
+		cancel := make(chan struct{})
+		res := make(chan bool, 1)
+		go func() {
+			_, ok, _ := c.BLPop([]string{"list"}, 0, cancel)
+			res <- ok
+		}()
+		waitBlocked(t, c, "list", 1)
+		close(cancel)
+		if <-res {
+			t.Fatal("the cancelled pop popped")
+		}
+		waitBlocked(t, c, "list", 0)
+		c.RPush("list", "v")
+		if v, found, _ := c.LPop("list"); !found || v != "v" {
+			t.Errorf("list has %v", v)
+		}
+	})
+
+	// an element pushed while a pop is cancelled goes to that pop
+	// or to the next one, it is neither lost nor popped twice
+	t.Run("handed over", func(t *testing.T) {
+		for i := 0; i < 200; i++ {
+			cancel := make(chan struct{})
+			first := make(chan bool, 1)
+			go func() {
+				kv, ok, _ := c.BLPop([]string{"list"}, 0, cancel)
+				first <- ok && kv.Val() == i
+			}()
+			waitBlocked(t, c, "list", 1)
+			cancelNext := make(chan struct{})
+			next := make(chan bool, 1)
+			go func() {
+				kv, ok, _ := c.BLPop([]string{"list"}, 0, cancelNext)
+				next <- ok && kv.Val() == i
+			}()
+			waitBlocked(t, c, "list", 2)
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				close(cancel)
+			}()
+			go func() {
+				defer wg.Done()
+				c.RPush("list", i)
+			}()
+			wg.Wait()
+			popped := <-first
+			if popped {
+				close(cancelNext)
+			}
+			if <-next == popped {
+				t.Fatalf("round %d: popped by the cancelled pop: %v, by the next pop: %v", i, popped, !popped)
+			}
+			if n, _ := c.LLen("list"); n != 0 {
+				t.Fatalf("round %d: %d elements are left", i, n)
+			}
+		}
+	})
+}
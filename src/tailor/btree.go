@@ -0,0 +1,235 @@
+package tailor
+
+import "sort"
+
+// every node but the root holds btreeDegree-1 to 2*btreeDegree-1 keys
+const btreeDegree = 32
+
+const btreeMaxKeys = 2*btreeDegree - 1
+
+// btree keeps a set of keys in lexicographic order.
+type btree struct {
+	root   *bnode
+	length int
+}
+
+// bnode is a leaf if it has no children,
+// otherwise it has one child more than keys.
+type bnode struct {
+	keys     []string
+	children []*bnode
+}
+
+func newBtree(items map[string]Item) *btree {
+	t := &btree{}
+	for k := range items {
+		t.insert(k)
+	}
+	return t
+}
+
+func (t *btree) insert(key string) {
+	if t.root == nil {
+		t.root = &bnode{keys: []string{key}}
+		t.length++
+		return
+	}
+	if len(t.root.keys) >= btreeMaxKeys {
+		old := t.root
+		t.root = &bnode{children: []*bnode{old}}
+		t.root.splitChild(0)
+	}
+	if t.root.insert(key) {
+		t.length++
+	}
+}
+
+func (t *btree) remove(key string) {
+	if t.root == nil {
+		return
+	}
+	if t.root.remove(key) {
+		t.length--
+	}
+	if len(t.root.keys) == 0 {
+		if t.root.leaf() {
+			t.root = nil
+		} else {
+			t.root = t.root.children[0]
+		}
+	}
+}
+
+// ascend calls fn with the keys from start on in order until fn returns false.
+func (t *btree) ascend(start string, fn func(key string) bool) {
+	if t.root != nil {
+		t.root.ascend(start, fn)
+	}
+}
+
+func (n *bnode) leaf() bool {
+	return len(n.children) == 0
+}
+
+// find returns the index of the first key not less than key.
+func (n *bnode) find(key string) (int, bool) {
+	i := sort.SearchStrings(n.keys, key)
+	return i, i < len(n.keys) && n.keys[i] == key
+}
+
+func (n *bnode) insert(key string) bool {
+	i, found := n.find(key)
+	if found {
+		return false
+	}
+	if n.leaf() {
+		n.keys = insertString(n.keys, i, key)
+		return true
+	}
+	// split a full child on the way down, so that
+	// a split never has to go back up.
+	if len(n.children[i].keys) >= btreeMaxKeys {
+		n.splitChild(i)
+		switch {
+		case key == n.keys[i]:
+			return false
+		case key > n.keys[i]:
+			i++
+		}
+	}
+	return n.children[i].insert(key)
+}
+
+// splitChild moves the middle key of the full child i up into n.
+func (n *bnode) splitChild(i int) {
+	child := n.children[i]
+	mid := btreeDegree - 1
+	right := &bnode{
+		keys: append([]string(nil), child.keys[mid+1:]...),
+	}
+	if !child.leaf() {
+		right.children = append([]*bnode(nil), child.children[mid+1:]...)
+		child.children = child.children[:mid+1]
+	}
+	midKey := child.keys[mid]
+	child.keys = child.keys[:mid]
+	n.keys = insertString(n.keys, i, midKey)
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = right
+}
+
+// remove makes sure that the child it goes down to has at least
+// btreeDegree keys, so that a removal never has to go back up.
+func (n *bnode) remove(key string) bool {
+	i, found := n.find(key)
+	if n.leaf() {
+		if !found {
+			return false
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		return true
+	}
+	if found {
+		switch {
+		case len(n.children[i].keys) >= btreeDegree:
+			pred := n.children[i].max()
+			n.keys[i] = pred
+			return n.children[i].remove(pred)
+		case len(n.children[i+1].keys) >= btreeDegree:
+			succ := n.children[i+1].min()
+			n.keys[i] = succ
+			return n.children[i+1].remove(succ)
+		default:
+			n.merge(i)
+			return n.children[i].remove(key)
+		}
+	}
+	if len(n.children[i].keys) < btreeDegree {
+		switch {
+		case i > 0 && len(n.children[i-1].keys) >= btreeDegree:
+			n.borrowLeft(i)
+		case i < len(n.keys) && len(n.children[i+1].keys) >= btreeDegree:
+			n.borrowRight(i)
+		case i < len(n.keys):
+			n.merge(i)
+		default:
+			n.merge(i - 1)
+			i--
+		}
+	}
+	return n.children[i].remove(key)
+}
+
+// merge joins child i, key i and child i+1 into child i.
+func (n *bnode) merge(i int) {
+	child, sibling := n.children[i], n.children[i+1]
+	child.keys = append(child.keys, n.keys[i])
+	child.keys = append(child.keys, sibling.keys...)
+	child.children = append(child.children, sibling.children...)
+	n.keys = append(n.keys[:i], n.keys[i+1:]...)
+	n.children = append(n.children[:i+1], n.children[i+2:]...)
+}
+
+// borrowLeft rotates the last key of child i-1 through n into child i.
+func (n *bnode) borrowLeft(i int) {
+	child, left := n.children[i], n.children[i-1]
+	last := len(left.keys) - 1
+	child.keys = insertString(child.keys, 0, n.keys[i-1])
+	n.keys[i-1] = left.keys[last]
+	left.keys = left.keys[:last]
+	if !left.leaf() {
+		moved := left.children[last+1]
+		left.children = left.children[:last+1]
+		child.children = append([]*bnode{moved}, child.children...)
+	}
+}
+
+// borrowRight rotates the first key of child i+1 through n into child i.
+func (n *bnode) borrowRight(i int) {
+	child, right := n.children[i], n.children[i+1]
+	child.keys = append(child.keys, n.keys[i])
+	n.keys[i] = right.keys[0]
+	right.keys = append(right.keys[:0], right.keys[1:]...)
+	if !right.leaf() {
+		child.children = append(child.children, right.children[0])
+		right.children = append(right.children[:0], right.children[1:]...)
+	}
+}
+
+func (n *bnode) min() string {
+	for !n.leaf() {
+		n = n.children[0]
+	}
+	return n.keys[0]
+}
+
+func (n *bnode) max() string {
+	for !n.leaf() {
+		n = n.children[len(n.children)-1]
+	}
+	return n.keys[len(n.keys)-1]
+}
+
+func (n *bnode) ascend(start string, fn func(key string) bool) bool {
+	i, _ := n.find(start)
+	for ; i < len(n.keys); i++ {
+		if !n.leaf() && !n.children[i].ascend(start, fn) {
+			return false
+		}
+		if !fn(n.keys[i]) {
+			return false
+		}
+	}
+	if !n.leaf() {
+		return n.children[len(n.keys)].ascend(start, fn)
+	}
+	return true
+}
+
+func insertString(s []string, i int, v string) []string {
+	s = append(s, "")
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
@@ -0,0 +1,248 @@
+package tailor
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func btreeKey(i int) string {
+	return fmt.Sprintf("%05d", i)
+}
+
+func btreeKeys(from, to int) []string {
+	var keys []string
+	for i := from; i < to; i++ {
+		keys = append(keys, btreeKey(i))
+	}
+	return keys
+}
+
+func shuffled(keys []string, seed int64) []string {
+	res := append([]string(nil), keys...)
+	rand.New(rand.NewSource(seed)).Shuffle(len(res), func(i, j int) {
+		res[i], res[j] = res[j], res[i]
+	})
+	return res
+}
+
+func everyNth(keys []string, n int) []string {
+	var res []string
+	for i := 0; i < len(keys); i += n {
+		res = append(res, keys[i])
+	}
+	return res
+}
+
+func reversed(keys []string) []string {
+	res := make([]string, len(keys))
+	for i, key := range keys {
+		res[len(keys)-1-i] = key
+	}
+	return res
+}
+
+// checkBtree checks the bounds of the nodes, that the leaves are at the same
+// depth and that the keys are in order, it returns the height of the tree.
+func checkBtree(t *testing.T, tree *btree) int {
+	t.Helper()
+	if tree.root == nil {
+		if tree.length != 0 {
+			t.Fatalf("empty tree of length %d", tree.length)
+		}
+		return 0
+	}
+	leafDepth := -1
+	var walk func(n *bnode, depth int, root bool)
+	walk = func(n *bnode, depth int, root bool) {
+		if !root && (len(n.keys) < btreeDegree-1 || len(n.keys) > btreeMaxKeys) {
+			t.Fatalf("node at depth %d has %d keys", depth, len(n.keys))
+		}
+		if n.leaf() {
+			if leafDepth >= 0 && leafDepth != depth {
+				t.Fatalf("leaves at depths %d and %d", leafDepth, depth)
+			}
+			leafDepth = depth
+			return
+		}
+		if len(n.children) != len(n.keys)+1 {
+			t.Fatalf("node has %d keys and %d children", len(n.keys), len(n.children))
+		}
+		for _, child := range n.children {
+			walk(child, depth+1, false)
+		}
+	}
+	walk(tree.root, 1, true)
+
+	var keys []string
+	tree.ascend("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if !sort.StringsAreSorted(keys) || len(keys) != tree.length {
+		t.Fatalf("%d keys in order %v, length %d", len(keys), sort.StringsAreSorted(keys), tree.length)
+	}
+	return leafDepth
+}
+
+func TestBtree(t *testing.T) {
+	all := btreeKeys(0, 5000)
+	for _, tc := range []struct {
+		name    string
+		inserts []string
+		removes []string
+		// height after the inserts, 0 for any
+		height int
+	}{
+		{"one leaf", btreeKeys(0, btreeMaxKeys), nil, 1},
+		{"split the root", btreeKeys(0, btreeMaxKeys+1), nil, 2},
+		{"split ascending", all, nil, 3},
+		{"split descending", reversed(all), nil, 3},
+		{"split at random", shuffled(all, 1), nil, 0},
+		{"duplicates", append(btreeKeys(0, 100), btreeKeys(0, 100)...), nil, 2},
+		{"merge into the root", btreeKeys(0, btreeMaxKeys+1), btreeKeys(0, btreeMaxKeys+1), 2},
+		{"borrow from the right", all, btreeKeys(0, 2500), 3},
+		{"borrow from the left", all, reversed(btreeKeys(2500, 5000)), 3},
+		{"remove at random", shuffled(all, 2), shuffled(all, 3), 0},
+		{"remove every third", all, everyNth(all, 3), 3},
+		{"remove missing", btreeKeys(0, 100), btreeKeys(100, 200), 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tree := &btree{}
+			want := make(map[string]bool)
+			for _, key := range tc.inserts {
+				tree.insert(key)
+				want[key] = true
+			}
+			if height := checkBtree(t, tree); tc.height > 0 && height != tc.height {
+				t.Fatalf("height %d, want %d", height, tc.height)
+			}
+			for i, key := range tc.removes {
+				tree.remove(key)
+				delete(want, key)
+				if i%97 == 0 {
+					checkBtree(t, tree)
+				}
+			}
+			checkBtree(t, tree)
+
+			var got []string
+			tree.ascend("", func(key string) bool {
+				got = append(got, key)
+				return true
+			})
+			var keys []string
+			for key := range want {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(got, keys) {
+				t.Fatalf("got %d keys, want %d", len(got), len(keys))
+			}
+		})
+	}
+}
+
+// leaves returns a node whose children are leaves of the given sizes,
+// with all the keys numbered in order.
+func leaves(sizes ...int) *bnode {
+	n := &bnode{}
+	next := 0
+	for i, size := range sizes {
+		if i > 0 {
+			n.keys = append(n.keys, btreeKey(next))
+			next++
+		}
+		n.children = append(n.children, &bnode{keys: btreeKeys(next, next+size)})
+		next += size
+	}
+	return n
+}
+
+func TestBnodeRemoveRebalances(t *testing.T) {
+	min := btreeDegree - 1
+	for _, tc := range []struct {
+		name   string
+		node   *bnode
+		remove string
+		// the sizes of the children afterwards
+		sizes []int
+	}{
+		// the key goes down to a child of the minimum size
+		{"borrow from the left", leaves(min+1, min), btreeKey(min + 2), []int{min, min}},
+		{"borrow from the right", leaves(min, min+1), btreeKey(0), []int{min, min}},
+		{"merge with the right", leaves(min, min), btreeKey(0), []int{2 * min}},
+		{"merge with the left", leaves(min, min, min), btreeKey(3*min + 1), []int{min, 2 * min}},
+		// the key is in the node itself
+		{"take the predecessor", leaves(min+1, min), btreeKey(min + 1), []int{min, min}},
+		{"take the successor", leaves(min, min+1), btreeKey(min), []int{min, min}},
+		{"merge around the key", leaves(min, min), btreeKey(min), []int{2 * min}},
+		{"missing key", leaves(min, min), "zzz", []int{2*min + 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var before []string
+			tc.node.ascend("", func(key string) bool {
+				before = append(before, key)
+				return true
+			})
+			found := tc.node.remove(tc.remove)
+			var sizes []int
+			for _, child := range tc.node.children {
+				sizes = append(sizes, len(child.keys))
+			}
+			if len(tc.node.keys) == 0 {
+				// the merged child replaces an emptied root
+				sizes = []int{len(tc.node.children[0].keys)}
+			}
+			if !reflect.DeepEqual(sizes, tc.sizes) {
+				t.Fatalf("sizes %v, want %v", sizes, tc.sizes)
+			}
+			var want []string
+			for _, key := range before {
+				if key != tc.remove {
+					want = append(want, key)
+				}
+			}
+			if found != (len(want) < len(before)) {
+				t.Fatalf("remove returned %v", found)
+			}
+			var got []string
+			tc.node.ascend("", func(key string) bool {
+				got = append(got, key)
+				return true
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("keys %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestBtreeAscendFrom(t *testing.T) {
+	tree := newBtree(nil)
+	for _, key := range shuffled(btreeKeys(0, 1000), 5) {
+		tree.insert(key)
+	}
+	for _, tc := range []struct {
+		start string
+		limit int
+		want  []string
+	}{
+		{"", 3, btreeKeys(0, 3)},
+		{btreeKey(500), 3, btreeKeys(500, 503)},
+		{btreeKey(500) + "x", 2, btreeKeys(501, 503)},
+		{btreeKey(998), 5, btreeKeys(998, 1000)},
+		{"a", 5, nil},
+	} {
+		var got []string
+		tree.ascend(tc.start, func(key string) bool {
+			got = append(got, key)
+			return len(got) < tc.limit
+		})
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("from %q: %v, want %v", tc.start, got, tc.want)
+		}
+	}
+}
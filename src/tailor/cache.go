@@ -1,11 +1,9 @@
 package tailor
 
 import (
-	"encoding/gob"
 	"fmt"
-	"io"
-	"os"
-	"regexp"
+	"math"
+	"math/rand"
 	"strconv"
 	"sync"
 	"time"
@@ -51,6 +49,13 @@ const (
 type Item struct {
 	Data       interface{}
 	Expiration int64
+	// the value turns stale at the soft expiration, zero means never.
+	// A stale value is still returned while it is refreshed.
+	SoftExpiration int64
+	// how long the value took to load (nanosecond)
+	Delta int64
+	// the tags which Invalidate removes the key by
+	Tags []string
 }
 
 func (item Item) Expired() bool {
@@ -58,49 +63,93 @@ func (item Item) Expired() bool {
 		time.Now().UnixNano() > item.Expiration
 }
 
+// staleRand draws the randomness of the early refresh in [0, 1),
+// the tests replace it to make the refresh deterministic.
+var staleRand = rand.Float64
+
+// Stale reports whether the value should be refreshed. If beta is greater
+// than zero, the value may turn stale before its soft expiration (XFetch),
+// the closer to it and the longer the value took to load, the likelier.
+func (item Item) Stale(beta float64) bool {
+	if item.SoftExpiration <= 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	if beta > 0 && item.Delta > 0 {
+		// -log(x) for x in (0, 1] is exponentially distributed
+		now += int64(float64(item.Delta) * beta * -math.Log(1-staleRand()))
+	}
+	return now >= item.SoftExpiration
+}
+
 type cache struct {
+	// the index of the database, for the keyspace events
+	db                int
 	defaultExpiration time.Duration
 	items             map[string]Item
-	mu                sync.RWMutex
-	afterDel          func(string, interface{})
-
-	stopCleaner  chan bool
-	asyncCleaner *cleaner
-	asyncQueue   LinkedList
+	tags              tagIndex
+	slots             slotIndex
+	// the keys in order, nil unless the ordered index is enabled
+	order *btree
+	// the secondary indexes of the database
+	fields *fieldIndexes
+	// compresses the large values of every cache
+	codec    *compressor
+	mu       sync.RWMutex
+	afterDel func(string, interface{})
+	lazyFree *lazyFreer
+	notify   *notifier
 }
 
-func newCache(de, asyncCycle time.Duration, m map[string]Item) *cache {
+func newCache(db int, de time.Duration, lf *lazyFreer, n *notifier, m map[string]Item) *cache {
 	if m == nil {
 		m = make(map[string]Item)
 	}
 
-	asyncDelFunc := func(c *cache) {
-		if c.asyncQueue.IsEmpty() {
-			return
-		}
-		unlinkedKey, err := c.asyncQueue.Poll()
-		if err == nil {
-			c.del(unlinkedKey.(string))
-		}
-	}
-	asyncCl := newCleanerWithHandler(asyncCycle, asyncDelFunc)
-
 	c := &cache{
+		db:                db,
 		defaultExpiration: de,
 		items:             m,
-		asyncCleaner:      asyncCl,
+		tags:              newTagIndex(m),
+		slots:             newSlotIndex(m),
+		lazyFree:          lf,
+		notify:            n,
 	}
-	go c.asyncCleaner.run(c)
 	return c
 }
 
 func (c *cache) addDelHandler(f func(string, interface{})) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.afterDel = f
+	if f == nil {
+		c.afterDel = nil
+		return
+	}
+	// the handler gets the values as they were set
+	codec := c.codec
+	c.afterDel = func(key string, val interface{}) {
+		f(key, codec.unpack(val))
+	}
+}
+
+func (c *cache) set(key string, val interface{}, lastFor time.Duration, tags []string) {
+	c.setItem(key, Item{
+		Data:       val,
+		Expiration: c.expiration(lastFor),
+		Tags:       tags,
+	})
 }
 
-func (c *cache) set(key string, val interface{}, lastFor time.Duration) {
+func (c *cache) setItem(key string, item Item) {
+	// compressed before the lock is taken
+	item.Data = c.codec.pack(item.Data)
+	c.mu.Lock()
+	c.putItem(key, item)
+	c.mu.Unlock()
+	c.notify.notify(EventWritten, c.db, key, "")
+}
+
+func (c *cache) expiration(lastFor time.Duration) int64 {
 	var ex int64
 	if lastFor == DefaultExpiration {
 		if c.defaultExpiration > 0 {
@@ -113,12 +162,7 @@ func (c *cache) set(key string, val interface{}, lastFor time.Duration) {
 	} else {
 		ex = -1
 	}
-	c.mu.Lock()
-	c.items[key] = Item{
-		Data:       val,
-		Expiration: ex,
-	}
-	c.mu.Unlock()
+	return ex
 }
 
 func (c *cache) setnx(key string, val interface{}, lastFor time.Duration) bool {
@@ -128,27 +172,107 @@ func (c *cache) setnx(key string, val interface{}, lastFor time.Duration) bool {
 	if found {
 		return false
 	}
-	c.set(key, val, lastFor)
+	c.set(key, val, lastFor, nil)
 	return true
 }
 
+// find returns the item of key unless it has expired, it changes nothing,
+// as the readers hold only the read lock. The cleaner removes the expired
+// items, or findForWrite on the next write of the key.
 func (c *cache) find(key string) (Item, bool) {
 	item, found := c.items[key]
 	if !found || item.Expired() {
-		delete(c.items, key)
 		return Item{}, false
 	}
 	return item, true
 }
 
+// findForWrite is find for the callers which hold the write lock,
+// it removes the item of key if it has expired.
+func (c *cache) findForWrite(key string) (Item, bool) {
+	item, found := c.items[key]
+	if !found {
+		return Item{}, false
+	}
+	if item.Expired() {
+		c.removeItem(key)
+		c.notify.notify(EventExpired, c.db, key, "")
+		return Item{}, false
+	}
+	return item, true
+}
+
+// putItem replaces the item of key and keeps the indexes up to date,
+// the caller must hold the lock. Every write of an item goes through it.
+func (c *cache) putItem(key string, item Item) {
+	if old, found := c.items[key]; found {
+		c.tags.remove(key, old.Tags)
+	} else {
+		c.slots.add(key)
+		if c.order != nil {
+			c.order.insert(key)
+		}
+	}
+	c.items[key] = item
+	c.tags.add(key, item.Tags)
+	c.fields.update(key, item.Data)
+}
+
+// removeItem deletes the item of key from the items and the indexes,
+// the caller must hold the lock. Every removal of an item goes through it.
+func (c *cache) removeItem(key string) (Item, bool) {
+	item, found := c.items[key]
+	if found {
+		delete(c.items, key)
+		c.tags.remove(key, item.Tags)
+		c.slots.remove(key)
+		if c.order != nil {
+			c.order.remove(key)
+		}
+		c.fields.remove(key)
+	}
+	return item, found
+}
+
+// take removes the key and returns its item if it has not expired.
+func (c *cache) take(key string) (Item, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, found := c.findForWrite(key)
+	if found {
+		c.removeItem(key)
+	}
+	return item, found
+}
+
+func (c *cache) put(key string, item Item) {
+	c.mu.Lock()
+	c.putItem(key, item)
+	c.mu.Unlock()
+}
+
+// discard removes the key without calling the handler or notifying,
+// it is used when the key moves to the other cache.
+func (c *cache) discard(key string) {
+	c.mu.Lock()
+	c.removeItem(key)
+	c.mu.Unlock()
+}
+
 func (c *cache) get(key string) (interface{}, bool) {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
 	item, found := c.find(key)
+	c.mu.RUnlock()
 	if !found {
 		return nil, false
 	}
-	return item.Data, true
+	return c.codec.unpack(item.Data), true
+}
+
+func (c *cache) item(key string) (Item, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.find(key)
 }
 
 func (c *cache) ttl(key string) (time.Duration, bool) {
@@ -164,25 +288,30 @@ func (c *cache) ttl(key string) (time.Duration, bool) {
 func (c *cache) sIncrby(key string, n int64) byte {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	item, found := c.find(key)
+	item, found := c.findForWrite(key)
 	if !found {
 		return 1
 	}
-	before, err := strconv.ParseInt(item.Data.(string), 10, 64)
+	s, ok := c.codec.unpack(item.Data).(string)
+	if !ok {
+		return 2
+	}
+	before, err := strconv.ParseInt(s, 10, 64)
 	if err != nil {
 		return 2
 	}
 	before += n
 	after := strconv.FormatInt(before, 10)
 	item.Data = after
-	c.items[key] = item
+	c.putItem(key, item)
+	c.notify.notify(EventIncr, c.db, key, "")
 	return 0
 }
 
 func (c *cache) incrby(key string, n int64) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	item, found := c.find(key)
+	item, found := c.findForWrite(key)
 	if !found {
 		return fmt.Errorf("item %s does not exist", key)
 	}
@@ -243,7 +372,8 @@ func (c *cache) incrby(key string, n int64) error {
 	default:
 		return fmt.Errorf("cannot incre the value of %s", key)
 	}
-	c.items[key] = item
+	c.putItem(key, item)
+	c.notify.notify(EventIncr, c.db, key, "")
 	return nil
 }
 
@@ -281,33 +411,38 @@ func overflowed(tp int, left, right int64) bool {
 
 func (c *cache) del(key string) {
 	c.mu.Lock()
-	val, hasHandler := c.doDel(key)
+	item, found := c.removeItem(key)
+	afterDel := c.afterDel
 	c.mu.Unlock()
-	if hasHandler {
-		c.afterDel(key, val)
+	if !found {
+		return
+	}
+	if item.Expired() {
+		c.notify.notify(EventExpired, c.db, key, "")
+	} else {
+		c.notify.notify(EventDeleted, c.db, key, "")
+	}
+	if afterDel != nil {
+		afterDel(key, item.Data)
 	}
 }
 
+// unlink removes the key at once and
+// leaves its value to the lazy-free workers.
 func (c *cache) unlink(key string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	item, found := c.find(key)
+	item, found := c.removeItem(key)
+	afterDel := c.afterDel
+	c.mu.Unlock()
 	if !found {
 		return
 	}
-	item.Expiration = 0
-	c.asyncQueue.Offer(key)
-}
-
-func (c *cache) doDel(key string) (interface{}, bool) {
-	if c.afterDel != nil {
-		if item, found := c.items[key]; found {
-			delete(c.items, key)
-			return item.Data, true
-		}
+	if item.Expired() {
+		c.notify.notify(EventExpired, c.db, key, "")
+	} else {
+		c.notify.notify(EventDeleted, c.db, key, "")
 	}
-	delete(c.items, key)
-	return nil, false
+	c.lazyFree.free(key, item.Data, afterDel)
 }
 
 type KV struct {
@@ -324,121 +459,90 @@ func (kv *KV) Val() interface{} {
 }
 
 // for exCache only
-func (c *cache) delExpired() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	var itemsWithHandler []KV
-	ticker := time.After(100 * time.Millisecond)
-loop:
+// delExpired runs one active expiry cycle. Each round samples
+// conf.SampleSize keys and deletes the expired ones, another round
+// runs at once while more than conf.Threshold of the sample was
+// expired and the cycle has not spent conf.MaxCost yet.
+// It returns how many keys were deleted.
+func (c *cache) delExpired(conf ActiveExpireConf) int {
+	var expiredItems []KV
+	var afterDel func(string, interface{})
+	deleted := 0
+	start := time.Now()
 	for {
-		select {
-		case <-ticker:
-			break loop
-		default:
-			count := 0
-			for k, v := range c.items {
-				count++
-				if v.Expired() {
-					val, hasHandler := c.doDel(k)
-					if hasHandler {
-						itemsWithHandler = append(itemsWithHandler, KV{k, val})
-					}
-				}
-				if count > 4 {
-					break
-				}
+		sampled, expired := 0, 0
+		c.mu.Lock()
+		// map iteration starts at a random position,
+		// so the first keys of a range are a fair sample.
+		for k, v := range c.items {
+			if sampled >= conf.SampleSize {
+				break
+			}
+			sampled++
+			if v.Expired() {
+				expired++
+				c.removeItem(k)
+				expiredItems = append(expiredItems, KV{k, v.Data})
 			}
 		}
-	}
-
-	go func() {
-		for _, item := range itemsWithHandler {
-			c.afterDel(item.key, item.val)
+		afterDel = c.afterDel
+		c.mu.Unlock()
+		deleted += expired
+
+		if sampled == 0 ||
+			float64(expired) <= conf.Threshold*float64(sampled) ||
+			time.Since(start) >= conf.MaxCost {
+			break
 		}
-	}()
-}
+	}
 
-func (c *cache) saveFile(filename string) error {
-	file, err := os.Create(filename)
-	defer func() {
-		if file != nil {
-			_ = file.Close()
-		}
-	}()
-	if err != nil {
-		return err
+	for _, item := range expiredItems {
+		c.notify.notify(EventExpired, c.db, item.key, "")
 	}
-	err = c.save(file)
-	if err != nil {
-		return err
+	if afterDel != nil && len(expiredItems) > 0 {
+		go func() {
+			for _, item := range expiredItems {
+				afterDel(item.key, item.val)
+			}
+		}()
 	}
-	return nil
+	return deleted
 }
 
-func (c *cache) save(w io.Writer) (err error) {
-	enc := gob.NewEncoder(w)
-	defer func() {
-		if x := recover(); x != nil {
-			err = fmt.Errorf("error registering item types with gob")
-		}
-	}()
+// copyItems copies the items into m, so that they
+// can be encoded without holding the lock.
+func (c *cache) copyItems(m map[string]Item) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	for _, item := range c.items {
-		gob.Register(item.Data)
-	}
-	err = enc.Encode(&c.items)
-	return
-}
-
-func (c *cache) loadFile(filename string) error {
-	file, err := os.Open(filename)
-	defer func() {
-		if file != nil {
-			_ = file.Close()
-		}
-	}()
-	if err != nil {
-		return err
-	}
-	err = c.load(file)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func (c *cache) load(r io.Reader) error {
-	dec := gob.NewDecoder(r)
-	items := map[string]Item{}
-	err := dec.Decode(&items)
-	if err == nil {
-		c.mu.Lock()
-		defer c.mu.Unlock()
-		for k, v := range items {
-			_, found := c.find(k)
-			if !found {
-				c.items[k] = v
-			}
-		}
+	for k, v := range c.items {
+		m[k] = v
 	}
-	return err
 }
 
-func (c *cache) keys(exp string) ([]KV, error) {
-	reg, err := regexp.Compile(exp)
-	if err != nil {
-		return nil, err
-	}
+func (c *cache) keys(p *Pattern) []KV {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	res := make([]KV, 0)
 	for k, v := range c.items {
-		if reg.Match([]byte(k)) {
+		if !v.Expired() && p.Match(k) {
+			// the copy holds the value, not the compressed one
+			v.Data = c.codec.unpack(v.Data)
 			res = append(res, KV{k, v})
 		}
 	}
-	return res, nil
+	return res
+}
+
+// matching returns the keys matching p which have not expired,
+// the caller must hold the lock.
+func (c *cache) matching(p *Pattern) []string {
+	var res []string
+	for k, v := range c.items {
+		if !v.Expired() && p.Match(k) {
+			res = append(res, k)
+		}
+	}
+	return res
 }
 
 func (c *cache) cnt() int {
@@ -447,8 +551,34 @@ func (c *cache) cnt() int {
 	return len(c.items)
 }
 
+// swap exchanges the items of two caches, it is only called
+// by the serial write path, so the locks are never taken in
+// the opposite order at the same time.
+func (c *cache) swap(other *cache) {
+	c.mu.Lock()
+	other.mu.Lock()
+	c.items, other.items = other.items, c.items
+	c.tags, other.tags = other.tags, c.tags
+	c.slots, other.slots = other.slots, c.slots
+	c.order, other.order = other.order, c.order
+	c.fields, other.fields = other.fields, c.fields
+	other.mu.Unlock()
+	c.mu.Unlock()
+}
+
 func (c *cache) cls() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.clear()
+}
+
+// clear removes every item, the caller holds the lock.
+func (c *cache) clear() {
+	c.fields.removeAll(c.items)
 	c.items = map[string]Item{}
+	c.tags = make(tagIndex)
+	c.slots = make(slotIndex, scanSlots)
+	if c.order != nil {
+		c.order = newBtree(nil)
+	}
 }
@@ -0,0 +1,88 @@
+package tailor
+
+import (
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The readers hold only the read lock, so a read of an expired key
+// must leave the items and their indexes as they are.
+func TestReadExpiredConcurrently(t *testing.T) {
+	c := newTestCache(time.Hour, 1)
+	defer c.Close()
+	c.EnableOrderedIndex()
+	for i := 0; i < 2000; i++ {
+		c.SetexTagged("k"+strconv.Itoa(i), "v", time.Millisecond, "tag")
+	}
+	c.WaitWrites()
+	time.Sleep(5 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				if _, found := c.Get("k" + strconv.Itoa(i)); found {
+					t.Error("an expired key was found")
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for cursor := uint64(0); ; {
+			next, _, err := c.Scan(cursor, ScanOptions{Count: 100})
+			if err != nil || next == 0 {
+				return
+			}
+			cursor = next
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = c.Export(ioutil.Discard, ExportOptions{})
+	}()
+	wg.Wait()
+
+	// the expired keys are still in place until the cleaner or a write
+	if n := c.cnt(); n != 2000 {
+		t.Fatalf("cnt = %d, want 2000", n)
+	}
+	_ = c.RangeKeys("", "", 0, func(key string) bool {
+		t.Fatalf("range returned the expired key %s", key)
+		return false
+	})
+	c.Setex("k0", "new", time.Hour)
+	c.WaitWrites()
+	if v, _ := c.Get("k0"); v != "new" {
+		t.Fatalf("k0 = %v, want new", v)
+	}
+}
+
+func TestDelMatching(t *testing.T) {
+	c := newTestCache(time.Hour, 1)
+	defer c.Close()
+	// without a default expiration the keys are split between two caches
+	c.Set("user:1", "a")
+	c.Setex("user:2", "b", time.Hour)
+	c.Setex("user:3", "c", time.Nanosecond)
+	c.Set("order:1", "d")
+	c.WaitWrites()
+	time.Sleep(time.Millisecond)
+
+	p, _ := CompilePattern("user:*", Glob)
+	if n := c.DelMatching(p); n != 2 {
+		t.Fatalf("deleted %d keys, want 2", n)
+	}
+	for key, want := range map[string]bool{"user:1": false, "user:2": false, "order:1": true} {
+		if _, found := c.Get(key); found != want {
+			t.Errorf("%s found = %v, want %v", key, found, want)
+		}
+	}
+}
@@ -2,27 +2,82 @@ package tailor
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
+// the cleaner waits at most interval << maxIdleBackoff
+// between two cycles which found nothing to clean.
+const maxIdleBackoff = 3
+
+// ActiveExpireConf tunes the active expiry cycle of the daemon cleaner.
+type ActiveExpireConf struct {
+	// number of keys sampled in each round
+	SampleSize int
+	// another round runs at once if more than
+	// this fraction of the sampled keys were expired
+	Threshold float64
+	// max time one cycle takes, measured by the wall clock,
+	// so the time the goroutine waits to run counts as well
+	MaxCost time.Duration
+}
+
+func DefaultActiveExpireConf() ActiveExpireConf {
+	return ActiveExpireConf{
+		SampleSize: 20,
+		Threshold:  0.25,
+		MaxCost:    25 * time.Millisecond,
+	}
+}
+
+func (conf ActiveExpireConf) check() error {
+	if conf.SampleSize <= 0 {
+		return fmt.Errorf("sample size must be greater than zero: %d", conf.SampleSize)
+	}
+	if conf.Threshold < 0 || conf.Threshold > 1 {
+		return fmt.Errorf("threshold must be between 0 and 1: %v", conf.Threshold)
+	}
+	if conf.MaxCost <= 0 {
+		return fmt.Errorf("max cost must be greater than zero: %v", conf.MaxCost)
+	}
+	return nil
+}
+
 type cleaner struct {
 	interval time.Duration
+	conf     ActiveExpireConf
+	mu       sync.Mutex
 	stop     chan struct{}
 	stopped  bool
-	clean    func(*cache)
+	// clean reports whether it found anything to clean,
+	// the cleaner backs off while it keeps returning false.
+	clean func(*cache) bool
 }
 
 func (cl *cleaner) isStopped() bool {
 	return cl.stopped
 }
 
-func (cl *cleaner) run(c *cache) {
+func (cl *cleaner) run(caches []*cache) {
 	cl.stopped = false
-	ticker := time.Tick(cl.interval)
+	idle := uint(0)
+	timer := time.NewTimer(cl.getInterval())
+	defer timer.Stop()
 	for {
 		select {
-		case <-ticker:
-			cl.clean(c)
+		case <-timer.C:
+			busy := false
+			for _, c := range caches {
+				if cl.clean(c) {
+					busy = true
+				}
+			}
+			if busy {
+				idle = 0
+			} else if idle < maxIdleBackoff {
+				idle++
+			}
+			timer.Reset(cl.getInterval() << idle)
 		case <-cl.stop:
 			cl.stopped = true
 			return
@@ -34,32 +89,48 @@ func (cl *cleaner) stopNow() {
 	close(cl.stop)
 }
 
+// setInterval takes effect from the next cycle.
 func (cl *cleaner) setInterval(t time.Duration) error {
-	if t < 0 {
+	if t <= 0 {
 		return fmt.Errorf("interval must greater than zero: %v", t)
 	}
+	cl.mu.Lock()
 	cl.interval = t
+	cl.mu.Unlock()
 	return nil
 }
 
-func defaultCleaner(t time.Duration) *cleaner {
-	cl := &cleaner{
-		interval: t,
-		stop:     make(chan struct{}),
-		stopped:  false,
-		clean: func(c *cache) {
-			c.delExpired()
-		},
+func (cl *cleaner) getInterval() time.Duration {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.interval
+}
+
+func (cl *cleaner) setExpireConf(conf ActiveExpireConf) error {
+	if err := conf.check(); err != nil {
+		return err
 	}
-	return cl
+	cl.mu.Lock()
+	cl.conf = conf
+	cl.mu.Unlock()
+	return nil
+}
+
+func (cl *cleaner) expireConf() ActiveExpireConf {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.conf
 }
 
-func newCleanerWithHandler(t time.Duration, handler func(c *cache)) *cleaner {
+func defaultCleaner(t time.Duration) *cleaner {
 	cl := &cleaner{
 		interval: t,
+		conf:     DefaultActiveExpireConf(),
 		stop:     make(chan struct{}),
-		stopped:  true,
-		clean:    handler,
+		stopped:  false,
+	}
+	cl.clean = func(c *cache) bool {
+		return c.delExpired(cl.expireConf()) > 0
 	}
 	return cl
 }
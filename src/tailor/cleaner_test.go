@@ -0,0 +1,133 @@
+package tailor
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fillExpiring puts n items into the ex cache of c,
+// the first expired of them have expired already.
+func fillExpiring(c *Cache, n, expired int) *cache {
+	ch := c.exCache
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	past, future := time.Now().Add(-time.Second).UnixNano(), time.Now().Add(time.Hour).UnixNano()
+	for i := 0; i < n; i++ {
+		item := Item{Data: i, Expiration: future}
+		if i < expired {
+			item.Expiration = past
+		}
+		ch.putItem(strconv.Itoa(i), item)
+	}
+	return ch
+}
+
+func TestDelExpiredRounds(t *testing.T) {
+	conf := DefaultActiveExpireConf()
+	conf.MaxCost = time.Minute
+	for _, tc := range []struct {
+		name       string
+		expired    int
+		conf       func(ActiveExpireConf) ActiveExpireConf
+		min, max   int
+		allDeleted bool
+	}{
+		// another round runs while more than a quarter of the sample
+		// was expired, until the expired keys are rare
+		{"mostly expired", 1000, nil, 2 * conf.SampleSize, 1000, false},
+		{"all expired", 1200, nil, 1200, 1200, true},
+		{"nothing expired", 0, nil, 0, 0, false},
+		{"threshold of 1", 1200, func(conf ActiveExpireConf) ActiveExpireConf {
+			conf.Threshold = 1
+			return conf
+		}, conf.SampleSize, conf.SampleSize, false},
+		{"out of time", 1200, func(conf ActiveExpireConf) ActiveExpireConf {
+			conf.MaxCost = time.Nanosecond
+			return conf
+		}, conf.SampleSize, conf.SampleSize, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache(time.Hour, 1)
+			defer c.Close()
+			ch := fillExpiring(c, 1200, tc.expired)
+			runConf := conf
+			if tc.conf != nil {
+				runConf = tc.conf(conf)
+			}
+			deleted := ch.delExpired(runConf)
+			if deleted < tc.min || deleted > tc.max {
+				t.Fatalf("deleted %d, want %d-%d", deleted, tc.min, tc.max)
+			}
+			if left := ch.cnt(); left != 1200-deleted {
+				t.Fatalf("%d left after %d deleted", left, deleted)
+			}
+		})
+	}
+}
+
+// The cleaner waits twice as long after each cycle which found
+// nothing to clean, up to interval << maxIdleBackoff, and goes
+// back to interval once it finds something.
+func TestCleanerBackoff(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	var mu sync.Mutex
+	var cycles []time.Time
+	busy := false
+	cl := defaultCleaner(interval)
+	cl.clean = func(*cache) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		cycles = append(cycles, time.Now())
+		return busy
+	}
+	start := time.Now()
+	go cl.run([]*cache{nil})
+	defer cl.stopNow()
+
+	gaps := func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		res := make([]time.Duration, len(cycles))
+		prev := start
+		for i, at := range cycles {
+			res[i] = at.Sub(prev)
+			prev = at
+		}
+		return res
+	}
+	// idle: 20ms, 40ms, 80ms, 160ms, then 160ms again
+	time.Sleep(interval * (1 + 2 + 4 + 8 + 8 + 4))
+	idle := gaps()
+	if len(idle) < 5 {
+		t.Fatalf("%d cycles: %v", len(idle), idle)
+	}
+	for i, gap := range idle[:5] {
+		want := interval << uint(i)
+		if i == 4 {
+			want = interval << maxIdleBackoff
+		}
+		if gap < want {
+			t.Errorf("cycle %d came after %v, want at least %v", i, gap, want)
+		}
+	}
+	if idle[1] >= interval<<maxIdleBackoff {
+		t.Errorf("the second idle cycle came after %v", idle[1])
+	}
+
+	mu.Lock()
+	busy = true
+	n := len(cycles)
+	mu.Unlock()
+	time.Sleep(interval * (8 + 4))
+	busyGaps := gaps()[n+1:]
+	if len(busyGaps) < 3 {
+		t.Fatalf("%d cycles after the cleaner found something", len(busyGaps))
+	}
+	for _, gap := range busyGaps {
+		if gap >= interval<<1 {
+			t.Errorf("a busy cycle came after %v, want about %v", gap, interval)
+		}
+	}
+}
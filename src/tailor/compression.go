@@ -0,0 +1,203 @@
+package tailor
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	// compressed values are saved into snapshots as they are
+	gob.Register(&compressedValue{})
+}
+
+// compressedValue is a string or []byte value kept compressed in
+// memory, it is decompressed whenever the value is read.
+type compressedValue struct {
+	data    []byte
+	size    int
+	isBytes bool
+}
+
+func (v *compressedValue) GobEncode() ([]byte, error) {
+	buf := make([]byte, 1+binary.MaxVarintLen64, 1+binary.MaxVarintLen64+len(v.data))
+	if v.isBytes {
+		buf[0] = 1
+	}
+	n := binary.PutUvarint(buf[1:], uint64(v.size))
+	return append(buf[:1+n], v.data...), nil
+}
+
+func (v *compressedValue) GobDecode(data []byte) error {
+	if len(data) < 1 {
+		return errors.New("invalid compressed value")
+	}
+	size, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return errors.New("invalid compressed value")
+	}
+	v.isBytes = data[0] == 1
+	v.size = int(size)
+	v.data = data[1+n:]
+	return nil
+}
+
+type CompressionStats struct {
+	// values are compressed from this size (bytes), 0 means never
+	Threshold int `json:"threshold"`
+	Level     int `json:"level"`
+	// values stored compressed, and the values above the threshold
+	// stored as they are, as compressing did not make them smaller
+	Compressed uint64 `json:"compressed"`
+	Skipped    uint64 `json:"skipped"`
+	// sizes of the values compressed so far, before and after
+	RawBytes        uint64 `json:"rawBytes"`
+	CompressedBytes uint64 `json:"compressedBytes"`
+	// CompressedBytes / RawBytes
+	Ratio        float64 `json:"ratio"`
+	Decompressed uint64  `json:"decompressed"`
+	// time spent (nanosecond), measured by the wall clock
+	CompressNanos   uint64 `json:"compressNanos"`
+	DecompressNanos uint64 `json:"decompressNanos"`
+}
+
+// compressor compresses the large values of all the databases.
+type compressor struct {
+	compressed      uint64
+	skipped         uint64
+	rawBytes        uint64
+	compressedBytes uint64
+	decompressed    uint64
+	compressNanos   uint64
+	decompressNanos uint64
+
+	mu        sync.RWMutex
+	threshold int
+	level     int
+	writers   *sync.Pool
+}
+
+func newCompressor() *compressor {
+	return &compressor{level: flate.DefaultCompression}
+}
+
+func (cp *compressor) configure(threshold, level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d, it must be from %d to %d",
+			level, flate.HuffmanOnly, flate.BestCompression)
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.threshold = threshold
+	if level != cp.level || cp.writers == nil {
+		// the writers of the old level are dropped
+		cp.level = level
+		cp.writers = &sync.Pool{
+			New: func() interface{} {
+				w, _ := flate.NewWriter(nil, level)
+				return w
+			},
+		}
+	}
+	return nil
+}
+
+// pack returns the value compressed if it is a string or []byte of at least
+// the threshold and compressing makes it smaller, otherwise val itself.
+func (cp *compressor) pack(val interface{}) interface{} {
+	var raw []byte
+	isBytes := false
+	switch v := val.(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw, isBytes = v, true
+	default:
+		return val
+	}
+	cp.mu.RLock()
+	threshold, writers := cp.threshold, cp.writers
+	cp.mu.RUnlock()
+	if threshold <= 0 || len(raw) < threshold {
+		return val
+	}
+
+	start := time.Now()
+	var buf bytes.Buffer
+	w := writers.Get().(*flate.Writer)
+	w.Reset(&buf)
+	_, err := w.Write(raw)
+	if err == nil {
+		err = w.Close()
+	}
+	writers.Put(w)
+	atomic.AddUint64(&cp.compressNanos, uint64(time.Since(start)))
+	if err != nil || buf.Len() >= len(raw) {
+		atomic.AddUint64(&cp.skipped, 1)
+		return val
+	}
+	atomic.AddUint64(&cp.compressed, 1)
+	atomic.AddUint64(&cp.rawBytes, uint64(len(raw)))
+	atomic.AddUint64(&cp.compressedBytes, uint64(buf.Len()))
+	return &compressedValue{
+		data:    append([]byte(nil), buf.Bytes()...),
+		size:    len(raw),
+		isBytes: isBytes,
+	}
+}
+
+// unpack returns the value a compressed value was made of, other values
+// as they are. A value which cannot be decompressed is returned as nil.
+func (cp *compressor) unpack(val interface{}) interface{} {
+	v, ok := val.(*compressedValue)
+	if !ok {
+		return val
+	}
+	start := time.Now()
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(v.data)))
+	atomic.AddUint64(&cp.decompressNanos, uint64(time.Since(start)))
+	atomic.AddUint64(&cp.decompressed, 1)
+	if err != nil {
+		return nil
+	}
+	if v.isBytes {
+		return raw
+	}
+	return string(raw)
+}
+
+func (cp *compressor) stats() CompressionStats {
+	cp.mu.RLock()
+	stats := CompressionStats{
+		Threshold: cp.threshold,
+		Level:     cp.level,
+	}
+	cp.mu.RUnlock()
+	stats.Compressed = atomic.LoadUint64(&cp.compressed)
+	stats.Skipped = atomic.LoadUint64(&cp.skipped)
+	stats.RawBytes = atomic.LoadUint64(&cp.rawBytes)
+	stats.CompressedBytes = atomic.LoadUint64(&cp.compressedBytes)
+	stats.Decompressed = atomic.LoadUint64(&cp.decompressed)
+	stats.CompressNanos = atomic.LoadUint64(&cp.compressNanos)
+	stats.DecompressNanos = atomic.LoadUint64(&cp.decompressNanos)
+	if stats.RawBytes > 0 {
+		stats.Ratio = float64(stats.CompressedBytes) / float64(stats.RawBytes)
+	}
+	return stats
+}
+
+// SetCompression keeps the string and []byte values of at least threshold
+// bytes compressed by flate at level, from flate.HuffmanOnly (-2) to
+// flate.BestCompression (9). They are decompressed whenever they are read,
+// so it is transparent but for the time it takes, which Stats shows. A threshold
+// not greater than zero turns it off, the values compressed before stay so.
+func (c *Cache) SetCompression(threshold, level int) error {
+	return c.codec.configure(threshold, level)
+}
@@ -0,0 +1,63 @@
+package tailor
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressedValues(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	if err := c.SetCompression(64, 1); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("compressible ", 100)
+	for _, tc := range []struct {
+		key string
+		val interface{}
+	}{
+		{"string", long},
+		{"bytes", []byte(long)},
+		{"short", "short"},
+	} {
+		c.Set(tc.key, tc.val)
+	}
+	c.WaitWrites()
+	if stats := c.codec.stats(); stats.Compressed != 2 {
+		t.Fatalf("%d values compressed, want 2", stats.Compressed)
+	}
+
+	check := func(how, key string, got interface{}) {
+		t.Helper()
+		switch key {
+		case "string":
+			if got != long {
+				t.Errorf("%s %s = %T", how, key, got)
+			}
+		case "bytes":
+			if b, ok := got.([]byte); !ok || !bytes.Equal(b, []byte(long)) {
+				t.Errorf("%s %s = %T", how, key, got)
+			}
+		case "short":
+			if got != "short" {
+				t.Errorf("%s %s = %v", how, key, got)
+			}
+		}
+	}
+	for _, key := range []string{"string", "bytes", "short"} {
+		v, _ := c.Get(key)
+		check("Get", key, v)
+	}
+	kvs, err := c.Keys(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 3 {
+		t.Fatalf("Keys returned %d keys", len(kvs))
+	}
+	for _, kv := range kvs {
+		check("Keys", kv.Key(), kv.Val().(Item).Data)
+	}
+}
@@ -0,0 +1,300 @@
+package tailor
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// database is one keyspace with its own pair of caches,
+// the state kept per key lives here as well.
+type database struct {
+	index    int
+	neCache  *cache
+	exCache  *cache
+	waits    *waitRegistry
+	flights  *flightGroup
+	negative *negativeCache
+	refresh  refresher
+	storeMu  sync.RWMutex
+	backing  *backing
+}
+
+func newDatabase(index int, defaultExpiration time.Duration, lf *lazyFreer, n *notifier, cp *compressor, m map[string]Item) *database {
+	// if expiry time is not greater than zero, then make it NoExpiration
+	var nec, exc *cache
+	if defaultExpiration <= 0 {
+		// the items of m are split by whether they expire
+		var ne, ex map[string]Item
+		if m != nil {
+			ne, ex = make(map[string]Item), make(map[string]Item)
+			for k, v := range m {
+				if v.Expiration < 0 {
+					ne[k] = v
+				} else {
+					ex[k] = v
+				}
+			}
+		}
+		nec = newCache(index, NoExpiration, lf, n, ne)
+		exc = newCache(index, NoExpiration, lf, n, ex)
+	} else {
+		exc = newCache(index, defaultExpiration, lf, n, m)
+		nec = exc
+	}
+	fx := newFieldIndexes()
+	nec.fields, exc.fields = fx, fx
+	nec.codec, exc.codec = cp, cp
+	db := &database{
+		index:    index,
+		neCache:  nec,
+		exCache:  exc,
+		waits:    newWaitRegistry(),
+		negative: newNegativeCache(),
+	}
+	db.flights = newFlightGroup(db)
+	return db
+}
+
+// swap exchanges the keys of two databases, the keys of each database
+// stay in its own pair of caches. The cached loader errors, the loads
+// in flight and the refresher which loaded the keys go along with them.
+func (db *database) swap(other *database) {
+	db.neCache.swap(other.neCache)
+	if db.exCache != db.neCache {
+		db.exCache.swap(other.exCache)
+	}
+	db.negative.swap(other.negative)
+	db.flights.swap(other.flights)
+	db.refresh.swap(&other.refresh)
+}
+
+// caches returns the caches of the database, the locks
+// of both are always taken in this order.
+func (db *database) caches() []*cache {
+	if db.exCache == db.neCache {
+		return []*cache{db.neCache}
+	}
+	return []*cache{db.neCache, db.exCache}
+}
+
+func (db *database) item(key string) (Item, bool) {
+	item, found := db.neCache.item(key)
+	if !found && db.exCache != db.neCache {
+		item, found = db.exCache.item(key)
+	}
+	return item, found
+}
+
+// loadItems puts the items which have not expired into the cache which
+// matches their expiration, and returns their keys. The expired items
+// found in place are replaced without being removed first, so the load
+// sends no events. The caller holds the locks of the caches.
+func (db *database) loadItems(items map[string]Item, mode LoadMode, res *LoadResult) []string {
+	keys := make([]string, 0, len(items))
+	for k, v := range items {
+		if v.Expired() {
+			res.Expired++
+			continue
+		}
+		if mode == LoadKeep && db.exists(k) {
+			res.Skipped++
+			continue
+		}
+		target := db.exCache
+		if v.Expiration < 0 {
+			target = db.neCache
+		}
+		for _, ch := range db.caches() {
+			if ch != target {
+				ch.removeItem(k)
+			}
+		}
+		target.putItem(k, v)
+		keys = append(keys, k)
+		res.Loaded++
+	}
+	return keys
+}
+
+// exists reports whether key has an item which has not expired,
+// the caller holds the locks of the caches.
+func (db *database) exists(key string) bool {
+	for _, ch := range db.caches() {
+		if item, found := ch.items[key]; found && !item.Expired() {
+			return true
+		}
+	}
+	return false
+}
+
+// keyList returns the keys of both caches, in no order.
+func (db *database) keyList() []string {
+	var keys []string
+	for _, ch := range db.caches() {
+		ch.mu.RLock()
+		for key := range ch.items {
+			keys = append(keys, key)
+		}
+		ch.mu.RUnlock()
+	}
+	return keys
+}
+
+// discard removes key from both caches without calling the handler.
+func (db *database) discard(key string) {
+	for _, ch := range db.caches() {
+		ch.discard(key)
+	}
+}
+
+func (db *database) flush() {
+	db.exCache.cls()
+	if db.neCache != db.exCache {
+		db.neCache.cls()
+	}
+}
+
+func (db *database) cnt() int {
+	// the result contains the expired items
+	// which are not cleaned when the func is called.
+	cnt := db.neCache.cnt()
+	if db.exCache != db.neCache {
+		cnt += db.exCache.cnt()
+	}
+	return cnt
+}
+
+// dbFilename returns the name of the files of database i which the
+// versions before the snapshot format 2 saved, without the suffix
+// of the cache. Those of database 0 are named after filename alone.
+func dbFilename(filename string, i int) string {
+	if i == 0 {
+		return filename
+	}
+	return filename + strconv.Itoa(i)
+}
+
+func (c *core) exCaches() []*cache {
+	res := make([]*cache, len(c.dbs))
+	for i, db := range c.dbs {
+		res[i] = db.exCache
+	}
+	return res
+}
+
+// execute runs the job on the database of the view.
+func (c *Cache) execute(j *job) {
+	j.c = c
+	c.executor.execute(j)
+}
+
+// DB returns the index of the database of the view.
+func (c *Cache) DB() int {
+	return c.index
+}
+
+// Databases returns the number of databases.
+func (c *Cache) Databases() int {
+	return len(c.dbs)
+}
+
+// Select returns the view of database n, which shares
+// everything but the keys with the other views.
+func (c *Cache) Select(n int) (*Cache, error) {
+	if n < 0 || n >= len(c.dbs) {
+		return nil, fmt.Errorf("database index %d is out of range 0-%d", n, len(c.dbs)-1)
+	}
+	return &Cache{
+		core:     c.core,
+		database: c.dbs[n],
+	}, nil
+}
+
+// FlushDB removes every key of the database of the view, after the
+// writes queued before it. The keys are deleted from the attached
+// store as well, in the background.
+func (c *Cache) FlushDB() {
+	c.flushJob(flushdb)
+}
+
+// FlushAll removes every key of all the databases,
+// after the writes queued before it.
+func (c *Cache) FlushAll() {
+	c.flushJob(flushall)
+}
+
+// flushJob runs a flush by the serial write path, so that the
+// append-only file logs it in the order the writes are applied.
+func (c *Cache) flushJob(op byte) {
+	newJob := &job{
+		op:   op,
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+}
+
+func (c *Cache) flushDB() {
+	keys := c.storedKeys()
+	c.flush()
+	c.aof.log(aofRecord{Op: aofFlushDB, DB: c.index})
+	c.saves.changed(1)
+	c.bulkWritten(keys)
+}
+
+func (c *Cache) flushAll() {
+	for _, db := range c.dbs {
+		view := &Cache{core: c.core, database: db}
+		keys := view.storedKeys()
+		db.flush()
+		view.bulkWritten(keys)
+	}
+	c.aof.log(aofRecord{Op: aofFlushAll})
+	c.saves.changed(1)
+}
+
+// SwapDB exchanges the keys of databases a and b, so that the views
+// of a see the keys of b and vice versa. The clients blocked on the
+// lists of either database are served by the lists they find there.
+// The attached stores stay with their databases, and are told about
+// the keys which came and went.
+func (c *Cache) SwapDB(a, b int) error {
+	if a < 0 || a >= len(c.dbs) || b < 0 || b >= len(c.dbs) {
+		return fmt.Errorf("database index is out of range 0-%d", len(c.dbs)-1)
+	}
+	newJob := &job{
+		op:   swapdb,
+		val:  [2]int{a, b},
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return nil
+}
+
+func (c *Cache) swapDB(a, b int) {
+	if a == b {
+		return
+	}
+	views := []*Cache{{core: c.core, database: c.dbs[a]}, {core: c.core, database: c.dbs[b]}}
+	var keys []string
+	if views[0].attachedStore() != nil || views[1].attachedStore() != nil {
+		keys = append(c.dbs[a].keyList(), c.dbs[b].keyList()...)
+	}
+	c.dbs[a].swap(c.dbs[b])
+	c.aof.log(aofRecord{Op: aofSwapDB, DB: a, Other: b})
+	c.saves.changed(1)
+	for _, view := range views {
+		view.bulkWritten(keys)
+		for _, key := range view.waits.keys() {
+			view.serveWaiters(key)
+		}
+	}
+}
+
+type DatabaseStats struct {
+	DB   int `json:"db"`
+	Keys int `json:"keys"`
+}
@@ -0,0 +1,208 @@
+package tailor
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSelect(t *testing.T) {
+	c := newTestCache(time.Minute, 3)
+	defer c.Close()
+	if c.Databases() != 3 || c.DB() != 0 {
+		t.Fatalf("%d databases, view of %d", c.Databases(), c.DB())
+	}
+	for _, n := range []int{-1, 3} {
+		if _, err := c.Select(n); err == nil {
+			t.Errorf("selected database %d", n)
+		}
+	}
+	db2, err := c.Select(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db2.DB() != 2 {
+		t.Fatalf("view of %d", db2.DB())
+	}
+	c.Set("k", "0")
+	db2.Set("k", "2")
+	if v, _ := c.Get("k"); v != "0" {
+		t.Errorf("db 0 k = %v", v)
+	}
+	if v, _ := db2.Get("k"); v != "2" {
+		t.Errorf("db 2 k = %v", v)
+	}
+	db1, _ := db2.Select(1)
+	if _, found := db1.Get("k"); found {
+		t.Error("db 1 has k")
+	}
+}
+
+func TestFlushDB(t *testing.T) {
+	c := newTestCache(time.Minute, 2)
+	defer c.Close()
+	store := newTestStore()
+	opts := DefaultStoreOptions()
+	opts.ReadFallback = true
+	if err := c.AttachStore(store, opts); err != nil {
+		t.Fatal(err)
+	}
+	db1, _ := c.Select(1)
+	c.Set("a", "v")
+	c.Setex("b", "v", time.Hour)
+	db1.Set("a", "v1")
+
+	c.FlushDB()
+	c.WaitWrites()
+	if n := c.Cnt(); n != 0 {
+		t.Fatalf("db 0 has %d keys", n)
+	}
+	if v, _ := db1.Get("a"); v != "v1" {
+		t.Fatalf("db 1 a = %v", v)
+	}
+	// the keys do not come back from the store
+	c.DetachStore()
+	for _, key := range []string{"a", "b"} {
+		if _, found := store.get(key); found {
+			t.Errorf("store has %s", key)
+		}
+	}
+
+	c.FlushAll()
+	if n := db1.Cnt(); n != 0 {
+		t.Fatalf("db 1 has %d keys", n)
+	}
+}
+
+func TestSwapDB(t *testing.T) {
+	c := newTestCache(time.Minute, 3)
+	defer c.Close()
+	db1, _ := c.Select(1)
+	store0, store1 := newTestStore(), newTestStore()
+	if err := c.AttachStore(store0, DefaultStoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db1.AttachStore(store1, DefaultStoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", "0")
+	db1.Set("b", "1")
+
+	if err := c.SwapDB(0, 3); err == nil {
+		t.Fatal("swapped with database 3")
+	}
+	if err := c.SwapDB(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitWrites()
+	if v, _ := c.Get("b"); v != "1" {
+		t.Errorf("db 0 b = %v", v)
+	}
+	if v, _ := db1.Get("a"); v != "0" {
+		t.Errorf("db 1 a = %v", v)
+	}
+	if _, found := c.Get("a"); found {
+		t.Error("db 0 still has a")
+	}
+	// the stores stay with their databases and follow the keys
+	c.DetachStore()
+	db1.DetachStore()
+	if _, found := store0.get("a"); found {
+		t.Error("store 0 has a")
+	}
+	if v, _ := store0.get("b"); v != "1" {
+		t.Errorf("store 0 b = %v", v)
+	}
+	if v, _ := store1.get("a"); v != "0" {
+		t.Errorf("store 1 a = %v", v)
+	}
+	if _, found := store1.get("b"); found {
+		t.Error("store 1 has b")
+	}
+}
+
+// The cached loader errors and the loads in flight
+// move with the keys.
+func TestSwapDBLoads(t *testing.T) {
+	c := newTestCache(time.Minute, 2)
+	defer c.Close()
+	db1, _ := c.Select(1)
+	c.SetNegativeTTL(time.Minute)
+	db1.SetNegativeTTL(time.Minute)
+	errDown := errors.New("down")
+	if _, err := c.GetOrLoad("failed", 0, func() (interface{}, error) {
+		return nil, errDown
+	}); err != errDown {
+		t.Fatalf("error %v", err)
+	}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad("slow", 0, func() (interface{}, error) {
+			close(started)
+			<-release
+			return "loaded", nil
+		})
+		done <- err
+	}()
+	<-started
+	if err := c.SwapDB(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	c.WaitWrites()
+	if v, _ := db1.Get("slow"); v != "loaded" {
+		t.Errorf("db 1 slow = %v", v)
+	}
+	if _, found := c.Get("slow"); found {
+		t.Error("the load in flight set slow into db 0")
+	}
+
+	calls := 0
+	loader := func() (interface{}, error) {
+		calls++
+		return "v", nil
+	}
+	if _, err := db1.GetOrLoad("failed", 0, loader); err != errDown || calls != 0 {
+		t.Errorf("db 1: error %v after %d calls, want the cached error", err, calls)
+	}
+	if v, err := c.GetOrLoad("failed", 0, loader); err != nil || v != "v" || calls != 1 {
+		t.Errorf("db 0: %v, %v after %d calls", v, err, calls)
+	}
+}
+
+// The refresher goes along with the keys it loaded.
+func TestSwapDBRefresher(t *testing.T) {
+	c := newTestCache(time.Minute, 2)
+	defer c.Close()
+	db1, _ := c.Select(1)
+	opts := RefreshOptions{SoftTTL: time.Minute}
+	if err := c.SetRefresher(func(key string) (interface{}, error) {
+		return "db 0 " + key, nil
+	}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Fetch("a"); err != nil || v != "db 0 a" {
+		t.Fatalf("Fetch = %v, %v", v, err)
+	}
+	if err := c.SwapDB(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitWrites()
+	if _, err := c.Fetch("b"); err == nil {
+		t.Error("db 0 still has a refresher")
+	}
+	if v, err := db1.Fetch("a"); err != nil || v != "db 0 a" {
+		t.Errorf("db 1 a = %v, %v", v, err)
+	}
+	if v, err := db1.Fetch("b"); err != nil || v != "db 0 b" {
+		t.Errorf("db 1 b = %v, %v", v, err)
+	}
+	if _, opts := db1.refresh.get(); opts.SoftTTL != time.Minute {
+		t.Errorf("db 1 soft TTL = %v", opts.SoftTTL)
+	}
+}
@@ -0,0 +1,180 @@
+package tailor
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// an encrypted snapshot file is laid out as the magic, the length of the
+// key id (1 byte), the key id, the nonce and the sealed snapshot. The magic
+// and the key id are authenticated along with the snapshot.
+var encryptedMagic = []byte("TKVAEAD1")
+
+// SnapshotKey is an AES key of 16, 24 or 32 bytes, the id is saved
+// into the encrypted files so that Load knows which key to use.
+type SnapshotKey struct {
+	ID  string
+	Key []byte
+}
+
+// ParseSnapshotKey parses "id:key" with the key in standard base64.
+func ParseSnapshotKey(s string) (SnapshotKey, error) {
+	i := strings.IndexByte(s, ':')
+	if i <= 0 {
+		return SnapshotKey{}, errors.New("snapshot key must be 'id:base64 key'")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s[i+1:]))
+	if err != nil {
+		return SnapshotKey{}, fmt.Errorf("snapshot key '%s' is not base64: %v", s[:i], err)
+	}
+	return SnapshotKey{ID: strings.TrimSpace(s[:i]), Key: key}, nil
+}
+
+// ReadSnapshotKeyFile reads one "id:key" per line, as ParseSnapshotKey
+// does. Empty lines and the lines starting with '#' are skipped.
+func ReadSnapshotKeyFile(filename string) ([]SnapshotKey, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var keys []SnapshotKey
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, err := ParseSnapshotKey(line)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, scanner.Err()
+}
+
+// keyring keeps the snapshot keys, the first one encrypts.
+type keyring struct {
+	mu   sync.RWMutex
+	keys []SnapshotKey
+	aead map[string]cipher.AEAD
+	// the plain data is decrypted as it is even with keys
+	acceptPlain bool
+}
+
+func (kr *keyring) set(keys []SnapshotKey) error {
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for _, k := range keys {
+		if k.ID == "" || len(k.ID) > 255 {
+			return fmt.Errorf("snapshot key id '%s' must be 1 to 255 bytes", k.ID)
+		}
+		if _, found := aeads[k.ID]; found {
+			return fmt.Errorf("snapshot key id '%s' is used twice", k.ID)
+		}
+		block, err := aes.NewCipher(k.Key)
+		if err != nil {
+			return fmt.Errorf("snapshot key '%s': %v", k.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		aeads[k.ID] = aead
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys = keys
+	kr.aead = aeads
+	return nil
+}
+
+// encrypt returns data as it is if there is no key.
+func (kr *keyring) encrypt(data []byte) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if len(kr.keys) == 0 {
+		return data, nil
+	}
+	id := kr.keys[0].ID
+	aead := kr.aead[id]
+	header := make([]byte, 0, len(encryptedMagic)+1+len(id)+aead.NonceSize())
+	header = append(header, encryptedMagic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(append(header, nonce...), nonce, data, header), nil
+}
+
+// decrypt returns data as it is if it is not encrypted, which it
+// only accepts with keys if acceptPlain is set, since anyone who can
+// write the file could otherwise replace it with a plain one.
+func (kr *keyring) decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		kr.mu.RLock()
+		rejected := len(kr.keys) > 0 && !kr.acceptPlain
+		kr.mu.RUnlock()
+		if rejected {
+			return nil, errors.New("data is not encrypted, but snapshot keys are configured")
+		}
+		return data, nil
+	}
+	rest := data[len(encryptedMagic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+		return nil, errors.New("encrypted snapshot is truncated")
+	}
+	id := string(rest[1 : 1+rest[0]])
+	headerLen := len(encryptedMagic) + 1 + len(id)
+
+	kr.mu.RLock()
+	aead, found := kr.aead[id]
+	configured := len(kr.keys) > 0
+	kr.mu.RUnlock()
+	if !found {
+		if !configured {
+			return nil, fmt.Errorf("snapshot is encrypted with key '%s', but no snapshot key is configured", id)
+		}
+		return nil, fmt.Errorf("snapshot is encrypted with key '%s', which is not among the configured keys", id)
+	}
+	if len(data) < headerLen+aead.NonceSize() {
+		return nil, errors.New("encrypted snapshot is truncated")
+	}
+	nonce := data[headerLen : headerLen+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[headerLen+aead.NonceSize():], data[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt snapshot with key '%s': the key is wrong or the file is corrupted", id)
+	}
+	return plain, nil
+}
+
+// SetSnapshotKeys makes Save encrypt the snapshots with AES-GCM by the first
+// key, and the append-only file each record. Load decrypts by any of the
+// keys, so to rotate the key, put the new key first and keep the old ones
+// until every file is saved again, and the append-only file rewritten. No
+// keys turns the encryption off, the plain files are always loaded then.
+// With keys, the plain files are rejected unless AcceptPlainFiles is set.
+func (c *Cache) SetSnapshotKeys(keys ...SnapshotKey) error {
+	return c.snapKeys.set(keys)
+}
+
+// AcceptPlainFiles makes Load and the replay of the append-only file accept
+// the files written before the snapshot keys were set, to migrate them. Turn
+// it off again once they are saved again and the append-only file rewritten.
+func (c *Cache) AcceptPlainFiles(accept bool) {
+	c.snapKeys.mu.Lock()
+	c.snapKeys.acceptPlain = accept
+	c.snapKeys.mu.Unlock()
+}
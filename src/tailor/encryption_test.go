@@ -0,0 +1,67 @@
+package tailor
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPlainSnapshotWithKeys(t *testing.T) {
+	dir := tempDir(t)
+	plain := filepath.Join(dir, "plain.tkv")
+	c := newTestCache(time.Minute, 1)
+	c.Set("k", "v")
+	c.WaitWrites()
+	if err := c.SaveFile(plain); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	key := SnapshotKey{ID: "k1", Key: bytes.Repeat([]byte{7}, 32)}
+	for _, tc := range []struct {
+		name   string
+		accept bool
+	}{
+		{"rejected", false},
+		{"migrated", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache(time.Minute, 1)
+			defer c.Close()
+			if err := c.SetSnapshotKeys(key); err != nil {
+				t.Fatal(err)
+			}
+			c.AcceptPlainFiles(tc.accept)
+			err := c.Load(plain)
+			if !tc.accept {
+				if err == nil {
+					t.Fatal("loaded a plain snapshot with a key configured")
+				}
+				if _, found := c.Get("k"); found {
+					t.Fatal("k was loaded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// saved again, it is encrypted and loads without the option
+			encrypted := filepath.Join(dir, "encrypted.tkv")
+			if err := c.SaveFile(encrypted); err != nil {
+				t.Fatal(err)
+			}
+			loaded := newTestCache(time.Minute, 1)
+			defer loaded.Close()
+			if err := loaded.SetSnapshotKeys(key); err != nil {
+				t.Fatal(err)
+			}
+			if err := loaded.Load(encrypted); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := loaded.Get("k"); v != "v" {
+				t.Fatalf("k = %v", v)
+			}
+		})
+	}
+}
@@ -15,15 +15,59 @@ const (
 	incr
 	incrby
 	ttl
+	rename
+	lpush
+	rpush
+	lpop
+	rpop
+	llen
+	blpop
+	brpop
+	// requeue gives back an element popped for a cancelled blocked pop
+	requeue
+	// fill sets a value loaded from the store,
+	// which is not written back to the store.
+	fill
+	setsoft
+	swapdb
+	flushdb
+	flushall
+	invalidate
+	delmatch
+	jsonset
+	jsonget
+	jsondel
+	jsonnumincrby
+	jsonarrappend
+	load
+	// dump copies every database for a snapshot
+	dump
+	// aofrewrite copies every database for a rewrite of the append-only file
+	aofrewrite
+	// barrier is done once the writes queued before it are
+	barrier
 )
 
 type job struct {
-	op   byte
-	key  string
-	val  interface{}
-	exp  time.Duration
+	// the view of the database the job runs on
+	c   *Cache
+	op  byte
+	key string
+	val interface{}
+	exp time.Duration
+	// the tags of set and setex
+	tags []string
 	done chan struct{}
 	res  response
+	// the store writer finishes the job once its keys are stored
+	stored bool
+}
+
+// finish wakes the caller waiting for the job, if any.
+func (j *job) finish() {
+	if j.done != nil && !j.stored {
+		close(j.done)
+	}
 }
 
 type response struct {
@@ -33,16 +77,14 @@ type response struct {
 }
 
 type executor struct {
-	c     *Cache
 	jobs  chan *job
 	size  uint8
 	count uint8
 	mu    sync.Mutex
 }
 
-func newExecutor(c *Cache, size uint8) *executor {
+func newExecutor(size uint8) *executor {
 	return &executor{
-		c:     c,
 		jobs:  make(chan *job, size),
 		size:  size,
 		count: 0,
@@ -59,41 +101,185 @@ func (exc *executor) execute(j *job) {
  */
 func (exc *executor) server() {
 	for j := range exc.jobs {
+		j := j
+		c := j.c
 		switch j.op {
 		case setex:
-			exc.c.setex(j.key, j.val, j.exp)
+			c.setex(j.key, j.val, j.exp, j.tags)
+			c.written(j, j.key)
+			j.finish()
 		case setnx:
-			j.res.value = exc.c.setnx(j.key, j.val)
-			close(j.done)
+			j.res.value = c.setnx(j.key, j.val)
+			if j.res.value.(bool) {
+				c.written(j, j.key)
+			}
+			j.finish()
 		case set:
-			exc.c.set(j.key, j.val)
+			c.set(j.key, j.val, j.tags)
+			c.written(j, j.key)
+			j.finish()
+		case setsoft:
+			c.setSoft(j.key, j.val.(*softValue))
+			c.written(j, j.key)
+			j.finish()
+		case invalidate:
+			keys := c.invalidate(j.val.([]string))
+			c.written(j, keys...)
+			j.res.value = len(keys)
+			j.finish()
+		case delmatch:
+			keys := c.delMatching(j.val.(*Pattern))
+			c.written(j, keys...)
+			j.res.value = len(keys)
+			j.finish()
+		case swapdb:
+			dbs := j.val.([2]int)
+			c.swapDB(dbs[0], dbs[1])
+			j.finish()
+		case load:
+			args := j.val.(loadArgs)
+			j.res.value = c.loadSnapshot(args.snap, args.mode)
+			j.finish()
+		case dump:
+			j.res.value = c.copySnapshot()
+			j.finish()
+		case aofrewrite:
+			j.res.value = j.val.(*appendOnlyFile).beginRewrite()
+			j.finish()
+		case flushdb:
+			c.flushDB()
+			j.finish()
+		case flushall:
+			c.flushAll()
+			j.finish()
+		case fill:
+			j.res.ok = c.fill(j.key, j.val.(fillArgs))
+			j.finish()
+		case barrier:
+			// and stored, with a write-through store
+			c.written(j)
+			j.finish()
 		case get:
 			go func() {
 				if exc.isReady() {
 					exc.addCount(true)
-					j.res.value, j.res.ok = exc.c.get(j.key)
-					close(j.done)
+					j.res.value, j.res.ok = c.get(j.key)
+					j.finish()
 					exc.addCount(false)
 				} else {
 					exc.jobs <- j
 				}
 			}()
 		case del:
-			exc.c.del(j.key)
+			c.del(j.key)
+			c.written(j, j.key)
+			j.finish()
 		case unlink:
-			exc.c.unlink(j.key)
+			c.unlink(j.key)
+			c.written(j, j.key)
+			j.finish()
 		case incr:
-			j.res.err = exc.c.incr(j.key)
-			close(j.done)
+			j.res.err = c.incr(j.key)
+			if j.res.err == nil {
+				c.written(j, j.key)
+			}
+			j.finish()
 		case incrby:
-			j.res.err = exc.c.incrby(j.key, j.val.(string))
-			close(j.done)
+			j.res.err = c.incrby(j.key, j.val.(string))
+			if j.res.err == nil {
+				c.written(j, j.key)
+			}
+			j.finish()
+		case rename:
+			j.res.err = c.rename(j.key, j.val.(string))
+			if j.res.err == nil {
+				c.serveWaiters(j.val.(string))
+				c.written(j, j.key, j.val.(string))
+			}
+			j.finish()
+		case lpush, rpush:
+			vals := j.val.([]interface{})
+			blocked := c.waits.blocked(j.key)
+			j.res.value, j.res.err = c.push(j.key, vals, j.op == lpush)
+			if j.res.err == nil {
+				c.pushed(j, vals, j.op == lpush, blocked)
+			}
+			j.finish()
+		case lpop, rpop:
+			j.res.value, j.res.ok, j.res.err = c.pop(j.key, j.op == lpop)
+			if j.res.ok {
+				c.writtenAs(j, aofRecord{Op: aofPop, Key: j.key, Left: j.op == lpop})
+			}
+			j.finish()
+		case blpop, brpop:
+			kv, w, err := c.bpop(j.val.([]string), j.op == blpop)
+			if w != nil {
+				j.res.value = w
+			} else {
+				j.res.value, j.res.ok = kv, err == nil
+				if err == nil {
+					c.writtenAs(j, aofRecord{Op: aofPop, Key: kv.key, Left: j.op == blpop})
+				}
+			}
+			j.res.err = err
+			j.finish()
+		case requeue:
+			args := j.val.(requeueArgs)
+			vals := []interface{}{args.val}
+			blocked := c.waits.blocked(j.key)
+			j.res.value, j.res.err = c.push(j.key, vals, args.left)
+			if j.res.err == nil {
+				c.pushed(j, vals, args.left, blocked)
+			}
+			j.finish()
+		case jsonset, jsondel, jsonnumincrby, jsonarrappend:
+			args := j.val.(jsonArgs)
+			changed := true
+			switch j.op {
+			case jsonset:
+				j.res.err = c.jsonSet(j.key, args.path, args.vals[0])
+			case jsondel:
+				var removed int
+				removed, j.res.err = c.jsonDel(j.key, args.path)
+				j.res.value, changed = removed, removed > 0
+			case jsonnumincrby:
+				j.res.value, j.res.err = c.jsonNumIncrBy(j.key, args.path, args.vals[0])
+			case jsonarrappend:
+				j.res.value, j.res.err = c.jsonArrAppend(j.key, args.path, args.vals)
+			}
+			if j.res.err == nil && changed {
+				c.written(j, j.key)
+			}
+			j.finish()
+		case jsonget:
+			go func() {
+				if exc.isReady() {
+					exc.addCount(true)
+					args := j.val.(jsonArgs)
+					j.res.value, j.res.ok, j.res.err = c.jsonGet(j.key, args.path)
+					j.finish()
+					exc.addCount(false)
+				} else {
+					exc.jobs <- j
+				}
+			}()
+		case llen:
+			go func() {
+				if exc.isReady() {
+					exc.addCount(true)
+					j.res.value, j.res.err = c.llen(j.key)
+					j.finish()
+					exc.addCount(false)
+				} else {
+					exc.jobs <- j
+				}
+			}()
 		case ttl:
 			go func() {
 				if exc.isReady() {
 					exc.addCount(true)
-					j.res.value, j.res.ok = exc.c.ttl(j.key)
-					close(j.done)
+					j.res.value, j.res.ok = c.ttl(j.key)
+					j.finish()
 					exc.addCount(false)
 				} else {
 					exc.jobs <- j
@@ -0,0 +1,470 @@
+package tailor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Progress is reported once this many keys more were exported or imported.
+const exportProgressEvery = 1000
+
+// the keys read by Import are applied this many at once
+const importBatch = 1000
+
+// ExportFormat is the format of the files of Export and Import.
+type ExportFormat byte
+
+const (
+	// one JSON object per line: {"key":..., "type":..., "value":..., "ttl":...}
+	ExportJSONLines ExportFormat = iota
+	// a header line "key,type,value,ttl" and one record per key
+	ExportCSV
+)
+
+func ParseExportFormat(s string) (ExportFormat, error) {
+	switch s {
+	case "jsonl":
+		return ExportJSONLines, nil
+	case "csv":
+		return ExportCSV, nil
+	default:
+		return 0, fmt.Errorf("invalid format '%s', it must be jsonl or csv", s)
+	}
+}
+
+func (f ExportFormat) String() string {
+	if f == ExportCSV {
+		return "csv"
+	}
+	return "jsonl"
+}
+
+// ExportOptions are the options of Export and Import.
+type ExportOptions struct {
+	Format ExportFormat
+	// pattern the keys must match, empty matches every key
+	Match string
+	// Match is a glob unless it is Regexp
+	Mode PatternMode
+	// called every 1000 keys and once it is done, if it is set
+	Progress func(ExportProgress)
+}
+
+// ExportProgress counts the keys an export or an import went through.
+type ExportProgress struct {
+	// the keys which were written or imported
+	Keys int `json:"keys"`
+	// the keys which did not match, and the values of the types
+	// which cannot be exported, which are those of the Go API
+	// but string, []byte, the numbers and bool
+	Skipped int  `json:"skipped"`
+	Done    bool `json:"done,omitempty"`
+}
+
+// exportRecord is one key of the file. The value is the JSON of a string
+// for "string", of the base64 of the bytes for "bytes", of the number for
+// "int", "uint" and "float", of an array for "list" and the document for
+// "json". The ttl is in millisecond, -1 means the key never expires.
+type exportRecord struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+	TTL   int64           `json:"ttl"`
+}
+
+var exportHeader = []string{"key", "type", "value", "ttl"}
+
+// exportedList is the copy of the values of a list, taken under the
+// lock of its cache.
+type exportedList []interface{}
+
+// exportValue returns the type and the JSON of val,
+// false if val is of a type which cannot be exported.
+func exportValue(val interface{}) (string, []byte, bool) {
+	var typ string
+	switch v := val.(type) {
+	case string:
+		typ = "string"
+	case []byte:
+		typ = "bytes"
+	case int, int8, int16, int32, int64:
+		typ = "int"
+	case uint, uint8, uint16, uint32, uint64:
+		typ = "uint"
+	case float32:
+		typ = "float"
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return "", nil, false
+		}
+	case float64:
+		typ = "float"
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", nil, false
+		}
+	case bool:
+		typ = "bool"
+	case exportedList:
+		typ = "list"
+		val = []interface{}(v)
+	case *JSONDoc:
+		data, err := v.MarshalJSON()
+		return "json", data, err == nil
+	default:
+		return "", nil, false
+	}
+	data, err := json.Marshal(val)
+	return typ, data, err == nil
+}
+
+// importValue makes the value of a record.
+func importValue(typ string, data json.RawMessage) (interface{}, error) {
+	var err error
+	switch typ {
+	case "string":
+		var v string
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "bytes":
+		var v []byte
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "int":
+		var v int64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "uint":
+		var v uint64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "float":
+		var v float64
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "bool":
+		var v bool
+		err = json.Unmarshal(data, &v)
+		return v, err
+	case "list":
+		var vals []interface{}
+		if err = json.Unmarshal(data, &vals); err != nil {
+			return nil, err
+		}
+		list := &LinkedList{}
+		for _, val := range vals {
+			list.AddLast(val)
+		}
+		return list, nil
+	case "json":
+		return NewJSONDoc(data)
+	default:
+		return nil, fmt.Errorf("unknown type '%s'", typ)
+	}
+}
+
+// Export writes the keys of the database which match into w, reading
+// them a hash slot at a time like Scan, so the whole keyspace is never
+// held at once. The keys written meanwhile may or may not be exported.
+func (c *Cache) Export(w io.Writer, opts ExportOptions) (ExportProgress, error) {
+	var progress ExportProgress
+	var p *Pattern
+	if opts.Match != "" {
+		var err error
+		if p, err = CompilePattern(opts.Match, opts.Mode); err != nil {
+			return progress, err
+		}
+	}
+
+	type entry struct {
+		key string
+		val interface{}
+		exp int64
+	}
+	bw := bufio.NewWriter(w)
+	var cw *csv.Writer
+	if opts.Format == ExportCSV {
+		cw = csv.NewWriter(bw)
+		if err := cw.Write(exportHeader); err != nil {
+			return progress, err
+		}
+	}
+	caches := c.caches()
+	var entries []entry
+	for slot := 0; slot < scanSlots; slot++ {
+		entries = entries[:0]
+		for _, ch := range caches {
+			ch.mu.RLock()
+		}
+		for _, ch := range caches {
+			for key := range ch.slots[slot] {
+				item := ch.items[key]
+				if item.Expired() {
+					continue
+				}
+				if p != nil && !p.Match(key) {
+					progress.Skipped++
+					continue
+				}
+				val := item.Data
+				if list, ok := val.(*LinkedList); ok {
+					val = exportedList(list.Values())
+				}
+				entries = append(entries, entry{key, val, item.Expiration})
+			}
+		}
+		for i := len(caches) - 1; i >= 0; i-- {
+			caches[i].mu.RUnlock()
+		}
+
+		now := time.Now().UnixNano()
+		for _, e := range entries {
+			typ, data, ok := exportValue(c.codec.unpack(e.val))
+			if !ok {
+				progress.Skipped++
+				continue
+			}
+			rec := exportRecord{Key: e.key, Type: typ, Value: data, TTL: -1}
+			if e.exp >= 0 {
+				// a key which has not expired has at least 1ms left
+				rec.TTL = (e.exp - now) / int64(time.Millisecond)
+				if rec.TTL < 1 {
+					rec.TTL = 1
+				}
+			}
+			var err error
+			if cw != nil {
+				err = cw.Write(rec.csvRow())
+			} else {
+				err = writeJSONLine(bw, &rec)
+			}
+			if err != nil {
+				return progress, err
+			}
+			progress.Keys++
+			if opts.Progress != nil && progress.Keys%exportProgressEvery == 0 {
+				opts.Progress(progress)
+			}
+		}
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return progress, err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return progress, err
+	}
+	progress.Done = true
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+	return progress, nil
+}
+
+func writeJSONLine(w *bufio.Writer, rec *exportRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
+
+// csvRow writes the strings and the bytes as they are, without
+// the quotes of JSON, and the other values as their JSON.
+func (rec *exportRecord) csvRow() []string {
+	val := string(rec.Value)
+	if rec.Type == "string" || rec.Type == "bytes" {
+		var s string
+		_ = json.Unmarshal(rec.Value, &s)
+		val = s
+	}
+	return []string{rec.Key, rec.Type, val, strconv.FormatInt(rec.TTL, 10)}
+}
+
+func csvRecord(row []string) (exportRecord, error) {
+	rec := exportRecord{Key: row[0], Type: row[1], Value: json.RawMessage(row[2])}
+	if rec.Type == "string" || rec.Type == "bytes" {
+		rec.Value, _ = json.Marshal(row[2])
+	}
+	ttl, err := strconv.ParseInt(row[3], 10, 64)
+	if err != nil {
+		return rec, fmt.Errorf("invalid ttl '%s'", row[3])
+	}
+	rec.TTL = ttl
+	return rec, nil
+}
+
+// Import sets the keys of r which match into the database, the keys
+// which exist are replaced. The keys are applied a batch at a time, so
+// if a record is invalid the keys before it are imported already. The
+// ttl of a key counts from when it is imported. The numbers are imported
+// as int64, uint64 and float64, and the elements of the lists as the
+// values of encoding/json.
+func (c *Cache) Import(r io.Reader, opts ExportOptions) (ExportProgress, error) {
+	var progress ExportProgress
+	var p *Pattern
+	if opts.Match != "" {
+		var err error
+		if p, err = CompilePattern(opts.Match, opts.Mode); err != nil {
+			return progress, err
+		}
+	}
+
+	var next func() (exportRecord, error)
+	line := 0
+	if opts.Format == ExportCSV {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = len(exportHeader)
+		header, err := cr.Read()
+		if err == io.EOF {
+			return progress, nil
+		}
+		if err != nil {
+			return progress, err
+		}
+		if header[0] != exportHeader[0] || header[1] != exportHeader[1] ||
+			header[2] != exportHeader[2] || header[3] != exportHeader[3] {
+			return progress, fmt.Errorf("the header must be %v", exportHeader)
+		}
+		line++
+		next = func() (exportRecord, error) {
+			row, err := cr.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			return csvRecord(row)
+		}
+	} else {
+		br := bufio.NewReader(r)
+		next = func() (exportRecord, error) {
+			for {
+				data, err := br.ReadBytes('\n')
+				if err == io.EOF && len(data) > 0 {
+					err = nil
+				}
+				if err != nil {
+					return exportRecord{}, err
+				}
+				data = bytes.TrimSpace(data)
+				if len(data) == 0 {
+					line++
+					continue
+				}
+				var rec exportRecord
+				if err = json.Unmarshal(data, &rec); err != nil {
+					return rec, err
+				}
+				return rec, nil
+			}
+		}
+	}
+
+	items := make(map[string]Item)
+	apply := func() {
+		if len(items) == 0 {
+			return
+		}
+		snap := &snapshot{Databases: make([]map[string]Item, c.index+1)}
+		snap.Databases[c.index] = items
+		c.applySnapshot(snap, LoadOverwrite)
+		items = make(map[string]Item)
+	}
+	for {
+		rec, err := next()
+		line++
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = importItem(items, &rec, p, &progress)
+		}
+		if err != nil {
+			apply()
+			return progress, fmt.Errorf("line %d: %v", line, err)
+		}
+		if len(items) >= importBatch {
+			apply()
+		}
+		if opts.Progress != nil && (progress.Keys+progress.Skipped)%exportProgressEvery == 0 {
+			opts.Progress(progress)
+		}
+	}
+	apply()
+	progress.Done = true
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+	return progress, nil
+}
+
+func importItem(items map[string]Item, rec *exportRecord, p *Pattern, progress *ExportProgress) error {
+	if rec.Key == "" {
+		return fmt.Errorf("the key is empty")
+	}
+	if p != nil && !p.Match(rec.Key) {
+		progress.Skipped++
+		return nil
+	}
+	if rec.TTL < -1 || rec.TTL == 0 {
+		return fmt.Errorf("invalid ttl %d of '%s'", rec.TTL, rec.Key)
+	}
+	val, err := importValue(rec.Type, rec.Value)
+	if err != nil {
+		return fmt.Errorf("value of '%s': %v", rec.Key, err)
+	}
+	item := Item{Data: val, Expiration: -1}
+	if rec.TTL > 0 {
+		item.Expiration = time.Now().Add(time.Duration(rec.TTL) * time.Millisecond).UnixNano()
+	}
+	items[rec.Key] = item
+	progress.Keys++
+	return nil
+}
+
+// ExportFile exports into filename, the file is written aside and
+// renamed over filename once it is complete. The progress is reported
+// done only once it is renamed.
+func (c *Cache) ExportFile(filename string, opts ExportOptions) (ExportProgress, error) {
+	report := opts.Progress
+	if report != nil {
+		opts.Progress = func(progress ExportProgress) {
+			if !progress.Done {
+				report(progress)
+			}
+		}
+	}
+	var progress ExportProgress
+	err := writeFileAtomic(filename, func(w io.Writer) error {
+		var err error
+		progress, err = c.Export(w, opts)
+		return err
+	})
+	if err != nil {
+		progress.Done = false
+		return progress, err
+	}
+	if report != nil {
+		report(progress)
+	}
+	return progress, nil
+}
+
+func (c *Cache) ImportFile(filename string, opts ExportOptions) (ExportProgress, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return ExportProgress{}, err
+	}
+	defer file.Close()
+	return c.Import(file, opts)
+}
@@ -0,0 +1,233 @@
+package tailor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportFileDoneAfterRename(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	for i := 0; i < 2500; i++ {
+		c.Set(strconv.Itoa(i), i)
+	}
+	c.WaitWrites()
+	filename := filepath.Join(tempDir(t), "keys.jsonl")
+	dones := 0
+	opts := ExportOptions{Progress: func(progress ExportProgress) {
+		if !progress.Done {
+			return
+		}
+		dones++
+		if _, err := os.Stat(filename); err != nil {
+			t.Errorf("done before the file was renamed: %v", err)
+		}
+	}}
+	progress, err := c.ExportFile(filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !progress.Done || progress.Keys != 2500 || dones != 1 {
+		t.Fatalf("progress %+v, done reported %d times", progress, dones)
+	}
+
+	dones = 0
+	if _, err := c.ExportFile(filepath.Join(filename, "not-a-dir"), opts); err == nil {
+		t.Fatal("exported under a file")
+	}
+	if dones != 0 {
+		t.Fatal("done reported for a failed export")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []ExportFormat{ExportJSONLines, ExportCSV} {
+		t.Run(format.String(), func(t *testing.T) {
+			c := newTestCache(time.Minute, 1)
+			defer c.Close()
+			c.Set("string", "a,\"b\"\nc")
+			c.Set("bytes", []byte{0, 1, 0xff})
+			c.Set("int", 42)
+			c.Set("uint", uint8(7))
+			c.Set("float", 1.5)
+			c.Set("bool", true)
+			c.Setex("ttl", "v", time.Hour)
+			if _, err := c.RPush("list", "x", 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.JSONSet("doc", "$", `{"a":[1,"b"]}`); err != nil {
+				t.Fatal(err)
+			}
+			// not of a type which can be exported
+			c.Set("struct", struct{}{})
+			c.WaitWrites()
+
+			var buf bytes.Buffer
+			progress, err := c.Export(&buf, ExportOptions{Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if progress.Keys != 9 || progress.Skipped != 1 || !progress.Done {
+				t.Fatalf("export progress %+v", progress)
+			}
+
+			loaded := newTestCache(time.Minute, 1)
+			defer loaded.Close()
+			progress, err = loaded.Import(&buf, ExportOptions{Format: format})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if progress.Keys != 9 || progress.Skipped != 0 || !progress.Done {
+				t.Fatalf("import progress %+v", progress)
+			}
+			for key, want := range map[string]interface{}{
+				"string": "a,\"b\"\nc",
+				"bytes":  []byte{0, 1, 0xff},
+				// the numbers come back as the widest type of their kind
+				"int":   int64(42),
+				"uint":  uint64(7),
+				"float": 1.5,
+				"bool":  true,
+				"ttl":   "v",
+			} {
+				if v, found := loaded.Get(key); !found || !reflect.DeepEqual(v, want) {
+					t.Errorf("%s = %#v, %v, want %#v", key, v, found, want)
+				}
+			}
+			if ttl, found := loaded.Ttl("ttl"); !found || ttl <= 0 || ttl > time.Hour {
+				t.Errorf("ttl of ttl = %v, %v", ttl, found)
+			}
+			if _, found := loaded.Get("struct"); found {
+				t.Error("struct was imported")
+			}
+			v, _ := loaded.Get("list")
+			list, ok := v.(*LinkedList)
+			// the elements are the values of encoding/json
+			if !ok || !reflect.DeepEqual(list.Values(), []interface{}{"x", float64(2)}) {
+				t.Errorf("list = %#v", v)
+			}
+			if doc, _, err := loaded.JSONGet("doc", "$"); err != nil || doc != `{"a":[1,"b"]}` {
+				t.Errorf("doc = %s, %v", doc, err)
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	lines := func(n int) string {
+		var sb strings.Builder
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&sb, `{"key":"k%d","type":"int","value":%d,"ttl":-1}`+"\n", i, i)
+		}
+		return sb.String()
+	}
+	for _, tc := range []struct {
+		name   string
+		format ExportFormat
+		input  string
+		opts   ExportOptions
+		// the keys which are set afterwards
+		keys    int
+		skipped int
+		err     string
+	}{
+		{
+			name:   "match",
+			format: ExportJSONLines,
+			input: `{"key":"user:1","type":"string","value":"a","ttl":-1}
+{"key":"post:1","type":"string","value":"b","ttl":-1}
+
+{"key":"user:2","type":"string","value":"c","ttl":60000}
+`,
+			opts: ExportOptions{Match: "user:*"},
+			keys: 2, skipped: 1,
+		},
+		{
+			name:   "match regexp",
+			format: ExportCSV,
+			input:  "key,type,value,ttl\nuser:1,string,a,-1\npost:1,string,b,-1\n",
+			opts:   ExportOptions{Match: "^post:", Mode: Regexp},
+			keys:   1, skipped: 1,
+		},
+		{
+			name:   "base64 bytes",
+			format: ExportCSV,
+			input:  "key,type,value,ttl\nb,bytes,AAH/,-1\n",
+			keys:   1,
+		},
+		{
+			name:   "bad base64",
+			format: ExportCSV,
+			input:  "key,type,value,ttl\nb,bytes,!!,-1\n",
+			err:    "line 2",
+		},
+		{
+			name:   "bad header",
+			format: ExportCSV,
+			input:  "k,type,value,ttl\n",
+			err:    "header",
+		},
+		{
+			name:   "bad ttl",
+			format: ExportJSONLines,
+			input:  `{"key":"k","type":"string","value":"v","ttl":0}`,
+			err:    "invalid ttl",
+		},
+		{
+			// the batches before the bad line are applied
+			name:   "bad line",
+			format: ExportJSONLines,
+			input:  lines(importBatch+10) + "{not json\n" + lines(5),
+			keys:   importBatch + 10,
+			err:    fmt.Sprintf("line %d", importBatch+11),
+		},
+		{
+			name:   "unknown type",
+			format: ExportJSONLines,
+			input:  lines(3) + `{"key":"k","type":"set","value":[],"ttl":-1}`,
+			keys:   3,
+			err:    "unknown type",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache(time.Minute, 1)
+			defer c.Close()
+			tc.opts.Format = tc.format
+			progress, err := c.Import(strings.NewReader(tc.input), tc.opts)
+			if tc.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("error %v, want one with %q", err, tc.err)
+			}
+			if progress.Done != (tc.err == "") {
+				t.Errorf("done %v", progress.Done)
+			}
+			if progress.Skipped != tc.skipped {
+				t.Errorf("skipped %d, want %d", progress.Skipped, tc.skipped)
+			}
+			if n := c.Cnt(); n != tc.keys {
+				t.Errorf("%d keys, want %d", n, tc.keys)
+			}
+		})
+	}
+}
+
+func TestImportBase64Bytes(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	input := "key,type,value,ttl\nb,bytes,AAH/,-1\n"
+	if _, err := c.Import(strings.NewReader(input), ExportOptions{Format: ExportCSV}); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.Get("b"); !reflect.DeepEqual(v, []byte{0, 1, 0xff}) {
+		t.Fatalf("b = %#v", v)
+	}
+}
@@ -0,0 +1,294 @@
+package tailor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// fieldIndexes are the secondary indexes of a database, shared by both
+// of its caches. Their lock is always taken after the lock of a cache,
+// and guards the set of indexes: the writes only read it and take the
+// lock of each index they change, so that the writes of keys with
+// other prefixes do not wait for each other.
+type fieldIndexes struct {
+	mu      sync.RWMutex
+	indexes map[string]*fieldIndex
+	// the number of indexes, read without the lock by the writes,
+	// which do not take it at all while there is no index
+	count int32
+}
+
+// fieldIndex maps the value of a field to the keys with the prefix
+// whose values have it. Only the scalars of JSON documents are indexed.
+type fieldIndex struct {
+	mu     sync.RWMutex
+	name   string
+	prefix string
+	path   string
+	steps  []pathStep
+	keys   map[string]map[string]struct{}
+	values map[string]string
+}
+
+type IndexInfo struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	Path   string `json:"path"`
+	// the keys which have the field
+	Keys int `json:"keys"`
+}
+
+func newFieldIndexes() *fieldIndexes {
+	return &fieldIndexes{indexes: make(map[string]*fieldIndex)}
+}
+
+// fieldValue returns the value at steps as it is indexed,
+// false if there is none or it is not a scalar.
+func fieldValue(data interface{}, steps []pathStep) (string, bool) {
+	doc, ok := data.(*JSONDoc)
+	if !ok {
+		return "", false
+	}
+	doc.mu.RLock()
+	v, err := lookupPath(doc.root, steps)
+	doc.mu.RUnlock()
+	if err != nil {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	case nil:
+		return "null", true
+	default:
+		return "", false
+	}
+}
+
+func (fi *fieldIndex) covers(key string) bool {
+	return len(key) >= len(fi.prefix) && key[:len(fi.prefix)] == fi.prefix
+}
+
+func (fi *fieldIndex) add(key string, data interface{}) {
+	if !fi.covers(key) {
+		return
+	}
+	if val, ok := fieldValue(data, fi.steps); ok {
+		fi.put(key, val)
+	}
+}
+
+func (fi *fieldIndex) put(key, val string) {
+	fi.values[key] = val
+	keys, found := fi.keys[val]
+	if !found {
+		keys = make(map[string]struct{})
+		fi.keys[val] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+func (fi *fieldIndex) remove(key string) {
+	val, found := fi.values[key]
+	if !found {
+		return
+	}
+	delete(fi.values, key)
+	keys := fi.keys[val]
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(fi.keys, val)
+	}
+}
+
+// empty reports whether there is no index. An index is created while
+// the locks of the caches are held, so a writer which holds the lock
+// of a cache does not miss it.
+func (fx *fieldIndexes) empty() bool {
+	return atomic.LoadInt32(&fx.count) == 0
+}
+
+// update indexes the value of key again, the caller must hold
+// the lock of the cache. Every write of a key ends up here.
+func (fx *fieldIndexes) update(key string, data interface{}) {
+	if fx.empty() {
+		return
+	}
+	fx.mu.RLock()
+	defer fx.mu.RUnlock()
+	for _, fi := range fx.indexes {
+		if !fi.covers(key) {
+			continue
+		}
+		val, ok := fieldValue(data, fi.steps)
+		fi.mu.Lock()
+		fi.remove(key)
+		if ok {
+			fi.put(key, val)
+		}
+		fi.mu.Unlock()
+	}
+}
+
+func (fx *fieldIndexes) remove(key string) {
+	if fx.empty() {
+		return
+	}
+	fx.mu.RLock()
+	defer fx.mu.RUnlock()
+	for _, fi := range fx.indexes {
+		if fi.covers(key) {
+			fi.mu.Lock()
+			fi.remove(key)
+			fi.mu.Unlock()
+		}
+	}
+}
+
+// removeAll removes the keys of items from every index.
+func (fx *fieldIndexes) removeAll(items map[string]Item) {
+	if fx.empty() {
+		return
+	}
+	fx.mu.RLock()
+	defer fx.mu.RUnlock()
+	for _, fi := range fx.indexes {
+		fi.mu.Lock()
+		for key := range items {
+			fi.remove(key)
+		}
+		fi.mu.Unlock()
+	}
+}
+
+// CreateIndex indexes the field at path of the JSON documents of the keys
+// with prefix, so that Find returns the keys by the value of the field.
+// The index is kept up to date on every write, delete and expiry, and
+// moves with the keys on SwapDB. It is not saved into snapshots nor the
+// append-only file, so it is created again after a restart: creating an
+// index which exists with the same prefix and path does nothing.
+func (c *Cache) CreateIndex(name, prefix, path string) error {
+	steps, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	fi := &fieldIndex{
+		name:   name,
+		prefix: prefix,
+		path:   path,
+		steps:  steps,
+		keys:   make(map[string]map[string]struct{}),
+		values: make(map[string]string),
+	}
+	// the keys cannot be written while the index is built
+	caches := c.caches()
+	for _, ch := range caches {
+		ch.mu.RLock()
+	}
+	defer func() {
+		for i := len(caches) - 1; i >= 0; i-- {
+			caches[i].mu.RUnlock()
+		}
+	}()
+	fx := c.neCache.fields
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	if old, found := fx.indexes[name]; found {
+		if old.prefix == prefix && old.path == path {
+			return nil
+		}
+		return fmt.Errorf("index '%s' already exists on %s field %s", name, old.prefix, old.path)
+	}
+	for _, ch := range caches {
+		for key, item := range ch.items {
+			if !item.Expired() {
+				fi.add(key, item.Data)
+			}
+		}
+	}
+	fx.indexes[name] = fi
+	atomic.AddInt32(&fx.count, 1)
+	return nil
+}
+
+// DropIndex returns false if there is no index called name.
+func (c *Cache) DropIndex(name string) bool {
+	fx := c.fieldIndexes()
+	fx.mu.Lock()
+	defer fx.mu.Unlock()
+	if _, found := fx.indexes[name]; !found {
+		return false
+	}
+	delete(fx.indexes, name)
+	atomic.AddInt32(&fx.count, -1)
+	return true
+}
+
+// Find returns the keys in order whose field of the index equals val, numbers
+// are compared as they are written, booleans and null as true, false and null.
+func (c *Cache) Find(index, val string) ([]string, error) {
+	fx := c.fieldIndexes()
+	fx.mu.RLock()
+	fi, found := fx.indexes[index]
+	if !found {
+		fx.mu.RUnlock()
+		return nil, fmt.Errorf("index '%s' does not exist", index)
+	}
+	fi.mu.RLock()
+	candidates := make([]string, 0, len(fi.keys[val]))
+	for key := range fi.keys[val] {
+		candidates = append(candidates, key)
+	}
+	fi.mu.RUnlock()
+	fx.mu.RUnlock()
+
+	// an expired key stays indexed until it is cleaned
+	res := candidates[:0]
+	for _, key := range candidates {
+		if _, found := c.item(key); found {
+			res = append(res, key)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Indexes returns the secondary indexes of the database by name.
+func (c *Cache) Indexes() []IndexInfo {
+	fx := c.fieldIndexes()
+	fx.mu.RLock()
+	defer fx.mu.RUnlock()
+	res := make([]IndexInfo, 0, len(fx.indexes))
+	for _, fi := range fx.indexes {
+		fi.mu.RLock()
+		res = append(res, IndexInfo{
+			Name:   fi.name,
+			Prefix: fi.prefix,
+			Path:   fi.path,
+			Keys:   len(fi.values),
+		})
+		fi.mu.RUnlock()
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// fieldIndexes returns the indexes under the lock of the cache,
+// as SwapDB moves them between the databases.
+func (c *Cache) fieldIndexes() *fieldIndexes {
+	c.neCache.mu.RLock()
+	defer c.neCache.mu.RUnlock()
+	return c.neCache.fields
+}
@@ -0,0 +1,163 @@
+package tailor
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setDoc(t *testing.T, c *Cache, key, doc string) {
+	if err := c.JSONSet(key, "$", doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// indexedKeys returns how many keys the index has, expired or not.
+func indexedKeys(c *Cache, index string) int {
+	for _, info := range c.Indexes() {
+		if info.Name == index {
+			return info.Keys
+		}
+	}
+	return -1
+}
+
+func checkFind(t *testing.T, c *Cache, val string, want ...string) {
+	t.Helper()
+	keys, err := c.Find("city", val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Find(%q) = %v, want %v", val, keys, want)
+	}
+}
+
+func TestFieldIndexMaintained(t *testing.T) {
+	c := newTestCache(10*time.Millisecond, 1)
+	defer c.Close()
+	setDoc(t, c, "user:1", `{"city":"Paris"}`)
+	if err := c.CreateIndex("city", "user:", "$.city"); err != nil {
+		t.Fatal(err)
+	}
+	setDoc(t, c, "user:2", `{"city":"Paris"}`)
+	setDoc(t, c, "other:1", `{"city":"Paris"}`)
+	checkFind(t, c, "Paris", "user:1", "user:2")
+
+	t.Run("overwrite", func(t *testing.T) {
+		setDoc(t, c, "user:1", `{"city":"Rome"}`)
+		checkFind(t, c, "Paris", "user:2")
+		checkFind(t, c, "Rome", "user:1")
+		// a value which is not a document leaves the index
+		c.Set("user:1", "plain")
+		c.WaitWrites()
+		checkFind(t, c, "Rome")
+		if n := indexedKeys(c, "city"); n != 1 {
+			t.Errorf("%d keys are indexed, want 1", n)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		setDoc(t, c, "user:3", `{"city":"Oslo"}`)
+		c.Del("user:3")
+		c.WaitWrites()
+		checkFind(t, c, "Oslo")
+		if n := indexedKeys(c, "city"); n != 1 {
+			t.Errorf("%d keys are indexed, want 1", n)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		doc, err := NewJSONDoc([]byte(`{"city":"Lima"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Setex("user:4", doc, 20*time.Millisecond)
+		c.WaitWrites()
+		checkFind(t, c, "Lima", "user:4")
+		time.Sleep(30 * time.Millisecond)
+		// Find skips it at once, the cleaner unindexes it
+		checkFind(t, c, "Lima")
+		deadline := time.Now().Add(5 * time.Second)
+		for indexedKeys(c, "city") != 1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%d keys are indexed, want 1", indexedKeys(c, "city"))
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	if !c.DropIndex("city") {
+		t.Fatal("city was not dropped")
+	}
+	if !c.fieldIndexes().empty() {
+		t.Error("an index is left")
+	}
+	setDoc(t, c, "user:5", `{"city":"Paris"}`)
+	if _, err := c.Find("city", "Paris"); err == nil {
+		t.Error("found by a dropped index")
+	}
+}
+
+func TestCreateIndexAgain(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	setDoc(t, c, "user:1", `{"city":"Paris"}`)
+	for i := 0; i < 2; i++ {
+		if err := c.CreateIndex("city", "user:", "$.city"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkFind(t, c, "Paris", "user:1")
+	if err := c.CreateIndex("city", "user:", "$.town"); err == nil {
+		t.Error("created an index with another path under the same name")
+	}
+	if err := c.CreateIndex("city", "member:", "$.city"); err == nil {
+		t.Error("created an index with another prefix under the same name")
+	}
+	if infos := c.Indexes(); len(infos) != 1 || infos[0].Path != "$.city" {
+		t.Errorf("indexes = %+v", infos)
+	}
+}
+
+func TestFieldIndexConcurrent(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	if err := c.CreateIndex("city", "user:", "$.city"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CreateIndex("age", "member:", "$.age"); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				n := strconv.Itoa(w*50 + i)
+				if err := c.JSONSet("user:"+n, "$", `{"city":"Paris"}`); err != nil {
+					t.Error(err)
+				}
+				if err := c.JSONSet("member:"+n, "$", `{"age":`+strconv.Itoa(i%2)+`}`); err != nil {
+					t.Error(err)
+				}
+				if _, err := c.Find("city", "Paris"); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if keys, _ := c.Find("city", "Paris"); len(keys) != 200 {
+		t.Errorf("%d keys of Paris, want 200", len(keys))
+	}
+	if keys, _ := c.Find("age", "1"); len(keys) != 100 {
+		t.Errorf("%d keys of age 1, want 100", len(keys))
+	}
+}
@@ -0,0 +1,97 @@
+package tailor
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileStore is a Store keeping one gob file per key in a directory,
+// it is meant for local tests rather than for production.
+type FileStore struct {
+	dir string
+}
+
+// the longest key whose file is named by the key itself, as most
+// file systems do not take names of more than 255 bytes
+const fileStoreMaxKey = 100
+
+// the value is wrapped, so that gob records its concrete type.
+// The key is kept as well, as the name of a long key is its hash.
+type fileStoreRecord struct {
+	Key string
+	Val interface{}
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// the key is hex encoded, so that any key is a valid file name,
+// a long or empty key is named by its SHA-256 instead
+func (fs *FileStore) path(key string) string {
+	if key == "" || len(key) > fileStoreMaxKey {
+		sum := sha256.Sum256([]byte(key))
+		return filepath.Join(fs.dir, "sha256-"+hex.EncodeToString(sum[:]))
+	}
+	return filepath.Join(fs.dir, hex.EncodeToString([]byte(key)))
+}
+
+func (fs *FileStore) Get(key string) (interface{}, bool, error) {
+	file, err := os.Open(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	var record fileStoreRecord
+	err = gob.NewDecoder(file).Decode(&record)
+	if err != nil {
+		return nil, false, err
+	}
+	// the files written before the key was kept have none
+	if record.Key != "" && record.Key != key {
+		return nil, false, nil
+	}
+	return record.Val, true, nil
+}
+
+// Put writes a temp file and renames it,
+// so that a reader never sees a partial value.
+func (fs *FileStore) Put(key string, val interface{}) error {
+	if err := registerGob(val); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(fs.dir, ".put-")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(file).Encode(&fileStoreRecord{Key: key, Val: val})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), fs.path(key))
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+func (fs *FileStore) Delete(key string) error {
+	err := os.Remove(fs.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
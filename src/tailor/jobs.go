@@ -0,0 +1,232 @@
+package tailor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DaemonJob is the name of the job managed by ReplaceDaemonOp.
+const DaemonJob = "daemon"
+
+type JobInfo struct {
+	Name    string    `json:"name"`
+	Running bool      `json:"running"`
+	Runs    uint64    `json:"runs"`
+	Fails   uint64    `json:"fails"`
+	LastRun time.Time `json:"lastRun"`
+	NextRun time.Time `json:"nextRun"`
+	LastErr string    `json:"lastErr,omitempty"`
+}
+
+type cacheJob struct {
+	name  string
+	sched Schedule
+	run   func(*Cache) error
+	// ctl serializes start and stop, so that a job
+	// never has two loops even while it is stopping.
+	ctl  sync.Mutex
+	stop chan struct{}
+	done chan struct{}
+	// mu guards the fields below
+	mu   sync.Mutex
+	info JobInfo
+}
+
+func (j *cacheJob) start(c *Cache) error {
+	j.ctl.Lock()
+	defer j.ctl.Unlock()
+	if j.stop != nil {
+		return fmt.Errorf("job '%s' has started", j.name)
+	}
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	j.mu.Lock()
+	j.info.Running = true
+	j.mu.Unlock()
+	go j.loop(c, j.stop, j.done)
+	return nil
+}
+
+// stopAndWait waits for the running op to return,
+// so a job must not stop itself synchronously.
+func (j *cacheJob) stopAndWait() error {
+	j.ctl.Lock()
+	defer j.ctl.Unlock()
+	if j.stop == nil {
+		return fmt.Errorf("job '%s' has stopped", j.name)
+	}
+	close(j.stop)
+	<-j.done
+	j.stop, j.done = nil, nil
+	j.mu.Lock()
+	j.info.Running = false
+	j.info.NextRun = time.Time{}
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *cacheJob) isRunning() bool {
+	j.ctl.Lock()
+	defer j.ctl.Unlock()
+	return j.stop != nil
+}
+
+func (j *cacheJob) loop(c *Cache, stop, done chan struct{}) {
+	ended := j.runUntil(c, stop)
+	close(done)
+	if !ended {
+		return
+	}
+	// the schedule has no next run, so the job stops by itself
+	// and can be started again, unless it was stopped meanwhile.
+	j.ctl.Lock()
+	defer j.ctl.Unlock()
+	if j.stop != stop {
+		return
+	}
+	j.stop, j.done = nil, nil
+	j.mu.Lock()
+	j.info.Running = false
+	j.info.NextRun = time.Time{}
+	j.mu.Unlock()
+}
+
+// runUntil runs the job by its schedule until it is stopped,
+// it returns true if the schedule ran out first.
+func (j *cacheJob) runUntil(c *Cache, stop chan struct{}) bool {
+	for {
+		next := j.sched.Next(time.Now())
+		if next.IsZero() {
+			return true
+		}
+		j.mu.Lock()
+		j.info.NextRun = next
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			j.runOnce(c)
+		case <-stop:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+func (j *cacheJob) runOnce(c *Cache) {
+	start := time.Now()
+	err := j.call(c)
+	j.mu.Lock()
+	j.info.Runs++
+	j.info.LastRun = start
+	if err != nil {
+		j.info.Fails++
+		j.info.LastErr = err.Error()
+	} else {
+		j.info.LastErr = ""
+	}
+	j.mu.Unlock()
+	if err == nil {
+		return
+	}
+	if onErr := c.jobs.errHandler(); onErr != nil {
+		onErr(j.name, err)
+	}
+}
+
+// call turns a panic of the op into an error of the job.
+func (j *cacheJob) call(c *Cache) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("job '%s' panicked: %v", j.name, x)
+		}
+	}()
+	return j.run(c)
+}
+
+func (j *cacheJob) snapshot() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+type jobRegistry struct {
+	mu    sync.Mutex
+	jobs  map[string]*cacheJob
+	onErr func(string, error)
+}
+
+func newJobRegistry() *jobRegistry {
+	return &jobRegistry{
+		jobs: make(map[string]*cacheJob),
+	}
+}
+
+func (r *jobRegistry) add(name string, sched Schedule, f func(*Cache) error) (*cacheJob, error) {
+	if sched == nil || f == nil {
+		return nil, fmt.Errorf("job '%s' needs a schedule and an op", name)
+	}
+	if interval, ok := sched.(every); ok && interval <= 0 {
+		return nil, fmt.Errorf("job '%s' needs a positive interval", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, found := r.jobs[name]; found {
+		return nil, fmt.Errorf("job '%s' exists", name)
+	}
+	j := &cacheJob{
+		name:  name,
+		sched: sched,
+		run:   f,
+		info:  JobInfo{Name: name},
+	}
+	r.jobs[name] = j
+	return j, nil
+}
+
+func (r *jobRegistry) get(name string) (*cacheJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, found := r.jobs[name]
+	if !found {
+		return nil, fmt.Errorf("there is no job '%s'", name)
+	}
+	return j, nil
+}
+
+func (r *jobRegistry) remove(name string) (*cacheJob, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, found := r.jobs[name]
+	if !found {
+		return nil, fmt.Errorf("there is no job '%s'", name)
+	}
+	delete(r.jobs, name)
+	return j, nil
+}
+
+func (r *jobRegistry) errHandler() func(string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.onErr
+}
+
+func (r *jobRegistry) list() []JobInfo {
+	r.mu.Lock()
+	jobs := make([]*cacheJob, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		jobs = append(jobs, j)
+	}
+	r.mu.Unlock()
+	res := make([]JobInfo, 0, len(jobs))
+	for _, j := range jobs {
+		res = append(res, j.snapshot())
+	}
+	sort.Slice(res, func(a, b int) bool {
+		return res[a].Name < res[b].Name
+	})
+	return res
+}
@@ -0,0 +1,78 @@
+package tailor
+
+import (
+	"testing"
+	"time"
+)
+
+// onceSchedule runs a job once, right after it is started.
+type onceSchedule struct {
+	ran bool
+}
+
+func (s *onceSchedule) Next(t time.Time) time.Time {
+	if s.ran {
+		return time.Time{}
+	}
+	s.ran = true
+	return t
+}
+
+func TestAddJobInterval(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	op := func(*Cache) error { return nil }
+	for _, tc := range []struct {
+		interval time.Duration
+		ok       bool
+	}{
+		{-time.Second, false},
+		{0, false},
+		{time.Nanosecond, true},
+		{time.Hour, true},
+	} {
+		name := tc.interval.String()
+		if err := c.AddJob(name, Every(tc.interval), op); (err == nil) != tc.ok {
+			t.Errorf("interval %v: error %v", tc.interval, err)
+		}
+		_ = c.RemoveJob(name)
+	}
+}
+
+func TestJobScheduleRunsOut(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	runs := make(chan struct{}, 2)
+	sched := &onceSchedule{}
+	if err := c.AddJob("once", sched, func(*Cache) error {
+		runs <- struct{}{}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// AddJob started it, then it is started again once it ran out
+	for run := 0; run < 2; run++ {
+		if run > 0 {
+			if err := c.StartJob("once"); err != nil {
+				t.Fatalf("run %d: %v", run, err)
+			}
+		}
+		<-runs
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			var info JobInfo
+			for _, info = range c.Jobs() {
+				if info.Name == "once" {
+					break
+				}
+			}
+			if !info.Running && info.NextRun.IsZero() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("run %d: the job is still running: %+v", run, info)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		sched.ran = false
+	}
+}
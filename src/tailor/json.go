@@ -0,0 +1,238 @@
+package tailor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+func notJSONErr(key string) error {
+	return fmt.Errorf("value of '%s' is not a JSON document", key)
+}
+
+// jsonArgs are the params of the JSON jobs besides the key.
+type jsonArgs struct {
+	path string
+	vals []string
+}
+
+// jsonUpdate updates the document of key under the lock,
+// found reports whether key exists in c.
+func (c *cache) jsonUpdate(key, path string, fn jsonUpdate) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, found := c.findForWrite(key)
+	if !found {
+		return false, nil
+	}
+	doc, ok := item.Data.(*JSONDoc)
+	if !ok {
+		return true, notJSONErr(key)
+	}
+	keep, err := doc.update(path, fn)
+	if err != nil {
+		return true, err
+	}
+	c.notify.notify(EventWritten, c.db, key, "")
+	if !keep {
+		c.removeItem(key)
+		c.notify.notify(EventDeleted, c.db, key, "")
+	} else {
+		// the document is updated in place, not by putItem
+		c.fields.update(key, doc)
+	}
+	return true, nil
+}
+
+func (c *cache) jsonGet(key, path string) ([]byte, bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	item, found := c.find(key)
+	if !found {
+		return nil, false, nil
+	}
+	doc, ok := item.Data.(*JSONDoc)
+	if !ok {
+		return nil, true, notJSONErr(key)
+	}
+	data, err := doc.Get(path)
+	return data, true, err
+}
+
+func (c *Cache) jsonUpdate(key, path string, fn jsonUpdate) (bool, error) {
+	found, err := c.neCache.jsonUpdate(key, path, fn)
+	if !found && c.exCache != c.neCache {
+		found, err = c.exCache.jsonUpdate(key, path, fn)
+	}
+	return found, err
+}
+
+// jsonSet creates the document of key if it does not exist,
+// which only works with the root path.
+func (c *Cache) jsonSet(key, path, data string) error {
+	val, err := decodeJSON([]byte(data))
+	if err != nil {
+		return err
+	}
+	found, err := c.jsonUpdate(key, path, func(interface{}, bool) (interface{}, bool, error) {
+		return val, true, nil
+	})
+	if found || err != nil {
+		return err
+	}
+	steps, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	if len(steps) > 0 {
+		return fmt.Errorf("'%s' does not exist, a new document must be set at the root", key)
+	}
+	c.neCache.set(key, &JSONDoc{root: val}, DefaultExpiration, nil)
+	if c.exCache != c.neCache {
+		c.exCache.discard(key)
+	}
+	return nil
+}
+
+func (c *Cache) jsonGet(key, path string) ([]byte, bool, error) {
+	data, found, err := c.neCache.jsonGet(key, path)
+	if !found && c.exCache != c.neCache {
+		data, found, err = c.exCache.jsonGet(key, path)
+	}
+	return data, found, err
+}
+
+// jsonDel removes the value at path, a path which does not exist
+// removes nothing and leaves the document as it is, unwritten.
+// Removing the root removes the key.
+func (c *Cache) jsonDel(key, path string) (int, error) {
+	removed := 0
+	_, err := c.jsonUpdate(key, path, func(_ interface{}, found bool) (interface{}, bool, error) {
+		if !found {
+			return nil, false, errNoPath
+		}
+		removed = 1
+		return nil, false, nil
+	})
+	if errors.Is(err, errNoPath) {
+		return 0, nil
+	}
+	return removed, err
+}
+
+func (c *Cache) jsonNumIncrBy(key, path, by string) (json.Number, error) {
+	var res json.Number
+	found, err := c.jsonUpdate(key, path, func(old interface{}, found bool) (interface{}, bool, error) {
+		n, ok := old.(json.Number)
+		if !found {
+			return nil, false, errNoPath
+		}
+		if !ok {
+			return nil, false, errNotNum
+		}
+		var err error
+		res, err = addNumbers(n, json.Number(by))
+		return res, true, err
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("'%s' does not exist", key)
+	}
+	return res, err
+}
+
+func (c *Cache) jsonArrAppend(key, path string, vals []string) (int, error) {
+	decoded := make([]interface{}, len(vals))
+	for i, val := range vals {
+		v, err := decodeJSON([]byte(val))
+		if err != nil {
+			return 0, err
+		}
+		decoded[i] = v
+	}
+	n := 0
+	found, err := c.jsonUpdate(key, path, func(old interface{}, found bool) (interface{}, bool, error) {
+		arr, ok := old.([]interface{})
+		if !found {
+			return nil, false, errNoPath
+		}
+		if !ok {
+			return nil, false, errNotArray
+		}
+		arr = append(arr, decoded...)
+		n = len(arr)
+		return arr, true, nil
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("'%s' does not exist", key)
+	}
+	return n, err
+}
+
+// JSONSet sets the value at path of the document of key to the JSON val.
+// A member is added to an object if it does not exist, while an array
+// index must exist. If key does not exist, path must be the root "$".
+// Paths are a subset of JSONPath: "$.a.b", "$['a']" and "$.arr[-1]".
+func (c *Cache) JSONSet(key, path, val string) error {
+	return c.jsonJob(jsonset, key, path, val).err
+}
+
+// JSONGet returns the JSON of the value at path of the document of key.
+func (c *Cache) JSONGet(key, path string) (string, bool, error) {
+	res := c.jsonJob(jsonget, key, path)
+	if !res.ok || res.err != nil {
+		return "", res.ok, res.err
+	}
+	return string(res.value.([]byte)), true, nil
+}
+
+// JSONDel removes the value at path of the document of key and returns
+// how many values were removed, removing the root removes the key.
+func (c *Cache) JSONDel(key, path string) (int, error) {
+	res := c.jsonJob(jsondel, key, path)
+	if res.err != nil {
+		return 0, res.err
+	}
+	return res.value.(int), nil
+}
+
+// JSONNumIncrBy adds the number by to the number at path
+// of the document of key, it returns the new number.
+func (c *Cache) JSONNumIncrBy(key, path, by string) (string, error) {
+	if !json.Valid([]byte(by)) {
+		return "", fmt.Errorf("'%s' is not a number", by)
+	}
+	if _, err := json.Number(by).Float64(); err != nil {
+		return "", fmt.Errorf("'%s' is not a number", by)
+	}
+	res := c.jsonJob(jsonnumincrby, key, path, by)
+	if res.err != nil {
+		return "", res.err
+	}
+	return string(res.value.(json.Number)), nil
+}
+
+// JSONArrAppend appends the JSON vals to the array at path of
+// the document of key, it returns the new length of the array.
+func (c *Cache) JSONArrAppend(key, path string, vals ...string) (int, error) {
+	res := c.jsonJob(jsonarrappend, key, path, vals...)
+	if res.err != nil {
+		return 0, res.err
+	}
+	return res.value.(int), nil
+}
+
+func (c *Cache) jsonJob(op byte, key, path string, vals ...string) response {
+	newJob := &job{
+		op:  op,
+		key: key,
+		val: jsonArgs{
+			path: path,
+			vals: vals,
+		},
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return newJob.res
+}
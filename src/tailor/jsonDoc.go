@@ -0,0 +1,340 @@
+package tailor
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+func init() {
+	// JSON documents are stored as values of the cache
+	gob.Register(&JSONDoc{})
+}
+
+// JSONDoc is a JSON document stored as a value. Its objects are
+// map[string]interface{}, its arrays []interface{} and its numbers
+// json.Number, so that integers keep every digit.
+type JSONDoc struct {
+	root interface{}
+	mu   sync.RWMutex
+}
+
+func NewJSONDoc(data []byte) (*JSONDoc, error) {
+	root, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONDoc{root: root}, nil
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	if dec.More() {
+		return nil, errors.New("invalid JSON: more than one value")
+	}
+	return v, nil
+}
+
+func (d *JSONDoc) MarshalJSON() ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return json.Marshal(d.root)
+}
+
+func (d *JSONDoc) String() string {
+	data, _ := d.MarshalJSON()
+	return string(data)
+}
+
+// Get returns the JSON of the value at path.
+func (d *JSONDoc) Get(path string) ([]byte, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	v, err := lookupPath(d.root, steps)
+	if err != nil {
+		return nil, pathErr(path, err)
+	}
+	return json.Marshal(v)
+}
+
+func (d *JSONDoc) GobEncode() ([]byte, error) {
+	return d.MarshalJSON()
+}
+
+func (d *JSONDoc) GobDecode(data []byte) error {
+	root, err := decodeJSON(data)
+	if err != nil {
+		return err
+	}
+	d.root = root
+	return nil
+}
+
+// copy returns a deep copy of the document, which the updates of d
+// do not change.
+func (d *JSONDoc) copy() *JSONDoc {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return &JSONDoc{root: copyJSON(d.root)}
+}
+
+// copyJSON copies the objects and arrays of v, the
+// other values of a decoded document are immutable.
+func copyJSON(v interface{}) interface{} {
+	switch node := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(node))
+		for k, child := range node {
+			m[k] = copyJSON(child)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(node))
+		for i, child := range node {
+			a[i] = copyJSON(child)
+		}
+		return a
+	}
+	return v
+}
+
+// update replaces the value at path by what fn returns for it, the
+// document is left as it is if fn fails. It returns false if the
+// root itself was removed.
+func (d *JSONDoc) update(path string, fn jsonUpdate) (bool, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	root, keep, err := updatePath(d.root, steps, fn)
+	if err != nil {
+		return false, pathErr(path, err)
+	}
+	d.root = root
+	return keep, nil
+}
+
+// pathStep is a member of an object or an element of an array,
+// a negative index counts from the end of the array.
+type pathStep struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+var (
+	errNoPath   = errors.New("does not exist")
+	errNotArray = errors.New("is not an array")
+	errNotNum   = errors.New("is not a number")
+)
+
+func pathErr(path string, err error) error {
+	return fmt.Errorf("path '%s' %w", path, err)
+}
+
+// parsePath parses the subset of JSONPath made of the root "$",
+// members ".name" or "['name']" and indexes "[0]" or "[-1]".
+// The "$" may be left out, and "." alone is the root as well.
+func parsePath(path string) ([]pathStep, error) {
+	invalid := fmt.Errorf("invalid path '%s'", path)
+	p := path
+	switch {
+	case p == "" || p == "$" || p == ".":
+		return nil, nil
+	case p[0] == '$':
+		p = p[1:]
+	case p[0] != '.' && p[0] != '[':
+		p = "." + p
+	}
+	var steps []pathStep
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			i := 1
+			for i < len(p) && p[i] != '.' && p[i] != '[' {
+				i++
+			}
+			if i == 1 {
+				return nil, invalid
+			}
+			steps = append(steps, pathStep{key: p[1:i]})
+			p = p[i:]
+		case '[':
+			if len(p) > 1 && (p[1] == '\'' || p[1] == '"') {
+				key, n, ok := quotedKey(p[1:])
+				if !ok || n+1 >= len(p) || p[n+1] != ']' {
+					return nil, invalid
+				}
+				steps = append(steps, pathStep{key: key})
+				p = p[n+2:]
+				continue
+			}
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, invalid
+			}
+			index, err := strconv.Atoi(p[1:end])
+			if err != nil {
+				return nil, invalid
+			}
+			steps = append(steps, pathStep{index: index, isIndex: true})
+			p = p[end+1:]
+		default:
+			return nil, invalid
+		}
+	}
+	return steps, nil
+}
+
+// quotedKey reads the key quoted at the start of s, in which '\'
+// escapes the next byte. It returns the length including the quotes.
+func quotedKey(s string) (string, int, bool) {
+	quote := s[0]
+	var key []byte
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) {
+				i++
+				key = append(key, s[i])
+			}
+		case quote:
+			return string(key), i + 1, true
+		default:
+			key = append(key, s[i])
+		}
+	}
+	return "", 0, false
+}
+
+func lookupPath(v interface{}, steps []pathStep) (interface{}, error) {
+	for _, s := range steps {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, found := node[s.key]
+			if s.isIndex || !found {
+				return nil, errNoPath
+			}
+			v = child
+		case []interface{}:
+			i, ok := arrayIndex(node, s)
+			if !ok {
+				return nil, errNoPath
+			}
+			v = node[i]
+		default:
+			return nil, errNoPath
+		}
+	}
+	return v, nil
+}
+
+func arrayIndex(arr []interface{}, s pathStep) (int, bool) {
+	if !s.isIndex {
+		return 0, false
+	}
+	i := s.index
+	if i < 0 {
+		i += len(arr)
+	}
+	return i, i >= 0 && i < len(arr)
+}
+
+// jsonUpdate returns the new value for the old one, found is false for a
+// missing member of an object. The value is removed if keep is false.
+type jsonUpdate func(old interface{}, found bool) (val interface{}, keep bool, err error)
+
+// updatePath writes a container only after fn and the updates below
+// it succeeded, so nothing changes if any of them fails.
+func updatePath(v interface{}, steps []pathStep, fn jsonUpdate) (interface{}, bool, error) {
+	if len(steps) == 0 {
+		return fn(v, true)
+	}
+	s := steps[0]
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if s.isIndex {
+			return nil, false, errNoPath
+		}
+		child, found := node[s.key]
+		var val interface{}
+		var keep bool
+		var err error
+		switch {
+		case found:
+			val, keep, err = updatePath(child, steps[1:], fn)
+		case len(steps) == 1:
+			val, keep, err = fn(nil, false)
+		default:
+			return nil, false, errNoPath
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if keep {
+			node[s.key] = val
+		} else {
+			delete(node, s.key)
+		}
+		return node, true, nil
+	case []interface{}:
+		i, ok := arrayIndex(node, s)
+		if !ok {
+			return nil, false, errNoPath
+		}
+		val, keep, err := updatePath(node[i], steps[1:], fn)
+		if err != nil {
+			return nil, false, err
+		}
+		if keep {
+			node[i] = val
+			return node, true, nil
+		}
+		return append(node[:i], node[i+1:]...), true, nil
+	default:
+		return nil, false, errNoPath
+	}
+}
+
+// addNumbers adds two JSON numbers, as integers if both are and
+// the sum does not overflow, otherwise as floats.
+func addNumbers(a, b json.Number) (json.Number, error) {
+	x, errX := a.Int64()
+	y, errY := b.Int64()
+	if errX == nil && errY == nil {
+		sum := x + y
+		if (sum > x) == (y > 0) {
+			return json.Number(strconv.FormatInt(sum, 10)), nil
+		}
+	}
+	f, err := a.Float64()
+	if err != nil {
+		return "", err
+	}
+	g, err := b.Float64()
+	if err != nil {
+		return "", err
+	}
+	sum := f + g
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", errors.New("increment would produce NaN or Infinity")
+	}
+	return json.Number(strconv.FormatFloat(sum, 'g', -1, 64)), nil
+}
@@ -0,0 +1,143 @@
+package tailor
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path  string
+		steps []pathStep
+		ok    bool
+	}{
+		{"$", nil, true},
+		{"", nil, true},
+		{".", nil, true},
+		{"$.a.b", []pathStep{{key: "a"}, {key: "b"}}, true},
+		{"a.b", []pathStep{{key: "a"}, {key: "b"}}, true},
+		{"$['a.b']", []pathStep{{key: "a.b"}}, true},
+		{`$["it's"]`, []pathStep{{key: "it's"}}, true},
+		{`$['it\'s']`, []pathStep{{key: "it's"}}, true},
+		{"$.arr[0][-1]", []pathStep{{key: "arr"}, {index: 0, isIndex: true}, {index: -1, isIndex: true}}, true},
+		{"[2]", []pathStep{{index: 2, isIndex: true}}, true},
+		{"$..a", nil, false},
+		{"$.a.", nil, false},
+		{"$[x]", nil, false},
+		{"$[1", nil, false},
+		{"$['a'", nil, false},
+		{"$['a'x", nil, false},
+		{"$*", nil, false},
+	}
+	for _, tt := range tests {
+		steps, err := parsePath(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsePath(%q) error = %v, want ok %v", tt.path, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(steps, tt.steps) {
+			t.Errorf("parsePath(%q) = %+v, want %+v", tt.path, steps, tt.steps)
+		}
+	}
+}
+
+func TestUpdatePath(t *testing.T) {
+	set := func(val interface{}) jsonUpdate {
+		return func(interface{}, bool) (interface{}, bool, error) {
+			return val, true, nil
+		}
+	}
+	del := func(interface{}, bool) (interface{}, bool, error) {
+		return nil, false, nil
+	}
+	tests := []struct {
+		name string
+		path string
+		fn   jsonUpdate
+		want string
+		err  bool
+	}{
+		{"set member", "$.a.b", set(json.Number("2")), `{"a":{"b":2},"arr":[1,2,3]}`, false},
+		{"add member", "$.a.c", set("x"), `{"a":{"b":1,"c":"x"},"arr":[1,2,3]}`, false},
+		{"set element", "$.arr[1]", set(true), `{"a":{"b":1},"arr":[1,true,3]}`, false},
+		{"set last element", "$.arr[-1]", set(nil), `{"a":{"b":1},"arr":[1,2,null]}`, false},
+		{"delete member", "$.a.b", del, `{"a":{},"arr":[1,2,3]}`, false},
+		{"delete element", "$.arr[0]", del, `{"a":{"b":1},"arr":[2,3]}`, false},
+		{"missing parent", "$.x.y", set("x"), "", true},
+		{"element out of range", "$.arr[3]", set("x"), "", true},
+		{"index of an object", "$.a[0]", set("x"), "", true},
+		{"member of an array", "$.arr.x", set("x"), "", true},
+		{"member of a scalar", "$.a.b.c", set("x"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const orig = `{"a":{"b":1},"arr":[1,2,3]}`
+			doc, err := NewJSONDoc([]byte(orig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keep, err := doc.update(tt.path, tt.fn)
+			if tt.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				// a failed update changes nothing
+				tt.want = orig
+			} else if err != nil || !keep {
+				t.Fatalf("update = %v, %v", keep, err)
+			}
+			if got := doc.String(); got != tt.want {
+				t.Errorf("document = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("failing fn", func(t *testing.T) {
+		doc, _ := NewJSONDoc([]byte(`{"a":[{"b":1}]}`))
+		_, err := doc.update("$.a[0].b", func(interface{}, bool) (interface{}, bool, error) {
+			return nil, false, errNotNum
+		})
+		if err == nil {
+			t.Fatal("no error")
+		}
+		if got := doc.String(); got != `{"a":[{"b":1}]}` {
+			t.Errorf("document = %s", got)
+		}
+	})
+
+	t.Run("remove root", func(t *testing.T) {
+		doc, _ := NewJSONDoc([]byte(`{"a":1}`))
+		if keep, err := doc.update("$", del); err != nil || keep {
+			t.Errorf("update = %v, %v, want false, nil", keep, err)
+		}
+	})
+}
+
+func TestAddNumbers(t *testing.T) {
+	tests := []struct {
+		a, b json.Number
+		want json.Number
+		err  bool
+	}{
+		{"1", "2", "3", false},
+		{"-5", "3", "-2", false},
+		{"9007199254740993", "0", "9007199254740993", false},
+		{"9223372036854775806", "1", "9223372036854775807", false},
+		// the integers overflow, so they are added as floats
+		{"9223372036854775807", "1", "9.223372036854776e+18", false},
+		{"-9223372036854775808", "-1", "-9.223372036854776e+18", false},
+		{"1.5", "1", "2.5", false},
+		{"1e308", "1e308", "", true},
+	}
+	for _, tt := range tests {
+		got, err := addNumbers(tt.a, tt.b)
+		if (err != nil) != tt.err {
+			t.Errorf("addNumbers(%s, %s) error = %v", tt.a, tt.b, err)
+			continue
+		}
+		if !tt.err && got != tt.want {
+			t.Errorf("addNumbers(%s, %s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
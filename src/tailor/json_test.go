@@ -0,0 +1,85 @@
+package tailor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJSONCommands(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	if err := c.JSONSet("doc", "$.a", `1`); err == nil {
+		t.Error("a new document was set below the root")
+	}
+	setDoc(t, c, "doc", `{"n":1,"arr":[1],"name":"x"}`)
+	if err := c.JSONSet("doc", "$.name", `"y"`); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.JSONNumIncrBy("doc", "$.n", "41"); err != nil || n != "42" {
+		t.Errorf("JSONNumIncrBy = %s, %v, want 42", n, err)
+	}
+	if _, err := c.JSONNumIncrBy("doc", "$.name", "1"); err == nil {
+		t.Error("incremented a string")
+	}
+	if n, err := c.JSONArrAppend("doc", "$.arr", `2`, `"three"`); err != nil || n != 3 {
+		t.Errorf("JSONArrAppend = %d, %v, want 3", n, err)
+	}
+	if _, err := c.JSONArrAppend("doc", "$.n", `2`); err == nil {
+		t.Error("appended to a number")
+	}
+	if data, found, err := c.JSONGet("doc", "$"); err != nil || !found || data != `{"arr":[1,2,"three"],"n":42,"name":"y"}` {
+		t.Errorf("JSONGet = %s, %v, %v", data, found, err)
+	}
+	if data, _, err := c.JSONGet("doc", "$.arr[-1]"); err != nil || data != `"three"` {
+		t.Errorf("JSONGet($.arr[-1]) = %s, %v", data, err)
+	}
+	if _, found, _ := c.JSONGet("missing", "$"); found {
+		t.Error("found a missing key")
+	}
+	c.Set("plain", "v")
+	if _, _, err := c.JSONGet("plain", "$"); err == nil {
+		t.Error("got a path of a string")
+	}
+
+	if n, err := c.JSONDel("doc", "$.arr[0]"); err != nil || n != 1 {
+		t.Errorf("JSONDel($.arr[0]) = %d, %v, want 1", n, err)
+	}
+	if n, err := c.JSONDel("doc", "$"); err != nil || n != 1 {
+		t.Errorf("JSONDel($) = %d, %v, want 1", n, err)
+	}
+	if _, found := c.Get("doc"); found {
+		t.Error("removing the root left the key")
+	}
+}
+
+// A delete which removes nothing does not count as a write.
+func TestJSONDelNothing(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	setDoc(t, c, "doc", `{"a":{"b":1}}`)
+	sub, err := c.Subscribe(EventWritten|EventDeleted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	dirty := c.Stats().Saves.Dirty
+	for _, path := range []string{"$.x", "$.a.x", "$.x.y", "$.a[0]"} {
+		if n, err := c.JSONDel("doc", path); err != nil || n != 0 {
+			t.Errorf("JSONDel(%s) = %d, %v, want 0", path, n, err)
+		}
+	}
+	if n, err := c.JSONDel("missing", "$"); err != nil || n != 0 {
+		t.Errorf("JSONDel of a missing key = %d, %v, want 0", n, err)
+	}
+	if d := c.Stats().Saves.Dirty; d != dirty {
+		t.Errorf("%d writes counted, want none", d-dirty)
+	}
+	select {
+	case ev := <-sub.C:
+		t.Errorf("notified of %+v", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if data, _, _ := c.JSONGet("doc", "$"); data != `{"a":{"b":1}}` {
+		t.Errorf("document = %s", data)
+	}
+}
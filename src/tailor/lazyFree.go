@@ -0,0 +1,109 @@
+package tailor
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// values waiting to be freed, the caller frees the value
+// by itself once the queue is full instead of blocking.
+const lazyFreeQueueSize = 1 << 16
+
+type LazyFreeStats struct {
+	// values waiting in the queue
+	Pending int `json:"pending"`
+	// values freed by the workers
+	Freed uint64 `json:"freed"`
+	// values freed by the caller as the queue was full
+	FreedInline uint64 `json:"freedInline"`
+}
+
+type lazyFreeJob struct {
+	key      string
+	val      interface{}
+	afterDel func(string, interface{})
+}
+
+// lazyFreer frees unlinked values in the background,
+// the key itself has been removed before the value is queued.
+type lazyFreer struct {
+	queue       chan lazyFreeJob
+	freed       uint64
+	freedInline uint64
+	wg          sync.WaitGroup
+	// stopMu guards the queue against being closed while a value
+	// is queued, the values unlinked after stop are freed inline.
+	stopMu  sync.RWMutex
+	stopped bool
+}
+
+func newLazyFreer(workers int) *lazyFreer {
+	if workers <= 0 {
+		workers = 1
+	}
+	lf := &lazyFreer{
+		queue: make(chan lazyFreeJob, lazyFreeQueueSize),
+	}
+	lf.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go lf.work()
+	}
+	return lf
+}
+
+func (lf *lazyFreer) free(key string, val interface{}, afterDel func(string, interface{})) {
+	j := lazyFreeJob{
+		key:      key,
+		val:      val,
+		afterDel: afterDel,
+	}
+	lf.stopMu.RLock()
+	queued := false
+	if !lf.stopped {
+		select {
+		case lf.queue <- j:
+			queued = true
+		default:
+		}
+	}
+	lf.stopMu.RUnlock()
+	if !queued {
+		release(j)
+		atomic.AddUint64(&lf.freedInline, 1)
+	}
+}
+
+func (lf *lazyFreer) work() {
+	defer lf.wg.Done()
+	for j := range lf.queue {
+		release(j)
+		atomic.AddUint64(&lf.freed, 1)
+	}
+}
+
+// stop waits for the queued values to be freed.
+func (lf *lazyFreer) stop() {
+	lf.stopMu.Lock()
+	if lf.stopped {
+		lf.stopMu.Unlock()
+		return
+	}
+	lf.stopped = true
+	close(lf.queue)
+	lf.stopMu.Unlock()
+	lf.wg.Wait()
+}
+
+func (lf *lazyFreer) stats() LazyFreeStats {
+	return LazyFreeStats{
+		Pending:     len(lf.queue),
+		Freed:       atomic.LoadUint64(&lf.freed),
+		FreedInline: atomic.LoadUint64(&lf.freedInline),
+	}
+}
+
+func release(j lazyFreeJob) {
+	if j.afterDel != nil {
+		j.afterDel(j.key, j.val)
+	}
+}
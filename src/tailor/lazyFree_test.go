@@ -0,0 +1,97 @@
+package tailor
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLazyFreerStop(t *testing.T) {
+	lf := newLazyFreer(4)
+	var freed int64
+	count := func(string, interface{}) {
+		atomic.AddInt64(&freed, 1)
+	}
+	for i := 0; i < 1000; i++ {
+		lf.free("k", i, count)
+	}
+	lf.stop()
+	if n := atomic.LoadInt64(&freed); n != 1000 {
+		t.Fatalf("%d values freed by stop, want 1000", n)
+	}
+
+	// freed inline once stopped, and stop may be called again
+	lf.free("k", 0, count)
+	lf.stop()
+	if n := atomic.LoadInt64(&freed); n != 1001 {
+		t.Fatalf("%d values freed, want 1001", n)
+	}
+	if stats := lf.stats(); stats.Freed+stats.FreedInline != 1001 {
+		t.Fatalf("stats %+v", stats)
+	}
+}
+
+// Unlink removes the key at once and hands the value to the workers,
+// which run the delete handler.
+func TestUnlink(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	release := make(chan struct{})
+	freed := make(chan interface{}, 1)
+	c.AddDelHandler(func(key string, val interface{}) {
+		<-release
+		freed <- val
+	})
+	c.Set("k", "v")
+	if err := c.UnlinkSync("k"); err != nil {
+		t.Fatal(err)
+	}
+	// the handler is blocked, yet the key is gone
+	if _, found := c.Get("k"); found {
+		t.Fatal("k is still there")
+	}
+	if stats := c.Stats().LazyFree; stats.Freed != 0 {
+		t.Fatalf("freed before the handler returned: %+v", stats)
+	}
+	close(release)
+	if val := <-freed; val != "v" {
+		t.Fatalf("the handler got %v", val)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().LazyFree.Freed != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v", c.Stats().LazyFree)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// An expired key is reported expired by Unlink, as by Del.
+func TestUnlinkExpired(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	sub, err := c.Subscribe(EventDeleted|EventExpired, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	c.Setex("expired", "v", time.Nanosecond)
+	c.Set("live", "v")
+	time.Sleep(time.Millisecond)
+	c.Unlink("expired")
+	c.Unlink("live")
+	c.WaitWrites()
+	for _, want := range []struct {
+		tp  EventType
+		key string
+	}{{EventExpired, "expired"}, {EventDeleted, "live"}} {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != want.tp || ev.Key != want.key {
+				t.Errorf("got %v %s, want %v %s", ev.Type, ev.Key, want.tp, want.key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %s", want.key)
+		}
+	}
+}
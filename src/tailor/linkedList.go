@@ -1,10 +1,17 @@
 package tailor
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"sync"
 )
 
+func init() {
+	// lists are stored as values of the cache
+	gob.Register(&LinkedList{})
+}
+
 type node struct {
 	data interface{}
 	next *node
@@ -154,6 +161,35 @@ func (list *LinkedList) Pop() (interface{}, error) {
 	return list.RemoveLast()
 }
 
+// Values returns the data from head to tail.
+func (list *LinkedList) Values() []interface{} {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	res := make([]interface{}, 0, list.size)
+	for cur := list.head; cur != nil; cur = cur.next {
+		res = append(res, cur.data)
+	}
+	return res
+}
+
+func (list *LinkedList) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(list.Values())
+	return buf.Bytes(), err
+}
+
+func (list *LinkedList) GobDecode(data []byte) error {
+	var values []interface{}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		list.AddLast(v)
+	}
+	return nil
+}
+
 func (list *LinkedList) node(n int) *node {
 	var res *node
 	if n < list.size>>1 {
@@ -0,0 +1,171 @@
+package tailor
+
+import "fmt"
+
+func notListErr(key string) error {
+	return fmt.Errorf("value of '%s' is not a list", key)
+}
+
+// listPush pushes vals into the list of key,
+// found reports whether key exists in c.
+func (c *cache) listPush(key string, vals []interface{}, left bool) (int, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, found := c.findForWrite(key)
+	if !found {
+		return 0, false, nil
+	}
+	list, ok := item.Data.(*LinkedList)
+	if !ok {
+		return 0, true, notListErr(key)
+	}
+	for _, val := range vals {
+		if left {
+			list.AddFirst(val)
+		} else {
+			list.AddLast(val)
+		}
+	}
+	c.notify.notify(EventWritten, c.db, key, "")
+	return list.Size(), true, nil
+}
+
+// listPop pops the head or tail of the list of key,
+// the key is deleted once its list is empty.
+func (c *cache) listPop(key string, left bool) (interface{}, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, found := c.findForWrite(key)
+	if !found {
+		return nil, false, nil
+	}
+	list, ok := item.Data.(*LinkedList)
+	if !ok {
+		return nil, false, notListErr(key)
+	}
+	var val interface{}
+	var err error
+	if left {
+		val, err = list.RemoveFirst()
+	} else {
+		val, err = list.RemoveLast()
+	}
+	if err != nil {
+		// an empty list is never kept
+		c.removeItem(key)
+		return nil, false, nil
+	}
+	c.notify.notify(EventWritten, c.db, key, "")
+	if list.IsEmpty() {
+		c.removeItem(key)
+		c.notify.notify(EventDeleted, c.db, key, "")
+	}
+	return val, true, nil
+}
+
+func (c *cache) listLen(key string) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	item, found := c.find(key)
+	if !found {
+		return 0, nil
+	}
+	list, ok := item.Data.(*LinkedList)
+	if !ok {
+		return 0, notListErr(key)
+	}
+	return list.Size(), nil
+}
+
+// push creates the list of key if it does not exist,
+// and hands the pushed values to the blocked poppers.
+func (c *Cache) push(key string, vals []interface{}, left bool) (int, error) {
+	n, found, err := c.neCache.listPush(key, vals, left)
+	if !found && c.exCache != c.neCache {
+		n, found, err = c.exCache.listPush(key, vals, left)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		list := newList(vals, left)
+		c.neCache.set(key, list, DefaultExpiration, nil)
+		if c.exCache != c.neCache {
+			c.exCache.discard(key)
+		}
+		n = list.Size()
+	}
+	c.serveWaiters(key)
+	return n, nil
+}
+
+func newList(vals []interface{}, left bool) *LinkedList {
+	list := &LinkedList{}
+	for _, val := range vals {
+		if left {
+			list.AddFirst(val)
+		} else {
+			list.AddLast(val)
+		}
+	}
+	return list
+}
+
+// pushed is written for a push. The push is logged as an op, unless
+// blocked pops were waiting for the list, which then was empty: they
+// took some of the values, so the list is logged, and it is no longer
+// than vals.
+func (c *Cache) pushed(j *job, vals []interface{}, left, blocked bool) {
+	if blocked {
+		c.written(j, j.key)
+		return
+	}
+	item, _ := c.item(j.key)
+	c.writtenAs(j, aofRecord{
+		Op:   aofPush,
+		Key:  j.key,
+		Item: Item{Expiration: item.Expiration},
+		Vals: vals,
+		Left: left,
+	})
+}
+
+// replayPush pushes vals as push did when it was logged, into a list
+// which expires at exp (-1 never).
+func (db *database) replayPush(key string, vals []interface{}, left bool, exp int64) error {
+	item := Item{Expiration: exp}
+	if item.Expired() {
+		db.discard(key)
+		return nil
+	}
+	_, found, err := db.neCache.listPush(key, vals, left)
+	if !found && db.exCache != db.neCache {
+		_, found, err = db.exCache.listPush(key, vals, left)
+	}
+	if err != nil || found {
+		return err
+	}
+	item.Data = newList(vals, left)
+	if exp < 0 {
+		db.neCache.put(key, item)
+	} else {
+		db.exCache.put(key, item)
+	}
+	return nil
+}
+
+func (db *database) pop(key string, left bool) (interface{}, bool, error) {
+	val, found, err := db.neCache.listPop(key, left)
+	if !found && err == nil && db.exCache != db.neCache {
+		val, found, err = db.exCache.listPop(key, left)
+	}
+	return val, found, err
+}
+
+func (c *Cache) llen(key string) (int, error) {
+	n, err := c.neCache.listLen(key)
+	if n == 0 && err == nil && c.exCache != c.neCache {
+		n, err = c.exCache.listLen(key)
+	}
+	return n, err
+}
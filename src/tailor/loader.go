@@ -0,0 +1,225 @@
+package tailor
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the negative cache sweeps its expired errors
+// once it holds more entries than this.
+const negativeSweepSize = 1024
+
+type LoadStats struct {
+	// calls of the loaders
+	Loads uint64 `json:"loads"`
+	// misses which waited for the load of another caller
+	Coalesced uint64 `json:"coalesced"`
+	// misses answered by a cached loader error
+	NegativeHits uint64 `json:"negativeHits"`
+	// background refreshes of stale values, and those which failed
+	Refreshes    uint64 `json:"refreshes"`
+	RefreshFails uint64 `json:"refreshFails"`
+}
+
+type flight struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+	// the group the flight is in, SwapDB moves it with the keys
+	mu    sync.Mutex
+	group *flightGroup
+}
+
+func (f *flight) owner() *flightGroup {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.group
+}
+
+// database returns the database the loaded value goes into,
+// the one the key is in even if SwapDB moved it meanwhile.
+func (f *flight) database() *database {
+	return f.owner().db
+}
+
+// flightGroup runs one load per key at a time,
+// the callers arriving meanwhile share its result.
+type flightGroup struct {
+	db      *database
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup(db *database) *flightGroup {
+	return &flightGroup{
+		db:      db,
+		flights: make(map[string]*flight),
+	}
+}
+
+// do reports whether the result was shared with another caller.
+func (g *flightGroup) do(key string, fn func(f *flight) (interface{}, error)) (interface{}, error, bool) {
+	g.mu.Lock()
+	if f, found := g.flights[key]; found {
+		g.mu.Unlock()
+		f.wg.Wait()
+		return f.val, f.err, true
+	}
+	f := &flight{group: g}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	g.run(key, f, fn)
+	return f.val, f.err, false
+}
+
+// doAsync runs fn in the background unless a call of key is in flight,
+// it reports whether fn was started.
+func (g *flightGroup) doAsync(key string, fn func(f *flight) (interface{}, error)) bool {
+	g.mu.Lock()
+	if _, found := g.flights[key]; found {
+		g.mu.Unlock()
+		return false
+	}
+	f := &flight{group: g}
+	f.wg.Add(1)
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	go g.run(key, f, fn)
+	return true
+}
+
+func (g *flightGroup) run(key string, f *flight, fn func(f *flight) (interface{}, error)) {
+	defer func() {
+		// the flight is removed from the group it is in now
+		for {
+			owner := f.owner()
+			owner.mu.Lock()
+			if f.owner() == owner {
+				delete(owner.flights, key)
+				owner.mu.Unlock()
+				break
+			}
+			owner.mu.Unlock()
+		}
+		f.wg.Done()
+	}()
+	f.val, f.err = fn(f)
+}
+
+// swap exchanges the flights of two groups, so that the loads in
+// flight set their values into the database the keys moved to.
+// The caller runs on the serial write path, which keeps swaps apart.
+func (g *flightGroup) swap(other *flightGroup) {
+	g.mu.Lock()
+	other.mu.Lock()
+	g.flights, other.flights = other.flights, g.flights
+	for _, group := range []*flightGroup{g, other} {
+		for _, f := range group.flights {
+			f.mu.Lock()
+			f.group = group
+			f.mu.Unlock()
+		}
+	}
+	other.mu.Unlock()
+	g.mu.Unlock()
+}
+
+type negativeEntry struct {
+	err        error
+	expiration int64
+}
+
+// negativeCache keeps the errors of the loaders for a while,
+// so that a failing backend is not hit by every miss.
+type negativeCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]negativeEntry
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{
+		entries: make(map[string]negativeEntry),
+	}
+}
+
+func (nc *negativeCache) setTTL(t time.Duration) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.ttl = t
+	if t <= 0 {
+		nc.entries = make(map[string]negativeEntry)
+	}
+}
+
+func (nc *negativeCache) get(key string) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	entry, found := nc.entries[key]
+	if !found {
+		return nil
+	}
+	if time.Now().UnixNano() > entry.expiration {
+		delete(nc.entries, key)
+		return nil
+	}
+	return entry.err
+}
+
+func (nc *negativeCache) put(key string, err error) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.ttl <= 0 {
+		return
+	}
+	now := time.Now().UnixNano()
+	if len(nc.entries) >= negativeSweepSize {
+		for k, entry := range nc.entries {
+			if now > entry.expiration {
+				delete(nc.entries, k)
+			}
+		}
+	}
+	nc.entries[key] = negativeEntry{
+		err:        err,
+		expiration: now + int64(nc.ttl),
+	}
+}
+
+func (nc *negativeCache) del(key string) {
+	nc.mu.Lock()
+	delete(nc.entries, key)
+	nc.mu.Unlock()
+}
+
+// swap exchanges the cached errors of two databases,
+// each keeps its own ttl.
+func (nc *negativeCache) swap(other *negativeCache) {
+	nc.mu.Lock()
+	other.mu.Lock()
+	nc.entries, other.entries = other.entries, nc.entries
+	other.mu.Unlock()
+	nc.mu.Unlock()
+}
+
+type loadCounter struct {
+	loads        uint64
+	coalesced    uint64
+	negativeHits uint64
+	refreshes    uint64
+	refreshFails uint64
+}
+
+func (lc *loadCounter) stats() LoadStats {
+	return LoadStats{
+		Loads:        atomic.LoadUint64(&lc.loads),
+		Coalesced:    atomic.LoadUint64(&lc.coalesced),
+		NegativeHits: atomic.LoadUint64(&lc.negativeHits),
+		Refreshes:    atomic.LoadUint64(&lc.refreshes),
+		RefreshFails: atomic.LoadUint64(&lc.refreshFails),
+	}
+}
@@ -0,0 +1,142 @@
+package tailor
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Concurrent misses of a key share one call of the loader.
+func TestGetOrLoadShared(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	var calls int32
+	release := make(chan struct{})
+	loader := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "v", nil
+	}
+
+	const callers = 8
+	var wg, started sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			if v, err := c.GetOrLoad("k", 0, loader); err != nil || v != "v" {
+				t.Errorf("GetOrLoad = %v, %v", v, err)
+			}
+		}()
+	}
+	// the first caller is held in the loader while the others join it
+	started.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&calls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the loader was not called")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+	if stats := c.Stats().Loads; stats.Loads != 1 || stats.Coalesced != callers-1 {
+		t.Errorf("stats = %+v", stats)
+	}
+	// the loaded value is set, the next miss is a hit
+	if v, err := c.GetOrLoad("k", 0, loader); err != nil || v != "v" || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("GetOrLoad = %v, %v after %d calls", v, err, calls)
+	}
+	if ttl, found := c.Ttl("k"); found {
+		t.Errorf("ttl = %v, want none", ttl)
+	}
+	if _, err := c.GetOrLoad("ttl", time.Hour, loader); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, found := c.Ttl("ttl"); !found || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("ttl = %v, %v, want up to an hour", ttl, found)
+	}
+}
+
+func TestGetOrLoadErrors(t *testing.T) {
+	errDown := errors.New("down")
+	calls := 0
+	fail := true
+	loader := func() (interface{}, error) {
+		calls++
+		if fail {
+			return nil, errDown
+		}
+		return "v", nil
+	}
+
+	t.Run("not cached", func(t *testing.T) {
+		c := newTestCache(time.Minute, 1)
+		defer c.Close()
+		calls, fail = 0, true
+		for i := 0; i < 3; i++ {
+			if _, err := c.GetOrLoad("k", 0, loader); err != errDown {
+				t.Fatalf("GetOrLoad error = %v", err)
+			}
+		}
+		if calls != 3 {
+			t.Errorf("loader called %d times, want 3", calls)
+		}
+		if _, found := c.Get("k"); found {
+			t.Error("the error set the key")
+		}
+	})
+
+	t.Run("cached", func(t *testing.T) {
+		c := newTestCache(time.Minute, 1)
+		defer c.Close()
+		c.SetNegativeTTL(50 * time.Millisecond)
+		calls, fail = 0, true
+		for i := 0; i < 3; i++ {
+			if _, err := c.GetOrLoad("k", 0, loader); err != errDown {
+				t.Fatalf("GetOrLoad error = %v", err)
+			}
+		}
+		if calls != 1 {
+			t.Errorf("loader called %d times, want 1", calls)
+		}
+		if n := c.Stats().Loads.NegativeHits; n != 2 {
+			t.Errorf("%d negative hits, want 2", n)
+		}
+		// another key is loaded
+		if _, err := c.GetOrLoad("other", 0, loader); err != errDown || calls != 2 {
+			t.Errorf("GetOrLoad(other) = %v after %d calls", err, calls)
+		}
+
+		// the error expires, then the loader is called again
+		fail = false
+		time.Sleep(60 * time.Millisecond)
+		if v, err := c.GetOrLoad("k", 0, loader); err != nil || v != "v" || calls != 3 {
+			t.Errorf("GetOrLoad = %v, %v after %d calls", v, err, calls)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		c := newTestCache(time.Minute, 1)
+		defer c.Close()
+		c.SetNegativeTTL(time.Minute)
+		calls, fail = 0, true
+		if _, err := c.GetOrLoad("k", 0, loader); err != errDown {
+			t.Fatalf("GetOrLoad error = %v", err)
+		}
+		// turning negative caching off drops the cached errors
+		c.SetNegativeTTL(0)
+		fail = false
+		if v, err := c.GetOrLoad("k", 0, loader); err != nil || v != "v" || calls != 2 {
+			t.Errorf("GetOrLoad = %v, %v after %d calls", v, err, calls)
+		}
+	})
+}
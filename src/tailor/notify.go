@@ -0,0 +1,192 @@
+package tailor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is a set of keyspace event classes,
+// several classes can be combined with '|'.
+type EventType uint16
+
+const (
+	// a key was set, whatever the command is
+	EventWritten EventType = 1 << iota
+	// a key was removed by del or unlink
+	EventDeleted
+	// a key was removed because its expiration passed
+	EventExpired
+	// a key was removed to reclaim memory. It is reserved for eviction
+	// policies, none of which exists yet, so it is accepted but never sent.
+	EventEvicted
+	// a key was renamed, the event carries the new name
+	EventRenamed
+	// the value of a key was incremented
+	EventIncr
+
+	EventAll = EventWritten | EventDeleted | EventExpired |
+		EventEvicted | EventRenamed | EventIncr
+)
+
+// the buffer of a subscription, events are dropped
+// rather than blocking the writers once it is full.
+const subscriptionBuffer = 1024
+
+var eventNames = []struct {
+	tp   EventType
+	name string
+}{
+	{EventWritten, "written"},
+	{EventDeleted, "deleted"},
+	{EventExpired, "expired"},
+	{EventEvicted, "evicted"},
+	{EventRenamed, "renamed"},
+	{EventIncr, "incr"},
+}
+
+func (tp EventType) String() string {
+	var names []string
+	for _, e := range eventNames {
+		if tp&e.tp != 0 {
+			names = append(names, e.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseEventType parses a comma separated list of event classes,
+// such as "written,deleted". "all" or an empty string means EventAll.
+func ParseEventType(s string) (EventType, error) {
+	if s == "" || s == "all" {
+		return EventAll, nil
+	}
+	var tp EventType
+loop:
+	for _, name := range strings.Split(s, ",") {
+		for _, e := range eventNames {
+			if e.name == name {
+				tp |= e.tp
+				continue loop
+			}
+		}
+		return 0, fmt.Errorf("unknown event '%s'", name)
+	}
+	return tp, nil
+}
+
+type KeyEvent struct {
+	Type EventType
+	// the database of the key
+	DB  int
+	Key string
+	// the new name of the key, for EventRenamed only
+	NewKey string
+	Time   time.Time
+}
+
+type Subscription struct {
+	// C delivers the events, it is closed by Close
+	C       <-chan KeyEvent
+	c       chan KeyEvent
+	types   EventType
+	db      int
+	pattern *Pattern
+	dropped uint64
+	n       *notifier
+}
+
+// Dropped returns how many events were dropped
+// because the subscriber did not keep up.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+func (sub *Subscription) Close() {
+	sub.n.unsubscribe(sub)
+}
+
+func (sub *Subscription) match(tp EventType, db int, key string) bool {
+	return sub.types&tp != 0 && sub.db == db &&
+		(sub.pattern == nil || sub.pattern.Match(key))
+}
+
+type notifier struct {
+	mu   sync.RWMutex
+	subs map[*Subscription]struct{}
+	// union of the subscribed types, so that
+	// writers skip the lock while nobody listens.
+	types uint32
+}
+
+func newNotifier() *notifier {
+	return &notifier{
+		subs: make(map[*Subscription]struct{}),
+	}
+}
+
+// subscribe matches every key if p is nil.
+func (n *notifier) subscribe(types EventType, db int, p *Pattern) *Subscription {
+	ch := make(chan KeyEvent, subscriptionBuffer)
+	sub := &Subscription{
+		C:       ch,
+		c:       ch,
+		types:   types,
+		db:      db,
+		pattern: p,
+		n:       n,
+	}
+	n.mu.Lock()
+	n.subs[sub] = struct{}{}
+	n.resetTypes()
+	n.mu.Unlock()
+	return sub
+}
+
+func (n *notifier) unsubscribe(sub *Subscription) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, found := n.subs[sub]; !found {
+		return
+	}
+	delete(n.subs, sub)
+	close(sub.c)
+	n.resetTypes()
+}
+
+func (n *notifier) resetTypes() {
+	var types EventType
+	for sub := range n.subs {
+		types |= sub.types
+	}
+	atomic.StoreUint32(&n.types, uint32(types))
+}
+
+// notify never blocks, it is called by the writers
+// and may be called while holding the lock of a cache.
+func (n *notifier) notify(tp EventType, db int, key, newKey string) {
+	if EventType(atomic.LoadUint32(&n.types))&tp == 0 {
+		return
+	}
+	ev := KeyEvent{
+		Type:   tp,
+		DB:     db,
+		Key:    key,
+		NewKey: newKey,
+		Time:   time.Now(),
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for sub := range n.subs {
+		if !sub.match(tp, db, key) && (newKey == "" || !sub.match(tp, db, newKey)) {
+			continue
+		}
+		select {
+		case sub.c <- ev:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
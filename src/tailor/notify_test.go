@@ -0,0 +1,102 @@
+package tailor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseEventType(t *testing.T) {
+	for _, tc := range []struct {
+		s     string
+		want  EventType
+		fails bool
+	}{
+		{"", EventAll, false},
+		{"all", EventAll, false},
+		{"written", EventWritten, false},
+		{"written,deleted", EventWritten | EventDeleted, false},
+		{"expired,evicted", EventExpired | EventEvicted, false},
+		{"renamed,incr", EventRenamed | EventIncr, false},
+		{"written,deleted,expired,evicted,renamed,incr", EventAll, false},
+		{"bogus", 0, true},
+		{"written,", 0, true},
+		{"Written", 0, true},
+	} {
+		got, err := ParseEventType(tc.s)
+		if (err != nil) != tc.fails || got != tc.want {
+			t.Errorf("ParseEventType(%q) = %v, %v", tc.s, got, err)
+			continue
+		}
+		if err != nil || tc.s == "" || tc.s == "all" {
+			continue
+		}
+		// the names parse back into the same classes
+		if again, _ := ParseEventType(got.String()); again != got {
+			t.Errorf("%q parsed back into %v", got.String(), again)
+		}
+	}
+}
+
+func TestKeyEvents(t *testing.T) {
+	c := newTestCache(time.Hour, 2)
+	defer c.Close()
+	classes := []EventType{EventWritten, EventDeleted, EventExpired, EventEvicted, EventRenamed, EventIncr}
+	subs := make(map[EventType]*Subscription)
+	for _, tp := range classes {
+		sub, err := c.Subscribe(tp, "^k:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		subs[tp] = sub
+	}
+
+	c.Set("k:written", "v")
+	c.Set("other", "v")
+	db1, _ := c.Select(1)
+	db1.Set("k:db1", "v")
+	c.Set("k:deleted", "v")
+	c.Del("k:deleted")
+	c.Setex("k:expired", "v", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	c.Del("k:expired")
+	c.Set("k:old", "v")
+	_ = c.Rename("k:old", "k:new")
+	c.Set("k:n", "1")
+	_ = c.Incr("k:n")
+	c.WaitWrites()
+
+	for _, tc := range []struct {
+		tp   EventType
+		want []string
+	}{
+		{EventWritten, []string{"k:written", "k:deleted", "k:expired", "k:old", "k:n"}},
+		{EventDeleted, []string{"k:deleted"}},
+		{EventExpired, []string{"k:expired"}},
+		{EventEvicted, nil},
+		{EventRenamed, []string{"k:old>k:new"}},
+		{EventIncr, []string{"k:n"}},
+	} {
+		var got []string
+	collect:
+		for {
+			select {
+			case ev := <-subs[tc.tp].C:
+				if ev.Type != tc.tp || ev.DB != 0 {
+					t.Errorf("%v subscription got %+v", tc.tp, ev)
+				}
+				key := ev.Key
+				if ev.NewKey != "" {
+					key += ">" + ev.NewKey
+				}
+				got = append(got, key)
+			case <-time.After(50 * time.Millisecond):
+				break collect
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v events of %v, want %v", tc.tp, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tailor
+
+import "errors"
+
+// the keys of a range are read this many at a time,
+// the locks are released between the batches.
+const rangeBatch = 128
+
+var ErrNoOrderedIndex = errors.New("the ordered index is not enabled")
+
+// EnableOrderedIndex keeps the keys of every database in a B-tree as
+// well, which RangeKeys and PrefixKeys need. It costs about O(log n)
+// per write of a new key and per removal, so it is off by default.
+func (c *Cache) EnableOrderedIndex() {
+	for _, db := range c.dbs {
+		for _, ch := range db.caches() {
+			ch.mu.Lock()
+			if ch.order == nil {
+				ch.order = newBtree(ch.items)
+			}
+			ch.mu.Unlock()
+		}
+	}
+}
+
+// OrderedIndex reports whether the ordered index is enabled.
+func (c *Cache) OrderedIndex() bool {
+	c.neCache.mu.RLock()
+	defer c.neCache.mu.RUnlock()
+	return c.neCache.order != nil
+}
+
+// RangeKeys calls fn with the keys from start up to but not including
+// end in lexicographic order, an empty end means no upper bound. It stops
+// after limit keys if limit is greater than zero, or once fn returns false.
+// fn is called without holding any lock, so the keys are read in batches,
+// and a key written meanwhile is returned if it is not behind the range yet.
+func (c *Cache) RangeKeys(start, end string, limit int, fn func(key string) bool) error {
+	if !c.OrderedIndex() {
+		return ErrNoOrderedIndex
+	}
+	from := start
+	for n := 0; limit <= 0 || n < limit; {
+		keys := c.rangeBatch(from, end)
+		for _, key := range keys {
+			if limit > 0 && n >= limit {
+				return nil
+			}
+			n++
+			if !fn(key) {
+				return nil
+			}
+		}
+		if len(keys) < rangeBatch {
+			return nil
+		}
+		// the least key greater than the last one
+		from = keys[len(keys)-1] + "\x00"
+	}
+	return nil
+}
+
+// PrefixKeys calls fn with the keys which start with prefix in
+// lexicographic order, it stops like RangeKeys does.
+func (c *Cache) PrefixKeys(prefix string, limit int, fn func(key string) bool) error {
+	return c.RangeKeys(prefix, prefixEnd(prefix), limit, fn)
+}
+
+// rangeBatch returns up to rangeBatch keys from start on, it reads both
+// caches under their locks, so a key which moves between them is never missed.
+func (c *Cache) rangeBatch(start, end string) []string {
+	caches := c.caches()
+	for _, ch := range caches {
+		ch.mu.RLock()
+	}
+	var lists [][]string
+	for _, ch := range caches {
+		var keys []string
+		ch.order.ascend(start, func(key string) bool {
+			if end != "" && key >= end {
+				return false
+			}
+			if !ch.items[key].Expired() {
+				keys = append(keys, key)
+			}
+			return len(keys) < rangeBatch
+		})
+		lists = append(lists, keys)
+	}
+	for i := len(caches) - 1; i >= 0; i-- {
+		caches[i].mu.RUnlock()
+	}
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	return mergeKeys(lists[0], lists[1], rangeBatch)
+}
+
+// mergeKeys merges two sorted lists into at most n keys.
+func mergeKeys(a, b []string, n int) []string {
+	res := make([]string, 0, len(a)+len(b))
+	for len(res) < n && (len(a) > 0 || len(b) > 0) {
+		switch {
+		case len(b) == 0 || (len(a) > 0 && a[0] < b[0]):
+			res, a = append(res, a[0]), a[1:]
+		case len(a) == 0 || b[0] < a[0]:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	return res
+}
+
+// prefixEnd returns the least key greater than every key
+// with the prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
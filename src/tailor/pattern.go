@@ -0,0 +1,174 @@
+package tailor
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type PatternMode byte
+
+const (
+	// Glob matches like Redis does: '*' matches any run of bytes, '?' any
+	// single byte, "[abc]", "[a-z]" and "[^abc]" a byte of a class, and
+	// '\' escapes the byte after it. It matches the whole string.
+	Glob PatternMode = iota
+	// Regexp matches by Go regular expressions, which match any part
+	// of the string unless they are anchored.
+	Regexp
+)
+
+func (m PatternMode) String() string {
+	if m == Regexp {
+		return "regexp"
+	}
+	return "glob"
+}
+
+// Pattern matches keys and channels, it is shared
+// by keys, SCAN, the subscriptions and DelMatching.
+type Pattern struct {
+	expr string
+	mode PatternMode
+	reg  *regexp.Regexp
+}
+
+// CompilePattern returns an error only for an invalid regular expression,
+// every glob is valid.
+func CompilePattern(expr string, mode PatternMode) (*Pattern, error) {
+	p := &Pattern{
+		expr: expr,
+		mode: mode,
+	}
+	switch mode {
+	case Glob:
+	case Regexp:
+		reg, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		p.reg = reg
+	default:
+		return nil, fmt.Errorf("unknown pattern mode %d", mode)
+	}
+	return p, nil
+}
+
+func (p *Pattern) String() string {
+	return p.expr
+}
+
+func (p *Pattern) Mode() PatternMode {
+	return p.mode
+}
+
+func (p *Pattern) Match(s string) bool {
+	if p.mode == Regexp {
+		return p.reg.MatchString(s)
+	}
+	return globMatch(p.expr, s)
+}
+
+// globMatch backtracks to the last '*' only, so it takes
+// no more than len(pattern) * len(s) steps.
+func globMatch(pattern, s string) bool {
+	px, sx := 0, 0
+	starPx, starSx := -1, 0
+	for sx < len(s) {
+		if px < len(pattern) {
+			switch pattern[px] {
+			case '*':
+				starPx, starSx = px, sx
+				px++
+				continue
+			case '?':
+				px++
+				sx++
+				continue
+			case '[':
+				if n, ok := matchClass(pattern[px:], s[sx]); n > 0 {
+					if ok {
+						px += n
+						sx++
+						continue
+					}
+					break
+				}
+				// an unterminated class is a literal '['
+				if s[sx] == '[' {
+					px++
+					sx++
+					continue
+				}
+			case '\\':
+				if px+1 < len(pattern) {
+					if pattern[px+1] == s[sx] {
+						px += 2
+						sx++
+						continue
+					}
+					break
+				}
+				if s[sx] == '\\' {
+					px++
+					sx++
+					continue
+				}
+			default:
+				if pattern[px] == s[sx] {
+					px++
+					sx++
+					continue
+				}
+			}
+		}
+		if starPx < 0 {
+			return false
+		}
+		// let the last '*' take one more byte
+		starSx++
+		px, sx = starPx+1, starSx
+	}
+	for px < len(pattern) && pattern[px] == '*' {
+		px++
+	}
+	return px == len(pattern)
+}
+
+// matchClass matches c against the class at the start of pattern,
+// it returns the length of the class, or 0 if it is unterminated.
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!') {
+		negate = true
+		i++
+	}
+	matched := false
+	for first := true; i < len(pattern); first = false {
+		if pattern[i] == ']' && !first {
+			return i + 1, matched != negate
+		}
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		i++
+		hi := lo
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			hi = pattern[i+1]
+			if hi == '\\' && i+2 < len(pattern) {
+				i++
+				hi = pattern[i+1]
+			}
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package tailor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		// stars
+		{"*", "", true},
+		{"*", "abc", true},
+		{"**", "", true},
+		{"a*", "abc", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abcd", false},
+		{"*a*b", "xxaxb", true},
+		{"user:*:name", "user:1:name", true},
+		{"user:*:name", "user:1:mail", false},
+		// single bytes
+		{"?", "", false},
+		{"?", "a", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"A", "a", false},
+		// classes
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[a-c]x", "bx", true},
+		{"[a-c]x", "dx", false},
+		{"[c-a]", "b", true},
+		{"[^abc]", "d", true},
+		{"[^abc]", "a", false},
+		{"[!a]", "b", true},
+		{"[!a]", "a", false},
+		{"[]]", "]", true},
+		{"[]a]", "a", true},
+		{"[a-]", "-", true},
+		{"[a-]", "b", false},
+		{"[0-9][0-9]", "42", true},
+		{"[0-9][0-9]", "4x", false},
+		// an unterminated class is literal
+		{"[abc", "[abc", true},
+		{"[abc", "a", false},
+		// escapes
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`\?`, "?", true},
+		{`\[a]`, "[a]", true},
+		{`\[a]`, "a", false},
+		{`a\`, `a\`, true},
+		{`[\]]`, "]", true},
+		{`[a\-z]`, "-", true},
+		{`[a\-z]`, "z", true},
+		{`[a\-z]`, "b", false},
+		{`[\^a]`, "^", true},
+		// no exponential backtracking
+		{strings.Repeat("a*", 30) + "b", strings.Repeat("a", 200), false},
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	for _, tc := range []struct {
+		expr  string
+		mode  PatternMode
+		s     string
+		want  bool
+		fails bool
+	}{
+		{"user:*", Glob, "user:1", true, false},
+		{"ser", Glob, "user", false, false},
+		{"ser", Regexp, "user", true, false},
+		{"^user:[0-9]+$", Regexp, "user:12", true, false},
+		{"^user:[0-9]+$", Regexp, "user:1a", false, false},
+		{"(", Regexp, "", false, true},
+		{"[", Glob, "[", true, false},
+		{"a", PatternMode(7), "a", false, true},
+	} {
+		p, err := CompilePattern(tc.expr, tc.mode)
+		if (err != nil) != tc.fails {
+			t.Errorf("CompilePattern(%q, %v): error %v", tc.expr, tc.mode, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := p.Match(tc.s); got != tc.want {
+			t.Errorf("%v %q matches %q = %v, want %v", tc.mode, tc.expr, tc.s, got, tc.want)
+		}
+	}
+}
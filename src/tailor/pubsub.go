@@ -0,0 +1,280 @@
+package tailor
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Message struct {
+	Channel string
+	// the pattern which matched the channel, for pattern subscriptions only
+	Pattern string
+	Payload interface{}
+	Time    time.Time
+}
+
+// ChannelSubscription receives the messages published to its channels
+// and patterns, it can subscribe and unsubscribe at any time.
+type ChannelSubscription struct {
+	// C delivers the messages, it is closed by Close
+	C        <-chan Message
+	c        chan Message
+	mu       sync.Mutex
+	channels map[string]struct{}
+	// the mode of each pattern, a pattern is subscribed in one mode at a time
+	patterns map[string]PatternMode
+	closed   bool
+	dropped  uint64
+	b        *broker
+}
+
+type patternKey struct {
+	expr string
+	mode PatternMode
+}
+
+type patternSubs struct {
+	pattern *Pattern
+	subs    map[*ChannelSubscription]struct{}
+}
+
+type broker struct {
+	mu       sync.RWMutex
+	channels map[string]map[*ChannelSubscription]struct{}
+	patterns map[patternKey]*patternSubs
+}
+
+func newBroker() *broker {
+	return &broker{
+		channels: make(map[string]map[*ChannelSubscription]struct{}),
+		patterns: make(map[patternKey]*patternSubs),
+	}
+}
+
+func (b *broker) newSubscription() *ChannelSubscription {
+	ch := make(chan Message, subscriptionBuffer)
+	return &ChannelSubscription{
+		C:        ch,
+		c:        ch,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]PatternMode),
+		b:        b,
+	}
+}
+
+// publish never blocks, it returns how many
+// subscriptions the message was delivered to.
+func (b *broker) publish(channel string, payload interface{}) int {
+	msg := Message{
+		Channel: channel,
+		Payload: payload,
+		Time:    time.Now(),
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	received := 0
+	for sub := range b.channels[channel] {
+		if sub.deliver(msg) {
+			received++
+		}
+	}
+	for _, ps := range b.patterns {
+		if !ps.pattern.Match(channel) {
+			continue
+		}
+		msg.Pattern = ps.pattern.String()
+		for sub := range ps.subs {
+			if sub.deliver(msg) {
+				received++
+			}
+		}
+	}
+	return received
+}
+
+func (sub *ChannelSubscription) deliver(msg Message) bool {
+	select {
+	case sub.c <- msg:
+		return true
+	default:
+		atomic.AddUint64(&sub.dropped, 1)
+		return false
+	}
+}
+
+func (sub *ChannelSubscription) Subscribe(channels ...string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	b := sub.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, channel := range channels {
+		subs, found := b.channels[channel]
+		if !found {
+			subs = make(map[*ChannelSubscription]struct{})
+			b.channels[channel] = subs
+		}
+		subs[sub] = struct{}{}
+		sub.channels[channel] = struct{}{}
+	}
+}
+
+// Unsubscribe leaves the given channels, or every channel if none is given.
+func (sub *ChannelSubscription) Unsubscribe(channels ...string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.unsubscribe(channels)
+}
+
+func (sub *ChannelSubscription) unsubscribe(channels []string) {
+	if len(channels) == 0 {
+		for channel := range sub.channels {
+			channels = append(channels, channel)
+		}
+	}
+	b := sub.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, channel := range channels {
+		if subs, found := b.channels[channel]; found {
+			delete(subs, sub)
+			if len(subs) == 0 {
+				delete(b.channels, channel)
+			}
+		}
+		delete(sub.channels, channel)
+	}
+}
+
+// PSubscribe subscribes to every channel matching the regular
+// expressions, nothing is subscribed if one of them is invalid.
+func (sub *ChannelSubscription) PSubscribe(patterns ...string) error {
+	return sub.PSubscribeMode(Regexp, patterns...)
+}
+
+// PSubscribeMode subscribes to every channel matching the patterns
+// of the given mode. A pattern subscribed in the other mode already
+// is switched to this one.
+func (sub *ChannelSubscription) PSubscribeMode(mode PatternMode, patterns ...string) error {
+	compiled := make([]*Pattern, len(patterns))
+	for i, pattern := range patterns {
+		p, err := CompilePattern(pattern, mode)
+		if err != nil {
+			return err
+		}
+		compiled[i] = p
+	}
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return nil
+	}
+	b := sub.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, pattern := range patterns {
+		if old, found := sub.patterns[pattern]; found && old != mode {
+			b.removePattern(sub, patternKey{pattern, old})
+		}
+		key := patternKey{pattern, mode}
+		ps, found := b.patterns[key]
+		if !found {
+			ps = &patternSubs{
+				pattern: compiled[i],
+				subs:    make(map[*ChannelSubscription]struct{}),
+			}
+			b.patterns[key] = ps
+		}
+		ps.subs[sub] = struct{}{}
+		sub.patterns[pattern] = mode
+	}
+	return nil
+}
+
+// removePattern must be called with the lock of b.
+func (b *broker) removePattern(sub *ChannelSubscription, key patternKey) {
+	if ps, found := b.patterns[key]; found {
+		delete(ps.subs, sub)
+		if len(ps.subs) == 0 {
+			delete(b.patterns, key)
+		}
+	}
+}
+
+// PUnsubscribe leaves the given patterns, or every pattern if none is given.
+func (sub *ChannelSubscription) PUnsubscribe(patterns ...string) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	sub.punsubscribe(patterns)
+}
+
+func (sub *ChannelSubscription) punsubscribe(patterns []string) {
+	if len(patterns) == 0 {
+		for pattern := range sub.patterns {
+			patterns = append(patterns, pattern)
+		}
+	}
+	b := sub.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, pattern := range patterns {
+		if mode, found := sub.patterns[pattern]; found {
+			b.removePattern(sub, patternKey{pattern, mode})
+			delete(sub.patterns, pattern)
+		}
+	}
+}
+
+// Count returns how many channels and patterns are subscribed.
+func (sub *ChannelSubscription) Count() int {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	return len(sub.channels) + len(sub.patterns)
+}
+
+func (sub *ChannelSubscription) Channels() []string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	res := make([]string, 0, len(sub.channels))
+	for channel := range sub.channels {
+		res = append(res, channel)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (sub *ChannelSubscription) Patterns() []string {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	res := make([]string, 0, len(sub.patterns))
+	for pattern := range sub.patterns {
+		res = append(res, pattern)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Dropped returns how many messages were dropped
+// because the subscriber did not keep up.
+func (sub *ChannelSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+func (sub *ChannelSubscription) Close() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	if sub.closed {
+		return
+	}
+	sub.closed = true
+	sub.unsubscribe(nil)
+	sub.punsubscribe(nil)
+	// no publisher holds sub any more, as it has
+	// been removed from the broker under b.mu.
+	close(sub.c)
+}
@@ -0,0 +1,204 @@
+package tailor
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// received returns the messages waiting for sub, which publish
+// delivers before it returns.
+func received(sub *ChannelSubscription) []Message {
+	var msgs []Message
+	for {
+		select {
+		case msg := <-sub.C:
+			msgs = append(msgs, msg)
+		default:
+			return msgs
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	exact := c.NewChannelSubscription()
+	defer exact.Close()
+	exact.Subscribe("news", "sport")
+	regexp := c.NewChannelSubscription()
+	defer regexp.Close()
+	if err := regexp.PSubscribe("^ne"); err != nil {
+		t.Fatal(err)
+	}
+	glob := c.NewChannelSubscription()
+	defer glob.Close()
+	if err := glob.PSubscribeMode(Glob, "n*s", "s?ort"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		channel string
+		// the number of subscriptions which receive it
+		n int
+		// the pattern each one receives it by, "-" if it does not
+		exact, regexp, glob string
+	}{
+		{"news", 3, "", "^ne", "n*s"},
+		{"sport", 2, "", "-", "s?ort"},
+		{"nets", 2, "-", "^ne", "n*s"},
+		{"one", 0, "-", "-", "-"},
+	}
+	for _, tt := range tests {
+		if n := c.Publish(tt.channel, tt.channel+"!"); n != tt.n {
+			t.Errorf("Publish(%s) = %d, want %d", tt.channel, n, tt.n)
+		}
+		for _, s := range []struct {
+			sub     *ChannelSubscription
+			pattern string
+		}{{exact, tt.exact}, {regexp, tt.regexp}, {glob, tt.glob}} {
+			msgs := received(s.sub)
+			if s.pattern == "-" {
+				if len(msgs) != 0 {
+					t.Errorf("%s: got %+v", tt.channel, msgs)
+				}
+				continue
+			}
+			if len(msgs) != 1 {
+				t.Errorf("%s: got %d messages, want 1", tt.channel, len(msgs))
+				continue
+			}
+			msg := msgs[0]
+			if msg.Channel != tt.channel || msg.Pattern != s.pattern || msg.Payload != tt.channel+"!" {
+				t.Errorf("%s: got %+v, pattern %q", tt.channel, msg, s.pattern)
+			}
+		}
+	}
+}
+
+func TestUnsubscribe(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	sub := c.NewChannelSubscription()
+	sub.Subscribe("a", "b", "c")
+	if err := sub.PSubscribe("^x", "^y"); err != nil {
+		t.Fatal(err)
+	}
+	if n := sub.Count(); n != 5 {
+		t.Errorf("Count = %d, want 5", n)
+	}
+
+	sub.Unsubscribe("a")
+	if n := c.Publish("a", 1); n != 0 {
+		t.Errorf("delivered to %d after Unsubscribe", n)
+	}
+	if got := sub.Channels(); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("Channels = %v", got)
+	}
+	sub.PUnsubscribe("^x")
+	if n := c.Publish("xy", 1); n != 0 {
+		t.Errorf("delivered to %d after PUnsubscribe", n)
+	}
+	if n := c.Publish("yx", 1); n != 1 {
+		t.Errorf("delivered to %d, want 1", n)
+	}
+
+	sub.Unsubscribe()
+	sub.PUnsubscribe()
+	if n := sub.Count(); n != 0 {
+		t.Errorf("Count = %d after leaving all", n)
+	}
+	if n := c.Publish("b", 1) + c.Publish("yx", 1); n != 0 {
+		t.Errorf("delivered to %d after leaving all", n)
+	}
+	received(sub)
+
+	sub.Subscribe("a")
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("C is not closed")
+	}
+	// a closed subscription subscribes to nothing
+	sub.Subscribe("a")
+	if err := sub.PSubscribe("^a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Publish("a", 1); n != 0 {
+		t.Errorf("delivered to %d after Close", n)
+	}
+	sub.Close()
+}
+
+func TestPSubscribeMode(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	sub := c.NewChannelSubscription()
+	defer sub.Close()
+
+	// the pattern is switched to the mode it is subscribed in last
+	if err := sub.PSubscribe("a.c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Publish("abc", 1); n != 1 {
+		t.Errorf("regexp: delivered to %d, want 1", n)
+	}
+	if err := sub.PSubscribeMode(Glob, "a.c"); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.Publish("abc", 1); n != 0 {
+		t.Errorf("glob: delivered abc to %d, want 0", n)
+	}
+	if n := c.Publish("a.c", 1); n != 1 {
+		t.Errorf("glob: delivered a.c to %d, want 1", n)
+	}
+	if got := sub.Patterns(); !reflect.DeepEqual(got, []string{"a.c"}) {
+		t.Errorf("Patterns = %v", got)
+	}
+
+	if err := sub.PSubscribe("^ok", "("); err == nil {
+		t.Error("subscribed an invalid pattern")
+	}
+	if n := c.Publish("ok", 1); n != 0 {
+		t.Error("a pattern was subscribed along with an invalid one")
+	}
+}
+
+// A subscriber which does not keep up loses the messages which do not fit
+// into its channel, without holding up the publisher or the others.
+func TestSlowSubscriber(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	slow := c.NewChannelSubscription()
+	defer slow.Close()
+	slow.Subscribe("ch")
+	fast := c.NewChannelSubscription()
+	defer fast.Close()
+	fast.Subscribe("ch")
+
+	const extra = 10
+	fastGot := 0
+	for i := 0; i < subscriptionBuffer+extra; i++ {
+		c.Publish("ch", i)
+		// fast reads every message at once
+		fastGot += len(received(fast))
+	}
+	if fastGot != subscriptionBuffer+extra {
+		t.Errorf("fast got %d messages, want %d", fastGot, subscriptionBuffer+extra)
+	}
+	if n := slow.Dropped(); n != extra {
+		t.Errorf("slow dropped %d messages, want %d", n, extra)
+	}
+	if n := fast.Dropped(); n != 0 {
+		t.Errorf("fast dropped %d messages", n)
+	}
+	// the messages which fitted arrive in order
+	msgs := received(slow)
+	if len(msgs) != subscriptionBuffer {
+		t.Fatalf("slow got %d messages, want %d", len(msgs), subscriptionBuffer)
+	}
+	for i, msg := range msgs {
+		if msg.Payload != i {
+			t.Fatalf("message %d is %v", i, msg.Payload)
+		}
+	}
+}
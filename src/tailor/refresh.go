@@ -0,0 +1,168 @@
+package tailor
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RefreshOptions struct {
+	// a loaded value turns stale SoftTTL after it is set
+	SoftTTL time.Duration
+	// and expires HardTTL after it is set, it never expires
+	// if HardTTL is not greater than zero.
+	HardTTL time.Duration
+	// Beta enables the probabilistic early refresh (XFetch) if it is
+	// greater than zero, a larger beta refreshes earlier, 1 is typical.
+	Beta float64
+}
+
+// refresher reloads the stale values of the cache.
+type refresher struct {
+	mu   sync.RWMutex
+	load func(key string) (interface{}, error)
+	opts RefreshOptions
+}
+
+func (r *refresher) get() (func(string) (interface{}, error), RefreshOptions) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.load, r.opts
+}
+
+func (r *refresher) swap(other *refresher) {
+	r.mu.Lock()
+	other.mu.Lock()
+	r.load, other.load = other.load, r.load
+	r.opts, other.opts = other.opts, r.opts
+	other.mu.Unlock()
+	r.mu.Unlock()
+}
+
+// softValue is the value of a setsoft job.
+type softValue struct {
+	val   interface{}
+	opts  RefreshOptions
+	delta time.Duration
+}
+
+func (c *cache) setSoft(key string, sv *softValue, lastFor time.Duration) {
+	now := time.Now()
+	c.setItem(key, Item{
+		Data:           sv.val,
+		Expiration:     c.expiration(lastFor),
+		SoftExpiration: now.Add(sv.opts.SoftTTL).UnixNano(),
+		Delta:          int64(sv.delta),
+	})
+}
+
+func (c *Cache) setSoft(key string, sv *softValue) {
+	if sv.opts.HardTTL > 0 {
+		c.exCache.setSoft(key, sv, sv.opts.HardTTL)
+		if c.neCache != c.exCache {
+			c.neCache.discard(key)
+		}
+		return
+	}
+	c.neCache.setSoft(key, sv, DefaultExpiration)
+	if c.exCache != c.neCache {
+		c.exCache.discard(key)
+	}
+}
+
+// SetRefresher registers the loader of Fetch. The values it loads turn stale
+// after the soft TTL of opts, a read of a stale value returns it at once and
+// refreshes it in the background, one refresh per key at a time. A nil
+// loader unregisters the refresher.
+func (c *Cache) SetRefresher(loader func(key string) (interface{}, error), opts RefreshOptions) error {
+	if loader != nil {
+		if opts.SoftTTL <= 0 {
+			return fmt.Errorf("soft TTL must be greater than zero")
+		}
+		if opts.HardTTL > 0 && opts.HardTTL <= opts.SoftTTL {
+			return fmt.Errorf("hard TTL must be greater than soft TTL")
+		}
+		if opts.Beta < 0 {
+			return fmt.Errorf("beta must not be negative")
+		}
+	}
+	c.refresh.mu.Lock()
+	defer c.refresh.mu.Unlock()
+	c.refresh.load = loader
+	c.refresh.opts = opts
+	return nil
+}
+
+// Fetch returns the value of key, on a miss it calls the loader registered
+// by SetRefresher and sets the loaded value. Concurrent misses share a single
+// call of the loader, and its errors are cached like those of GetOrLoad.
+func (c *Cache) Fetch(key string) (interface{}, error) {
+	load, opts := c.refresh.get()
+	if load == nil {
+		return nil, fmt.Errorf("there is no refresher")
+	}
+	if val, found := c.Get(key); found {
+		return val, nil
+	}
+	if err := c.negative.get(key); err != nil {
+		atomic.AddUint64(&c.loads.negativeHits, 1)
+		return nil, err
+	}
+	val, err, shared := c.flights.do(key, func(f *flight) (interface{}, error) {
+		// the key may have been loaded since the miss above
+		if val, found := c.Get(key); found {
+			return val, nil
+		}
+		atomic.AddUint64(&c.loads.loads, 1)
+		return c.loadSoft(f, key, load, opts)
+	})
+	if shared {
+		atomic.AddUint64(&c.loads.coalesced, 1)
+	}
+	return val, err
+}
+
+// loadSoft sets the value into the database of f, which
+// SwapDB may have moved the key to while it was loaded.
+func (c *Cache) loadSoft(f *flight, key string, load func(string) (interface{}, error), opts RefreshOptions) (interface{}, error) {
+	start := time.Now()
+	val, err := load(key)
+	view := &Cache{core: c.core, database: f.database()}
+	if err != nil {
+		view.negative.put(key, err)
+		return nil, err
+	}
+	view.negative.del(key)
+	newJob := &job{
+		op:   setsoft,
+		key:  key,
+		val:  &softValue{val, opts, time.Since(start)},
+		done: make(chan struct{}),
+	}
+	view.execute(newJob)
+	<-newJob.done
+	return val, nil
+}
+
+// revalidate refreshes key in the background if its value is stale,
+// unless a load of key is in flight already.
+func (c *Cache) revalidate(key string) {
+	load, opts := c.refresh.get()
+	if load == nil {
+		return
+	}
+	item, found := c.item(key)
+	if !found || !item.Stale(opts.Beta) || c.negative.get(key) != nil {
+		return
+	}
+	c.flights.doAsync(key, func(f *flight) (interface{}, error) {
+		atomic.AddUint64(&c.loads.refreshes, 1)
+		val, err := c.loadSoft(f, key, load, opts)
+		if err != nil {
+			// the stale value is kept until it expires
+			atomic.AddUint64(&c.loads.refreshFails, 1)
+		}
+		return val, err
+	})
+}
@@ -0,0 +1,167 @@
+package tailor
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setStaleRand makes the early refresh draw x until the test ends.
+func setStaleRand(t *testing.T, x float64) {
+	old := staleRand
+	staleRand = func() float64 { return x }
+	t.Cleanup(func() { staleRand = old })
+}
+
+func TestItemStale(t *testing.T) {
+	now := time.Now().UnixNano()
+	hour := int64(time.Hour)
+	tests := []struct {
+		name  string
+		item  Item
+		beta  float64
+		draw  float64
+		stale bool
+	}{
+		{"never", Item{SoftExpiration: 0}, 1, 0.5, false},
+		{"passed", Item{SoftExpiration: now - 1}, 0, 0, true},
+		{"ahead", Item{SoftExpiration: now + hour}, 0, 0, false},
+		// -log(1-draw) is 0 for a draw of 0, about 5 for 1-e^-5
+		{"early", Item{SoftExpiration: now + hour, Delta: hour}, 1, 1 - math.Exp(-5), true},
+		{"not early", Item{SoftExpiration: now + hour, Delta: hour}, 1, 0, false},
+		{"too far", Item{SoftExpiration: now + 10*hour, Delta: hour}, 1, 1 - math.Exp(-5), false},
+		{"larger beta", Item{SoftExpiration: now + 10*hour, Delta: hour}, 3, 1 - math.Exp(-5), true},
+		{"quick load", Item{SoftExpiration: now + hour, Delta: 0}, 1, 1 - math.Exp(-5), false},
+	}
+	for _, tt := range tests {
+		setStaleRand(t, tt.draw)
+		if stale := tt.item.Stale(tt.beta); stale != tt.stale {
+			t.Errorf("%s: Stale = %v, want %v", tt.name, stale, tt.stale)
+		}
+	}
+}
+
+// waitFor polls cond for up to 5 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// A stale value is returned at once while one refresh reloads it.
+func TestStaleWhileRevalidate(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	var version int32
+	hold := make(chan struct{})
+	errDown := errors.New("down")
+	fail := int32(0)
+	err := c.SetRefresher(func(key string) (interface{}, error) {
+		v := atomic.AddInt32(&version, 1)
+		if v > 1 {
+			<-hold
+		}
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil, errDown
+		}
+		return v, nil
+	}, RefreshOptions{SoftTTL: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Fetch("k"); err != nil || v != int32(1) {
+		t.Fatalf("Fetch = %v, %v", v, err)
+	}
+	if v, _ := c.Get("k"); v != int32(1) || c.Stats().Loads.Refreshes != 0 {
+		t.Fatal("a fresh value was refreshed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	// the refresh is held in the loader, the reads return the stale value
+	for i := 0; i < 3; i++ {
+		if v, found := c.Get("k"); !found || v != int32(1) {
+			t.Fatalf("Get = %v, %v while refreshing", v, found)
+		}
+	}
+	if v, err := c.Fetch("k"); err != nil || v != int32(1) {
+		t.Fatalf("Fetch = %v, %v while refreshing", v, err)
+	}
+	// the refresh counts once it runs in the background
+	waitFor(t, "the refresh", func() bool {
+		return c.Stats().Loads.Refreshes > 0
+	})
+	hold <- struct{}{}
+	waitFor(t, "the refreshed value", func() bool {
+		v, _ := c.Get("k")
+		return v == int32(2)
+	})
+	if n := c.Stats().Loads.Refreshes; n != 1 {
+		t.Errorf("%d refreshes, want 1", n)
+	}
+
+	// a failed refresh keeps the stale value
+	atomic.StoreInt32(&fail, 1)
+	time.Sleep(30 * time.Millisecond)
+	if v, _ := c.Get("k"); v != int32(2) {
+		t.Fatalf("Get = %v", v)
+	}
+	hold <- struct{}{}
+	waitFor(t, "the failed refresh", func() bool {
+		return c.Stats().Loads.RefreshFails == 1
+	})
+	if v, found := c.Get("k"); !found || v != int32(2) {
+		t.Errorf("Get = %v, %v after a failed refresh", v, found)
+	}
+}
+
+// With XFetch, a value which took long to load may be refreshed long
+// before it turns stale, depending on the draw.
+func TestEarlyRefresh(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		draw    float64
+		refresh bool
+	}{
+		{"late draw", 0, false},
+		{"early draw", 1 - 1e-9, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			setStaleRand(t, tt.draw)
+			c := newTestCache(time.Minute, 1)
+			defer c.Close()
+			var loads int32
+			// a load takes at least a millisecond, which times the beta
+			// and -log(1e-9) is about 6 hours ahead of the soft expiration
+			err := c.SetRefresher(func(string) (interface{}, error) {
+				time.Sleep(time.Millisecond)
+				return atomic.AddInt32(&loads, 1), nil
+			}, RefreshOptions{SoftTTL: time.Hour, Beta: 1e6})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Fetch("k"); err != nil {
+				t.Fatal(err)
+			}
+			c.Get("k")
+			if !tt.refresh {
+				time.Sleep(20 * time.Millisecond)
+				if n := c.Stats().Loads.Refreshes; n != 0 {
+					t.Errorf("%d refreshes, want none", n)
+				}
+				return
+			}
+			// the refreshed value is stale at once as well
+			waitFor(t, "the early refresh", func() bool {
+				v, _ := c.Get("k")
+				return v.(int32) >= 2
+			})
+		})
+	}
+}
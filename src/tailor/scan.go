@@ -0,0 +1,131 @@
+package tailor
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// the keys of each cache are also kept in this many hash slots,
+// SCAN walks the slots in order, so its cursor is the next slot.
+const scanSlots = 1 << 12
+
+const defaultScanCount = 10
+
+// slotIndex keeps the keys of a cache by their hash slot,
+// it is guarded by the lock of the cache.
+type slotIndex []map[string]struct{}
+
+func newSlotIndex(items map[string]Item) slotIndex {
+	si := make(slotIndex, scanSlots)
+	for k := range items {
+		si.add(k)
+	}
+	return si
+}
+
+func slotOf(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % scanSlots)
+}
+
+func (si slotIndex) add(key string) {
+	slot := slotOf(key)
+	if si[slot] == nil {
+		si[slot] = make(map[string]struct{})
+	}
+	si[slot][key] = struct{}{}
+}
+
+func (si slotIndex) remove(key string) {
+	delete(si[slotOf(key)], key)
+}
+
+type ScanOptions struct {
+	// pattern the keys must match, empty matches every key
+	Match string
+	// Match is a glob unless it is Regexp
+	Mode PatternMode
+	// how many keys to return about, the result may hold
+	// fewer or more of them. It is 10 if not greater than zero.
+	Count int
+	// the type the values must have, see TypeOf, empty matches every type
+	Type string
+}
+
+// TypeOf returns the type name of a value as SCAN filters it:
+// "string", "list", "json", or "other" for the values set by the Go API.
+func TypeOf(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return "string"
+	case *LinkedList:
+		return "list"
+	case *JSONDoc:
+		return "json"
+	case *compressedValue:
+		if !v.isBytes {
+			return "string"
+		}
+		return "other"
+	default:
+		return "other"
+	}
+}
+
+// Scan returns some keys of the database and the cursor to continue
+// from, it starts with cursor 0 and is done once it returns cursor 0.
+// Every key which exists during the whole iteration is returned at
+// least once, a key may be returned more than once if it is removed
+// and set again meanwhile. The keys of one slot are read under the locks
+// of both caches, so a key which moves between them is never missed.
+func (c *Cache) Scan(cursor uint64, opts ScanOptions) (uint64, []string, error) {
+	if cursor >= scanSlots {
+		return 0, nil, fmt.Errorf("invalid cursor %d", cursor)
+	}
+	var p *Pattern
+	if opts.Match != "" {
+		var err error
+		p, err = CompilePattern(opts.Match, opts.Mode)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	count := opts.Count
+	if count <= 0 {
+		count = defaultScanCount
+	}
+
+	caches := []*cache{c.neCache}
+	if c.exCache != c.neCache {
+		caches = append(caches, c.exCache)
+	}
+	var keys []string
+	slot := int(cursor)
+	// empty slots count as well, so that a sparse keyspace
+	// does not make one call walk all the slots.
+	for visited := 0; slot < scanSlots && len(keys) < count && visited < count*10; visited++ {
+		for _, ch := range caches {
+			ch.mu.RLock()
+		}
+		for _, ch := range caches {
+			for key := range ch.slots[slot] {
+				item := ch.items[key]
+				if item.Expired() ||
+					(p != nil && !p.Match(key)) ||
+					(opts.Type != "" && TypeOf(item.Data) != opts.Type) {
+					continue
+				}
+				keys = append(keys, key)
+			}
+		}
+		for i := len(caches) - 1; i >= 0; i-- {
+			caches[i].mu.RUnlock()
+		}
+		slot++
+	}
+	if slot >= scanSlots {
+		return 0, keys, nil
+	}
+	return uint64(slot), keys, nil
+}
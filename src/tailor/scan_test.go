@@ -0,0 +1,178 @@
+package tailor
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scanAll scans the database from cursor 0 until the cursor is 0 again,
+// it returns the keys and how many calls it took.
+func scanAll(t *testing.T, c *Cache, opts ScanOptions) (map[string]int, int) {
+	keys := make(map[string]int)
+	var cursor uint64
+	for calls := 1; ; calls++ {
+		next, batch, err := c.Scan(cursor, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range batch {
+			keys[key]++
+		}
+		if next == 0 {
+			return keys, calls
+		}
+		if next <= cursor || calls > scanSlots {
+			t.Fatalf("the cursor went from %d to %d", cursor, next)
+		}
+		cursor = next
+	}
+}
+
+func sortedKeys(keys map[string]int) []string {
+	res := make([]string, 0, len(keys))
+	for key := range keys {
+		res = append(res, key)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Every key is returned once, from both caches,
+// and the keys of the other databases are not.
+func TestScan(t *testing.T) {
+	c := newTestCache(time.Minute, 2)
+	defer c.Close()
+	db1, _ := c.Select(1)
+	want := make([]string, 0, 200)
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("ne:%03d", i), i)
+		c.Setex(fmt.Sprintf("ex:%03d", i), i, time.Hour)
+		want = append(want, fmt.Sprintf("ne:%03d", i), fmt.Sprintf("ex:%03d", i))
+		db1.Set(fmt.Sprintf("db1:%d", i), i)
+	}
+	c.Setex("expired", 0, time.Millisecond)
+	c.WaitWrites()
+	time.Sleep(5 * time.Millisecond)
+	sort.Strings(want)
+
+	keys, _ := scanAll(t, c, ScanOptions{Count: 7})
+	if got := sortedKeys(keys); !reflect.DeepEqual(got, want) {
+		t.Fatalf("scanned %d keys, want %d", len(got), len(want))
+	}
+	for key, n := range keys {
+		if n != 1 {
+			t.Errorf("%s returned %d times", key, n)
+		}
+	}
+
+	if _, _, err := c.Scan(scanSlots, ScanOptions{}); err == nil {
+		t.Error("scanned from an invalid cursor")
+	}
+	if _, _, err := c.Scan(0, ScanOptions{Match: "[a-", Mode: Regexp}); err == nil {
+		t.Error("scanned with an invalid pattern")
+	}
+}
+
+func TestScanOptions(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		c.Set(fmt.Sprintf("user:%d", i), "v")
+	}
+	if _, err := c.LPush("list", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.JSONSet("doc", "$", `{"a":1}`); err != nil {
+		t.Fatal(err)
+	}
+	c.Setex("user:x", "v", time.Hour)
+	c.WaitWrites()
+
+	for _, tt := range []struct {
+		opts ScanOptions
+		want int
+	}{
+		{ScanOptions{Match: "user:1?"}, 10},
+		{ScanOptions{Match: "^user:[0-9]$", Mode: Regexp}, 10},
+		{ScanOptions{Match: "user:*"}, 101},
+		{ScanOptions{Type: "string"}, 101},
+		{ScanOptions{Type: "list"}, 1},
+		{ScanOptions{Type: "json"}, 1},
+		{ScanOptions{Match: "user:*", Type: "list"}, 0},
+		{ScanOptions{}, 103},
+	} {
+		keys, _ := scanAll(t, c, tt.opts)
+		if len(keys) != tt.want {
+			t.Errorf("%+v: %d keys, want %d", tt.opts, len(keys), tt.want)
+		}
+	}
+	if keys, _ := scanAll(t, c, ScanOptions{Type: "json"}); keys["doc"] != 1 {
+		t.Errorf("type json returned %v", keys)
+	}
+
+	// a large count walks all the slots at once,
+	// a small one returns a few keys per call
+	if keys, calls := scanAll(t, c, ScanOptions{Count: scanSlots}); calls != 1 || len(keys) != 103 {
+		t.Errorf("count %d: %d keys in %d calls", scanSlots, len(keys), calls)
+	}
+	if _, calls := scanAll(t, c, ScanOptions{Count: 1}); calls < 50 {
+		t.Errorf("count 1: %d calls", calls)
+	}
+}
+
+// The keys which exist during the whole scan are returned, while
+// other keys are added and removed and some move between the caches.
+func TestScanConcurrentWrites(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	for i := 0; i < 500; i++ {
+		c.Set(fmt.Sprintf("ne:%d", i), i)
+		c.Setex(fmt.Sprintf("ex:%d", i), i, time.Hour)
+		c.Set(fmt.Sprintf("move:%d", i), i)
+	}
+	c.WaitWrites()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Set(fmt.Sprintf("new:%d", i), i)
+			c.Del(fmt.Sprintf("new:%d", i-50))
+			// the key leaves the cache without expiration
+			// for the one with it, and goes back
+			key := fmt.Sprintf("move:%d", i%500)
+			if i/500%2 == 0 {
+				c.Setex(key, i, time.Hour)
+			} else {
+				c.Set(key, i)
+			}
+		}
+	}()
+	for round := 0; round < 5; round++ {
+		keys, _ := scanAll(t, c, ScanOptions{Count: 5})
+		for i := 0; i < 500; i++ {
+			for _, key := range []string{
+				fmt.Sprintf("ne:%d", i),
+				fmt.Sprintf("ex:%d", i),
+				fmt.Sprintf("move:%d", i),
+			} {
+				if keys[key] == 0 {
+					t.Fatalf("round %d: %s is missing", round, key)
+				}
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,151 @@
+package tailor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule decides when a job runs next.
+type Schedule interface {
+	// Next returns the first time after t at which the job runs,
+	// or the zero time if it does not run again, which stops the job.
+	Next(t time.Time) time.Time
+}
+
+type every time.Duration
+
+// Every runs a job at a fixed interval, the first run
+// happens one interval after the job is started.
+// A job is not added with an interval <= 0.
+func Every(interval time.Duration) Schedule {
+	return every(interval)
+}
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+// cronSchedule keeps the allowed values of each field as a bit set.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// a day matches either dom or dow if both of them are restricted,
+	// otherwise it has to match the restricted one. As in cron, a field
+	// which starts with '*', like "*/2", is not restricted.
+	domStar, dowStar bool
+}
+
+var cronBounds = []struct {
+	min, max int
+}{
+	{0, 59}, // minute
+	{0, 23}, // hour
+	{1, 31}, // day of month
+	{1, 12}, // month
+	{0, 6},  // day of week, 0 is Sunday
+}
+
+// ParseCron parses a cron expression of five fields: minute, hour,
+// day of month, month and day of week. Each field is '*' or a comma
+// separated list of values and ranges like "1-5", any of which can
+// take a step like "*/15". Times are in the local time zone.
+func ParseCron(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields", spec)
+	}
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseCronField(field, cronBounds[i].min, cronBounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("cron expression '%s': %v", spec, err)
+		}
+		sets[i] = set
+	}
+	return &cronSchedule{
+		minute:  sets[0],
+		hour:    sets[1],
+		dom:     sets[2],
+		month:   sets[3],
+		dow:     sets[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			step = n
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			if i := strings.Index(part, "-"); i >= 0 {
+				lo, err = strconv.Atoi(part[:i])
+				if err == nil {
+					hi, err = strconv.Atoi(part[i+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(part)
+				hi = lo
+				if step > 1 {
+					hi = max
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in '%s'", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("'%s' is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (cs *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// a valid expression matches at least once in a few years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (cs *cronSchedule) dayMatches(t time.Time) bool {
+	domOk := cs.dom&(1<<uint(t.Day())) != 0
+	dowOk := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domOk && dowOk
+	}
+	return domOk || dowOk
+}
@@ -0,0 +1,47 @@
+package tailor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// March 2026 starts on a Sunday, its Mondays are the 2nd, 9th, 16th...
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2026, time.March, day, hour, min, 0, 0, time.Local)
+	}
+	for _, tc := range []struct {
+		spec     string
+		from     time.Time
+		want     time.Time
+		parseErr bool
+	}{
+		{spec: "30 9 * * *", from: at(1, 0, 0), want: at(1, 9, 30)},
+		{spec: "*/15 * * * *", from: at(1, 10, 7), want: at(1, 10, 15)},
+		{spec: "0 0 13 * *", from: at(1, 0, 0), want: at(13, 0, 0)},
+		{spec: "0 0 * * 1", from: at(1, 0, 0), want: at(2, 0, 0)},
+		// both days restricted, either of them matches
+		{spec: "0 0 1,13 * 1", from: at(1, 0, 0), want: at(2, 0, 0)},
+		// a day field with a step is not restricted, both have to match
+		{spec: "0 0 */2 * 1", from: at(1, 0, 0), want: at(9, 0, 0)},
+		{spec: "0 0 1,15 * */3", from: at(1, 0, 0), want: at(15, 0, 0)},
+		{spec: "0 0 * *", parseErr: true},
+		{spec: "60 0 * * *", parseErr: true},
+		{spec: "0 0 */0 * *", parseErr: true},
+	} {
+		sched, err := ParseCron(tc.spec)
+		if tc.parseErr {
+			if err == nil {
+				t.Errorf("%q was parsed", tc.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if next := sched.Next(tc.from); !next.Equal(tc.want) {
+			t.Errorf("%q after %v: %v, want %v", tc.spec, tc.from, next, tc.want)
+		}
+	}
+}
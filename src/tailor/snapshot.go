@@ -0,0 +1,378 @@
+package tailor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot file starts with snapshotMagic, the format version (2 bytes),
+// the time it was created at (unix nanosecond, 8 bytes) and the number of
+// keys (8 bytes), and ends with the CRC-32 of everything before it (4 bytes),
+// all big-endian. What is in between depends on the version, the current one
+// is described in snapshotFormat.md. With a snapshot key, the whole file is
+// encrypted. The files of one cache each, saved before the format version 2,
+// are read by readLegacyFiles.
+var snapshotMagic = []byte("TKVSNAP\x00")
+
+const (
+	snapshotVersion = 2
+	snapshotHeader  = 8 + 2 + 8 + 8
+)
+
+// snapshotReaders read the snapshots of each format version after the
+// header into the current snapshot, which is how old files migrate.
+var snapshotReaders = map[uint16]func(r *snapshotReader) (*snapshot, error){
+	1: readSnapshotV1,
+	2: readSnapshotV2,
+}
+
+// snapshot is the content of a snapshot file,
+// it keeps the items of database i at Databases[i].
+type snapshot struct {
+	Databases []map[string]Item
+}
+
+func (snap *snapshot) keys() int {
+	n := 0
+	for _, items := range snap.Databases {
+		n += len(items)
+	}
+	return n
+}
+
+func encodeSnapshot(snap *snapshot) ([]byte, error) {
+	w := &snapshotWriter{}
+	w.buf.Write(snapshotMagic)
+	w.u16(snapshotVersion)
+	w.u64(uint64(time.Now().UnixNano()))
+	w.u64(uint64(snap.keys()))
+	if err := writeSnapshotV2(w, snap); err != nil {
+		return nil, err
+	}
+	w.u32(crc32.ChecksumIEEE(w.buf.Bytes()))
+	return w.buf.Bytes(), nil
+}
+
+// decodeSnapshot checks the whole file before it decodes anything.
+func decodeSnapshot(data []byte) (*snapshot, error) {
+	if !bytes.HasPrefix(data, snapshotMagic) {
+		// one cache written before the header
+		items := map[string]Item{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&items); err != nil {
+			return nil, err
+		}
+		return &snapshot{Databases: []map[string]Item{items}}, nil
+	}
+	if len(data) < snapshotHeader+4 {
+		return nil, errSnapshotTruncated
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return nil, errors.New("snapshot is corrupted, its checksum does not match")
+	}
+	r := &snapshotReader{data: body, off: len(snapshotMagic)}
+	version := r.u16()
+	r.u64()
+	keys := r.u64()
+	read, found := snapshotReaders[version]
+	if !found {
+		return nil, fmt.Errorf("snapshot format version %d is not supported, the latest is %d",
+			version, snapshotVersion)
+	}
+	snap, err := read(r)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(snap.keys()) != keys {
+		return nil, fmt.Errorf("snapshot has %d keys, but its header says %d", snap.keys(), keys)
+	}
+	return snap, nil
+}
+
+// writeFileAtomic writes into a temporary file next to filename, syncs
+// it and renames it over filename, so that a crash leaves either the old
+// file or the new one.
+func writeFileAtomic(filename string, write func(w io.Writer) error) (err error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, base+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// copySnapshot copies every database. It runs on the executor, between
+// two writes, so the snapshot is of a single point in time.
+func (c *Cache) copySnapshot() *snapshot {
+	snap := &snapshot{
+		Databases: make([]map[string]Item, len(c.dbs)),
+	}
+	for i, db := range c.dbs {
+		items := make(map[string]Item)
+		db.neCache.copyItems(items)
+		if db.exCache != db.neCache {
+			db.exCache.copyItems(items)
+		}
+		// the lists and documents are changed in place by the writes
+		copyValues(items)
+		snap.Databases[i] = items
+	}
+	return snap
+}
+
+// copyValues replaces the lists and the JSON documents of items by
+// copies of them, the other values are not changed in place.
+func copyValues(items map[string]Item) {
+	for key, item := range items {
+		switch v := item.Data.(type) {
+		case *LinkedList:
+			item.Data = newList(v.Values(), false)
+		case *JSONDoc:
+			item.Data = v.copy()
+		default:
+			continue
+		}
+		items[key] = item
+	}
+}
+
+func (c *Cache) saveFile(filename string) (err error) {
+	// only the copy is taken on the executor; encoding
+	// and writing the file do not hold up the writes
+	newJob := &job{
+		op:   dump,
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+	snap := newJob.res.value.(*snapshot)
+
+	data, err := encodeSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	if data, err = c.snapKeys.encrypt(data); err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// LoadMode tells what Load does with the keys which exist already.
+type LoadMode byte
+
+const (
+	// keep the keys which exist, only the others are loaded
+	LoadKeep LoadMode = iota
+	// the keys of the snapshot replace the keys which exist
+	LoadOverwrite
+	// every key of all the databases, and of their attached stores,
+	// is removed before the load
+	LoadReplace
+)
+
+func ParseLoadMode(s string) (LoadMode, error) {
+	switch s {
+	case "keep":
+		return LoadKeep, nil
+	case "overwrite":
+		return LoadOverwrite, nil
+	case "replace":
+		return LoadReplace, nil
+	default:
+		return 0, fmt.Errorf("invalid load mode '%s', it must be keep, overwrite or replace", s)
+	}
+}
+
+func (m LoadMode) String() string {
+	switch m {
+	case LoadKeep:
+		return "keep"
+	case LoadOverwrite:
+		return "overwrite"
+	default:
+		return "replace"
+	}
+}
+
+// LoadResult counts the keys of a snapshot by what Load did with them.
+type LoadResult struct {
+	Loaded int `json:"loaded"`
+	// the keys which existed, with LoadKeep
+	Skipped int `json:"skipped"`
+	// the keys which expired since the snapshot was saved
+	Expired int `json:"expired"`
+}
+
+func (c *Cache) loadFile(filename string, mode LoadMode) (LoadResult, error) {
+	snap, err := c.readSnapshotFile(filename)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	// a snapshot of more databases loads as long as the ones
+	// which are not here have no keys
+	for i := len(c.dbs); i < len(snap.Databases); i++ {
+		if len(snap.Databases[i]) > 0 {
+			return LoadResult{}, fmt.Errorf("snapshot has keys in database %d, but there are %d databases",
+				i, len(c.dbs))
+		}
+	}
+	if len(snap.Databases) > len(c.dbs) {
+		snap.Databases = snap.Databases[:len(c.dbs)]
+	}
+	return c.applySnapshot(snap, mode), nil
+}
+
+// applySnapshot loads snap by the serial write path,
+// so that no write comes in between.
+func (c *Cache) applySnapshot(snap *snapshot, mode LoadMode) LoadResult {
+	newJob := &job{
+		op:   load,
+		val:  loadArgs{snap: snap, mode: mode},
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return newJob.res.value.(LoadResult)
+}
+
+func (c *Cache) readSnapshotFile(filename string) (*snapshot, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if _, legacyErr := os.Stat(filename + "ne"); legacyErr == nil {
+			return c.readLegacyFiles(filename)
+		}
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// nothing is loaded unless the whole file is authenticated
+	data, err = c.snapKeys.decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load '%s': %v", filename, err)
+	}
+	return snap, nil
+}
+
+// readLegacyFiles reads the files of one cache each, which the versions
+// before the format version 2 saved, as the databases of the same index,
+// see dbFilename. A database without files was not there when they were
+// saved, and is left empty.
+func (c *Cache) readLegacyFiles(filename string) (*snapshot, error) {
+	snap := &snapshot{Databases: make([]map[string]Item, len(c.dbs))}
+	for i := range snap.Databases {
+		items := map[string]Item{}
+		name := dbFilename(filename, i)
+		for _, suffix := range []string{"ne", "ex"} {
+			if _, err := os.Stat(name + suffix); os.IsNotExist(err) && (suffix == "ex" || i > 0) {
+				// a cache with default expiration saved no ex file
+				break
+			}
+			file, err := c.readSnapshotFile(name + suffix)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range file.Databases[0] {
+				items[k] = v
+			}
+		}
+		snap.Databases[i] = items
+	}
+	return snap, nil
+}
+
+type loadArgs struct {
+	snap *snapshot
+	mode LoadMode
+}
+
+// loadSnapshot puts the items of snap into the databases of the same
+// index. The locks of all the caches are held until every item is in
+// place, so the readers see either none of the snapshot or all of it.
+// The attached stores are told about the keys it removed or replaced.
+func (c *Cache) loadSnapshot(snap *snapshot, mode LoadMode) LoadResult {
+	var res LoadResult
+	views := make([]*Cache, len(c.dbs))
+	changed := make([][]string, len(c.dbs))
+	for i, db := range c.dbs {
+		views[i] = &Cache{core: c.core, database: db}
+		if mode == LoadReplace {
+			changed[i] = views[i].storedKeys()
+		}
+	}
+	var locked []*cache
+	for _, db := range c.dbs {
+		for _, ch := range db.caches() {
+			ch.mu.Lock()
+			locked = append(locked, ch)
+		}
+	}
+	loaded := make([][]string, len(c.dbs))
+	for i, db := range c.dbs {
+		if mode == LoadReplace {
+			for _, ch := range db.caches() {
+				ch.clear()
+			}
+		}
+		if i < len(snap.Databases) {
+			loaded[i] = db.loadItems(snap.Databases[i], mode, &res)
+		}
+	}
+	for _, ch := range locked {
+		ch.mu.Unlock()
+	}
+
+	if mode == LoadReplace {
+		c.aof.log(aofRecord{Op: aofFlushAll})
+		c.saves.changed(1)
+	}
+	for i, keys := range loaded {
+		views[i].bulkWritten(append(changed[i], keys...))
+		if len(keys) == 0 {
+			continue
+		}
+		c.aof.logKeys(c.dbs[i], keys)
+		c.saves.changed(len(keys))
+		for _, key := range views[i].waits.keys() {
+			views[i].serveWaiters(key)
+		}
+	}
+	return res
+}
@@ -0,0 +1,461 @@
+package tailor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// The sections and the values of snapshot format version 2, see
+// snapshotFormat.md. The numbers are part of the format, so they
+// must never change; new ones are added at the end.
+const (
+	sectionEnd      byte = 0
+	sectionDatabase byte = 1
+)
+
+const (
+	valueNil        byte = 0
+	valueString     byte = 1
+	valueBytes      byte = 2
+	valueInt        byte = 3
+	valueInt8       byte = 4
+	valueInt16      byte = 5
+	valueInt32      byte = 6
+	valueInt64      byte = 7
+	valueUint       byte = 8
+	valueUint8      byte = 9
+	valueUint16     byte = 10
+	valueUint32     byte = 11
+	valueUint64     byte = 12
+	valueFloat32    byte = 13
+	valueFloat64    byte = 14
+	valueBool       byte = 15
+	valueList       byte = 16
+	valueJSON       byte = 17
+	valueCompressed byte = 18
+	valueGob        byte = 255
+)
+
+var errSnapshotTruncated = errors.New("snapshot is truncated")
+
+// snapshotWriter appends the fields of the format, all big-endian.
+type snapshotWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *snapshotWriter) u8(v byte) {
+	w.buf.WriteByte(v)
+}
+
+func (w *snapshotWriter) u16(v uint16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *snapshotWriter) u32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *snapshotWriter) u64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.buf.Write(b[:])
+}
+
+func (w *snapshotWriter) bytes(b []byte) {
+	w.u32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *snapshotWriter) str(s string) {
+	w.u32(uint32(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *snapshotWriter) item(key string, item Item) error {
+	w.str(key)
+	w.u64(uint64(item.Expiration))
+	w.u64(uint64(item.SoftExpiration))
+	w.u64(uint64(item.Delta))
+	w.u32(uint32(len(item.Tags)))
+	for _, tag := range item.Tags {
+		w.str(tag)
+	}
+	if err := w.value(item.Data); err != nil {
+		return fmt.Errorf("value of '%s': %v", key, err)
+	}
+	return nil
+}
+
+func (w *snapshotWriter) value(val interface{}) error {
+	switch v := val.(type) {
+	case nil:
+		w.u8(valueNil)
+	case string:
+		w.u8(valueString)
+		w.str(v)
+	case []byte:
+		w.u8(valueBytes)
+		w.bytes(v)
+	case int:
+		w.u8(valueInt)
+		w.u64(uint64(v))
+	case int8:
+		w.u8(valueInt8)
+		w.u64(uint64(v))
+	case int16:
+		w.u8(valueInt16)
+		w.u64(uint64(v))
+	case int32:
+		w.u8(valueInt32)
+		w.u64(uint64(v))
+	case int64:
+		w.u8(valueInt64)
+		w.u64(uint64(v))
+	case uint:
+		w.u8(valueUint)
+		w.u64(uint64(v))
+	case uint8:
+		w.u8(valueUint8)
+		w.u64(uint64(v))
+	case uint16:
+		w.u8(valueUint16)
+		w.u64(uint64(v))
+	case uint32:
+		w.u8(valueUint32)
+		w.u64(uint64(v))
+	case uint64:
+		w.u8(valueUint64)
+		w.u64(v)
+	case float32:
+		w.u8(valueFloat32)
+		w.u64(math.Float64bits(float64(v)))
+	case float64:
+		w.u8(valueFloat64)
+		w.u64(math.Float64bits(v))
+	case bool:
+		w.u8(valueBool)
+		if v {
+			w.u8(1)
+		} else {
+			w.u8(0)
+		}
+	case *LinkedList:
+		values := v.Values()
+		w.u8(valueList)
+		w.u32(uint32(len(values)))
+		for _, elem := range values {
+			if err := w.value(elem); err != nil {
+				return err
+			}
+		}
+	case *JSONDoc:
+		data, err := v.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		w.u8(valueJSON)
+		w.bytes(data)
+	case *compressedValue:
+		w.u8(valueCompressed)
+		if v.isBytes {
+			w.u8(1)
+		} else {
+			w.u8(0)
+		}
+		w.u64(uint64(v.size))
+		w.bytes(v.data)
+	default:
+		// the types of the applications, which only Go can read
+		if err := registerGob(val); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&val); err != nil {
+			return err
+		}
+		w.u8(valueGob)
+		w.bytes(buf.Bytes())
+	}
+	return nil
+}
+
+// registeredGob holds the types which registerGob registered,
+// so that each one is registered once rather than on every value.
+var registeredGob sync.Map
+
+func registerGob(val interface{}) (err error) {
+	t := reflect.TypeOf(val)
+	if _, found := registeredGob.Load(t); found {
+		return nil
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			err = fmt.Errorf("error registering %T with gob", val)
+		}
+	}()
+	gob.Register(val)
+	registeredGob.Store(t, true)
+	return nil
+}
+
+// snapshotReader reads the fields of the format, the first
+// read past the end sets err and the rest read zeros.
+type snapshotReader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *snapshotReader) next(n int) []byte {
+	if r.err != nil || n < 0 || len(r.data)-r.off < n {
+		r.err = errSnapshotTruncated
+		return nil
+	}
+	b := r.data[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *snapshotReader) u8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *snapshotReader) u16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *snapshotReader) u32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *snapshotReader) u64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *snapshotReader) bytes() []byte {
+	n := r.u32()
+	return r.next(int(n))
+}
+
+func (r *snapshotReader) str() string {
+	return string(r.bytes())
+}
+
+func (r *snapshotReader) item() (string, Item, error) {
+	key := r.str()
+	item := Item{
+		Expiration:     int64(r.u64()),
+		SoftExpiration: int64(r.u64()),
+		Delta:          int64(r.u64()),
+	}
+	if n := r.u32(); n > 0 && r.err == nil {
+		if int(n) > len(r.data)-r.off {
+			return "", Item{}, errSnapshotTruncated
+		}
+		item.Tags = make([]string, n)
+		for i := range item.Tags {
+			item.Tags[i] = r.str()
+		}
+	}
+	data, err := r.value()
+	if err != nil {
+		return "", Item{}, fmt.Errorf("value of '%s': %v", key, err)
+	}
+	item.Data = data
+	return key, item, r.err
+}
+
+func (r *snapshotReader) value() (interface{}, error) {
+	t := r.u8()
+	if r.err != nil {
+		return nil, r.err
+	}
+	switch t {
+	case valueNil:
+		return nil, nil
+	case valueString:
+		return r.str(), r.err
+	case valueBytes:
+		return append([]byte(nil), r.bytes()...), r.err
+	case valueInt:
+		return int(r.u64()), r.err
+	case valueInt8:
+		return int8(r.u64()), r.err
+	case valueInt16:
+		return int16(r.u64()), r.err
+	case valueInt32:
+		return int32(r.u64()), r.err
+	case valueInt64:
+		return int64(r.u64()), r.err
+	case valueUint:
+		return uint(r.u64()), r.err
+	case valueUint8:
+		return uint8(r.u64()), r.err
+	case valueUint16:
+		return uint16(r.u64()), r.err
+	case valueUint32:
+		return uint32(r.u64()), r.err
+	case valueUint64:
+		return r.u64(), r.err
+	case valueFloat32:
+		return float32(math.Float64frombits(r.u64())), r.err
+	case valueFloat64:
+		return math.Float64frombits(r.u64()), r.err
+	case valueBool:
+		return r.u8() != 0, r.err
+	case valueList:
+		n := r.u32()
+		list := &LinkedList{}
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			elem, err := r.value()
+			if err != nil {
+				return nil, err
+			}
+			list.AddLast(elem)
+		}
+		return list, r.err
+	case valueJSON:
+		data := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return NewJSONDoc(data)
+	case valueCompressed:
+		isBytes := r.u8() == 1
+		size := r.u64()
+		data := r.bytes()
+		return &compressedValue{
+			data:    append([]byte(nil), data...),
+			size:    int(size),
+			isBytes: isBytes,
+		}, r.err
+	case valueGob:
+		data := r.bytes()
+		if r.err != nil {
+			return nil, r.err
+		}
+		var v interface{}
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unknown value type %d", t)
+	}
+}
+
+// writeSnapshotV2 writes the databases after the header.
+func writeSnapshotV2(w *snapshotWriter, snap *snapshot) error {
+	w.u32(uint32(len(snap.Databases)))
+	for i, items := range snap.Databases {
+		if len(items) == 0 {
+			continue
+		}
+		// the keys are in order, so that the same keys make the same file
+		keys := make([]string, 0, len(items))
+		for key := range items {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		section := &snapshotWriter{}
+		section.u32(uint32(i))
+		section.u64(uint64(len(keys)))
+		for _, key := range keys {
+			if err := section.item(key, items[key]); err != nil {
+				return err
+			}
+		}
+		w.u8(sectionDatabase)
+		w.u64(uint64(section.buf.Len()))
+		w.buf.Write(section.buf.Bytes())
+	}
+	w.u8(sectionEnd)
+	w.u64(0)
+	return nil
+}
+
+// readSnapshotV2 reads the databases after the header,
+// the sections it does not know are skipped.
+func readSnapshotV2(r *snapshotReader) (*snapshot, error) {
+	n := r.u32()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if int(n) > len(r.data) {
+		return nil, fmt.Errorf("snapshot has %d databases", n)
+	}
+	snap := &snapshot{Databases: make([]map[string]Item, n)}
+	for {
+		kind := r.u8()
+		length := r.u64()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if length > uint64(len(r.data)-r.off) {
+			return nil, errSnapshotTruncated
+		}
+		body := r.next(int(length))
+		switch kind {
+		case sectionEnd:
+			return snap, nil
+		case sectionDatabase:
+			if err := readDatabaseSection(&snapshotReader{data: body}, snap); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readDatabaseSection(r *snapshotReader, snap *snapshot) error {
+	index := r.u32()
+	count := r.u64()
+	if r.err != nil {
+		return r.err
+	}
+	if int(index) >= len(snap.Databases) {
+		return fmt.Errorf("section of database %d, but the snapshot has %d databases", index, len(snap.Databases))
+	}
+	items := make(map[string]Item)
+	for i := uint64(0); i < count; i++ {
+		key, item, err := r.item()
+		if err != nil {
+			return fmt.Errorf("database %d: %v", index, err)
+		}
+		items[key] = item
+	}
+	snap.Databases[index] = items
+	return nil
+}
+
+// readSnapshotV1 reads the gob encoded items of format version 1,
+// which held one cache of one database.
+func readSnapshotV1(r *snapshotReader) (*snapshot, error) {
+	items := map[string]Item{}
+	if err := gob.NewDecoder(bytes.NewReader(r.data[r.off:])).Decode(&items); err != nil {
+		return nil, err
+	}
+	return &snapshot{Databases: []map[string]Item{items}}, nil
+}
@@ -0,0 +1,499 @@
+package tailor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCache(cleanCycle time.Duration, databases int) *Cache {
+	opts := DefaultCacheOptions()
+	opts.CleanCycle = cleanCycle
+	opts.Databases = databases
+	return NewCacheWithOptions(opts, nil)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tailor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func testSnapshot() *snapshot {
+	return &snapshot{Databases: []map[string]Item{
+		{
+			"string": {Data: "v", Expiration: -1},
+			"bytes":  {Data: []byte{0, 1, 2}, Expiration: -1},
+			"int":    {Data: 42, Expiration: -1},
+			"int8":   {Data: int8(-8), Expiration: -1},
+			"uint64": {Data: uint64(1) << 63, Expiration: -1},
+			"float":  {Data: 1.5, Expiration: -1},
+			"bool":   {Data: true, Expiration: -1},
+			"nil":    {Data: nil, Expiration: -1},
+			"tagged": {Data: "t", Expiration: time.Now().Add(time.Hour).UnixNano(), Tags: []string{"a", "b"}},
+		},
+		{},
+		{"db2": {Data: "v2", Expiration: -1, SoftExpiration: 7, Delta: 3}},
+	}}
+}
+
+// sealSnapshot writes the header of version with keys before body,
+// and the checksum after it.
+func sealSnapshot(version uint16, keys int, body []byte) []byte {
+	w := &snapshotWriter{}
+	w.buf.Write(snapshotMagic)
+	w.u16(version)
+	w.u64(uint64(time.Now().UnixNano()))
+	w.u64(uint64(keys))
+	w.buf.Write(body)
+	w.u32(crc32.ChecksumIEEE(w.buf.Bytes()))
+	return w.buf.Bytes()
+}
+
+func gobItems(t *testing.T, items map[string]Item) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(items); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	want := testSnapshot()
+	data, err := encodeSnapshot(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := binary.BigEndian.Uint16(data[len(snapshotMagic):]); version != snapshotVersion {
+		t.Fatalf("version %d", version)
+	}
+	got, err := decodeSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a database without keys has no section, but is still counted
+	if len(got.Databases) != len(want.Databases) {
+		t.Fatalf("%d databases, want %d", len(got.Databases), len(want.Databases))
+	}
+	for i := range want.Databases {
+		for key, item := range want.Databases[i] {
+			if !reflect.DeepEqual(got.Databases[i][key], item) {
+				t.Errorf("db %d %s = %+v, want %+v", i, key, got.Databases[i][key], item)
+			}
+		}
+		if len(got.Databases[i]) != len(want.Databases[i]) {
+			t.Errorf("db %d has %d keys, want %d", i, len(got.Databases[i]), len(want.Databases[i]))
+		}
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	good, err := encodeSnapshot(testSnapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := good[snapshotHeader : len(good)-4]
+	keys := testSnapshot().keys()
+	for _, tc := range []struct {
+		name string
+		data func() []byte
+		err  string
+	}{
+		{"flipped byte", func() []byte {
+			data := append([]byte(nil), good...)
+			data[snapshotHeader+3] ^= 1
+			return data
+		}, "checksum does not match"},
+		{"flipped checksum", func() []byte {
+			data := append([]byte(nil), good...)
+			data[len(data)-1] ^= 1
+			return data
+		}, "checksum does not match"},
+		{"cut off", func() []byte {
+			return good[:len(good)-10]
+		}, "checksum does not match"},
+		{"header only", func() []byte {
+			return good[:snapshotHeader]
+		}, "truncated"},
+		{"wrong key count", func() []byte {
+			return sealSnapshot(snapshotVersion, keys+1, body)
+		}, "header says"},
+		{"future version", func() []byte {
+			return sealSnapshot(snapshotVersion+1, keys, body)
+		}, "not supported"},
+		{"body cut off", func() []byte {
+			return sealSnapshot(snapshotVersion, keys, body[:len(body)/2])
+		}, "truncated"},
+	} {
+		if _, err := decodeSnapshot(tc.data()); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want one with %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestSnapshotMigration(t *testing.T) {
+	snap := &snapshot{Databases: []map[string]Item{
+		{"a": {Data: "0a", Expiration: -1}},
+		{"a": {Data: "1a", Expiration: -1}},
+	}}
+	// writeFiles writes the files of one cache each, which the versions
+	// before the format version 2 saved, encoded by encode
+	writeFiles := func(t *testing.T, filename string, dbs int, encode func(map[string]Item) []byte) {
+		for i := 0; i < dbs; i++ {
+			for _, suffix := range []string{"ne", "ex"} {
+				items := snap.Databases[i]
+				if suffix == "ex" {
+					items = map[string]Item{}
+				}
+				if err := ioutil.WriteFile(dbFilename(filename, i)+suffix, encode(items), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		// write writes the old files of snap into filename
+		write func(t *testing.T, filename string)
+		// the databases it keeps
+		dbs int
+	}{
+		{"version 1", func(t *testing.T, filename string) {
+			writeFiles(t, filename, 2, func(items map[string]Item) []byte {
+				return sealSnapshot(1, len(items), gobItems(t, items))
+			})
+		}, 2},
+		{"no header", func(t *testing.T, filename string) {
+			writeFiles(t, filename, 2, func(items map[string]Item) []byte {
+				return gobItems(t, items)
+			})
+		}, 2},
+		{"one database", func(t *testing.T, filename string) {
+			writeFiles(t, filename, 1, func(items map[string]Item) []byte {
+				return gobItems(t, items)
+			})
+		}, 1},
+		{"no ex file", func(t *testing.T, filename string) {
+			data := sealSnapshot(1, 1, gobItems(t, snap.Databases[0]))
+			if err := ioutil.WriteFile(filename+"ne", data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(tempDir(t), "dump.tkv")
+			tc.write(t, filename)
+			c := newTestCache(time.Minute, 2)
+			defer c.Close()
+			if err := c.Load(filename); err != nil {
+				t.Fatal(err)
+			}
+			// the next save writes the current version
+			if err := c.SaveFile(filename); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version := binary.BigEndian.Uint16(data[len(snapshotMagic):]); version != snapshotVersion {
+				t.Fatalf("saved version %d", version)
+			}
+
+			loaded := newTestCache(time.Minute, 2)
+			defer loaded.Close()
+			if err := loaded.Load(filename); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				db, _ := loaded.Select(i)
+				v, found := db.Get("a")
+				if want := i < tc.dbs; found != want || (found && v != snap.Databases[i]["a"].Data) {
+					t.Errorf("db %d a = %v, %v", i, v, found)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadMoreDatabases(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// the databases of the snapshot which have keys
+		full  []int
+		fails bool
+	}{
+		{"extra databases are empty", []int{0, 1}, false},
+		{"an extra database has keys", []int{0, 15}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(tempDir(t), "dump.tkv")
+			saved := newTestCache(time.Minute, 16)
+			for _, i := range tc.full {
+				db, _ := saved.Select(i)
+				db.Set("k", i)
+			}
+			saved.WaitWrites()
+			if err := saved.SaveFile(filename); err != nil {
+				t.Fatal(err)
+			}
+			saved.Close()
+
+			c := newTestCache(time.Minute, 2)
+			defer c.Close()
+			err := c.Load(filename)
+			if tc.fails {
+				if err == nil {
+					t.Fatal("loaded the keys of a database which is not here")
+				}
+				if _, found := c.Get("k"); found {
+					t.Fatal("loaded database 0 in part")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, i := range tc.full {
+				db, _ := c.Select(i)
+				if v, _ := db.Get("k"); v != i {
+					t.Errorf("db %d k = %v", i, v)
+				}
+			}
+		})
+	}
+}
+
+func TestSaveFilePointInTime(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "dump.tkv")
+	c := newTestCache(time.Minute, 3)
+	defer c.Close()
+	// database 1 is large and keeps the copy busy
+	// between databases 0 and 2 while n is set in both
+	db1, _ := c.Select(1)
+	db2, _ := c.Select(2)
+	for i := 0; i < 50000; i++ {
+		db1.Set(fmt.Sprintf("filler:%d", i), i)
+	}
+	stop := make(chan struct{})
+	writer := make(chan struct{})
+	go func() {
+		defer close(writer)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Set("n", i)
+			db2.Set("n", i)
+		}
+	}()
+	for round := 0; round < 5; round++ {
+		if err := c.SaveFile(filename); err != nil {
+			t.Fatal(err)
+		}
+		loaded := newTestCache(time.Minute, 3)
+		if err := loaded.Load(filename); err != nil {
+			t.Fatal(err)
+		}
+		loaded2, _ := loaded.Select(2)
+		n0, _ := loaded.Get("n")
+		n2, _ := loaded2.Get("n")
+		loaded.Close()
+		if n0 == nil || n2 == nil {
+			continue
+		}
+		// n is set in database 0 first, so it is at most one write ahead
+		if d := n0.(int) - n2.(int); d != 0 && d != 1 {
+			t.Fatalf("the snapshot has n = %v in database 0 and n = %v in database 2", n0, n2)
+		}
+	}
+	close(stop)
+	<-writer
+}
+
+// The JSON documents are updated in place, so a background save must not
+// encode the document of the cache, which the writes after the copy change.
+func TestBgSaveJSONPointInTime(t *testing.T) {
+	filename := filepath.Join(tempDir(t), "dump.tkv")
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	// the fillers keep the encoding busy after the copy
+	for i := 0; i < 50000; i++ {
+		c.Set(fmt.Sprintf("filler:%d", i), i)
+	}
+	if err := c.JSONSet("doc", "$", `{"n":0,"a":[]}`); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	writer := make(chan struct{})
+	go func() {
+		defer close(writer)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			c.Set("n", i)
+			if _, err := c.JSONNumIncrBy("doc", "$.n", "1"); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := c.JSONArrAppend("doc", "$.a", "0"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for round := 0; round < 5; round++ {
+		if err := c.BgSave(filename); err != nil {
+			t.Fatal(err)
+		}
+		for c.SaveStats().InProgress {
+			time.Sleep(time.Millisecond)
+		}
+		loaded := newTestCache(time.Minute, 1)
+		if err := loaded.Load(filename); err != nil {
+			t.Fatal(err)
+		}
+		n, _ := loaded.Get("n")
+		docN, _, err := loaded.JSONGet("doc", "$.n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		arr, _, _ := loaded.JSONGet("doc", "$.a")
+		loaded.Close()
+		if n == nil {
+			n = 0
+		}
+		// the document is updated after n, so it is at most one write behind
+		if docN != strconv.Itoa(n.(int)) && docN != strconv.Itoa(n.(int)-1) {
+			t.Fatalf("the snapshot has n = %v and a document with n = %s", n, docN)
+		}
+		if k := strings.Count(arr, "0"); k > n.(int) || k < n.(int)-1 {
+			t.Fatalf("the snapshot has n = %v and a document with %d elements", n, k)
+		}
+	}
+	close(stop)
+	<-writer
+}
+
+// saveTestSnapshot saves the keys a, b and the expiring e into
+// database 0 and c into database 1, and returns the file.
+func saveTestSnapshot(t *testing.T) string {
+	c := newTestCache(time.Minute, 2)
+	defer c.Close()
+	c.Set("a", "snap")
+	c.Set("b", "snap")
+	c.Setex("e", "snap", 50*time.Millisecond)
+	db1, _ := c.Select(1)
+	db1.Set("c", "snap")
+	filename := filepath.Join(tempDir(t), "dump.tkv")
+	if err := c.SaveFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadModes(t *testing.T) {
+	filename := saveTestSnapshot(t)
+	// e expires after the save, and is not loaded
+	time.Sleep(100 * time.Millisecond)
+	for _, tc := range []struct {
+		mode LoadMode
+		res  LoadResult
+		// the values afterwards, "" if the key does not exist
+		a, x, c string
+	}{
+		{LoadKeep, LoadResult{Loaded: 2, Skipped: 1, Expired: 1}, "cache", "cache", "snap"},
+		{LoadOverwrite, LoadResult{Loaded: 3, Expired: 1}, "snap", "cache", "snap"},
+		{LoadReplace, LoadResult{Loaded: 3, Expired: 1}, "snap", "", "snap"},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			c := newTestCache(time.Minute, 2)
+			defer c.Close()
+			c.Set("a", "cache")
+			c.Set("x", "cache")
+			res, err := c.LoadWithMode(filename, tc.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != tc.res {
+				t.Errorf("result %+v, want %+v", res, tc.res)
+			}
+			db1, _ := c.Select(1)
+			for _, kv := range []struct {
+				c         *Cache
+				key, want string
+			}{{c, "a", tc.a}, {c, "x", tc.x}, {db1, "c", tc.c}, {c, "b", "snap"}, {c, "e", ""}} {
+				v, found := kv.c.Get(kv.key)
+				if found != (kv.want != "") || (found && v != kv.want) {
+					t.Errorf("%s = %v, %v, want %q", kv.key, v, found, kv.want)
+				}
+			}
+		})
+	}
+}
+
+// The keys which a replace removes must not come back
+// from the store by read fallback.
+func TestLoadReplaceStore(t *testing.T) {
+	filename := saveTestSnapshot(t)
+	for _, mode := range []WriteMode{WriteThrough, WriteBehind} {
+		c := newTestCache(time.Minute, 2)
+		store := newTestStore()
+		opts := DefaultStoreOptions()
+		opts.Mode = mode
+		opts.ReadFallback = true
+		if err := c.AttachStore(store, opts); err != nil {
+			t.Fatal(err)
+		}
+		c.Set("a", "cache")
+		c.Set("x", "cache")
+		if _, err := c.LoadWithMode(filename, LoadReplace); err != nil {
+			t.Fatal(err)
+		}
+		// the store is flushed by Close
+		c.Close()
+		if _, found := store.get("x"); found {
+			t.Errorf("mode %d: x is still in the store", mode)
+		}
+		for _, key := range []string{"a", "b"} {
+			if v, _ := store.get(key); v != "snap" {
+				t.Errorf("mode %d: store has %s = %v, want snap", mode, key, v)
+			}
+		}
+	}
+
+	c := newTestCache(time.Minute, 2)
+	defer c.Close()
+	store := newTestStore()
+	opts := DefaultStoreOptions()
+	opts.ReadFallback = true
+	if err := c.AttachStore(store, opts); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("x", "cache")
+	if _, err := c.LoadWithMode(filename, LoadReplace); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitWrites()
+	if v, found := c.Get("x"); found {
+		t.Fatalf("x came back as %v", v)
+	}
+}
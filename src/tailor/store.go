@@ -0,0 +1,492 @@
+package tailor
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Store is a backing store the writes of the cache are propagated to.
+// Its methods are called by one goroutine at a time.
+type Store interface {
+	Get(key string) (val interface{}, found bool, err error)
+	Put(key string, val interface{}) error
+	Delete(key string) error
+}
+
+type WriteMode byte
+
+const (
+	// writes reach the store before the write op returns, the ops
+	// which return an error return the one of the store
+	WriteThrough WriteMode = iota
+	// writes are batched, coalesced and flushed in the background
+	WriteBehind
+)
+
+type StoreOptions struct {
+	Mode WriteMode
+	// load a missed key of Get from the store
+	ReadFallback bool
+	// write-behind only: how often the pending writes are flushed,
+	// and how many pending keys trigger a flush at once.
+	FlushInterval time.Duration
+	BatchSize     int
+	// retries of a failed write, each one waits RetryBackoff
+	// longer than the previous one. The writes are retried by the
+	// store writer, the other ops of the cache go on meanwhile.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// OnError is called with the writes which failed after all retries
+	OnError func(key string, err error)
+}
+
+func DefaultStoreOptions() StoreOptions {
+	return StoreOptions{
+		Mode:          WriteThrough,
+		FlushInterval: time.Second,
+		BatchSize:     1024,
+		MaxRetries:    3,
+		RetryBackoff:  100 * time.Millisecond,
+	}
+}
+
+type StoreStats struct {
+	Puts    uint64 `json:"puts"`
+	Deletes uint64 `json:"deletes"`
+	Fails   uint64 `json:"fails"`
+	// keys waiting to be flushed, write-behind only
+	Pending int `json:"pending"`
+}
+
+// backing propagates the writes of the cache to a Store.
+type backing struct {
+	store Store
+	opts  StoreOptions
+	c     *Cache
+
+	puts    uint64
+	deletes uint64
+	fails   uint64
+	// serializes the calls of the store
+	callMu sync.Mutex
+
+	// write-behind only, dirty maps the pending keys to
+	// true for a put and false for a delete.
+	mu    sync.Mutex
+	dirty map[string]bool
+	// the keys being written to the store, which is behind
+	// the cache until they are written
+	inflight map[string]int
+	// the keys loaded from the store by the read fallback
+	fills   map[string]*storeFill
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	// write-through only, the writes in order, which the
+	// store writer takes off the serial write path
+	queue  []storeWrite
+	closed bool
+}
+
+// storeFill is a load of a missed key from the store. It is stale once
+// a write of the key reaches the serial write path, as the loaded value
+// may be older than the write then.
+type storeFill struct {
+	b     *backing
+	stale bool
+	// the misses which loaded the key meanwhile
+	refs int
+}
+
+type fillArgs struct {
+	val  interface{}
+	fill *storeFill
+}
+
+// storeWrite is the keys written by a job, the job is
+// finished once all of them are stored.
+type storeWrite struct {
+	keys []string
+	puts []bool
+	j    *job
+}
+
+func newBacking(c *Cache, store Store, opts StoreOptions) (*backing, error) {
+	if store == nil {
+		return nil, fmt.Errorf("store must not be nil")
+	}
+	if opts.Mode == WriteBehind && (opts.FlushInterval <= 0 || opts.BatchSize <= 0) {
+		return nil, fmt.Errorf("write-behind needs a flush interval and a batch size")
+	}
+	b := &backing{
+		store:    store,
+		opts:     opts,
+		c:        c,
+		inflight: make(map[string]int),
+		fills:    make(map[string]*storeFill),
+	}
+	b.trigger = make(chan struct{}, 1)
+	b.done = make(chan struct{})
+	if opts.Mode == WriteBehind {
+		b.dirty = make(map[string]bool)
+		b.stop = make(chan struct{})
+		go b.flushLoop()
+	} else {
+		go b.writeLoop()
+	}
+	return b, nil
+}
+
+// written is called by the serial write path of the executor with the
+// keys whose values j changed or removed. With write-through, the store
+// writer finishes j once they are stored, j is nil if nothing waits.
+func (b *backing) written(j *job, keys []string) {
+	puts := make([]bool, len(keys))
+	for i, key := range keys {
+		_, puts[i] = b.c.get(key)
+	}
+	b.mu.Lock()
+	for _, key := range keys {
+		if f, found := b.fills[key]; found {
+			f.stale = true
+			delete(b.fills, key)
+		}
+	}
+	b.mu.Unlock()
+	if b.opts.Mode == WriteThrough {
+		if j != nil && j.done == nil {
+			j = nil
+		}
+		if j == nil && len(keys) == 0 {
+			return
+		}
+		b.mu.Lock()
+		if !b.closed {
+			b.queue = append(b.queue, storeWrite{keys: keys, puts: puts, j: j})
+			for _, key := range keys {
+				b.inflight[key]++
+			}
+			if j != nil {
+				j.stored = true
+			}
+		}
+		b.mu.Unlock()
+		b.signal()
+		return
+	}
+	b.mu.Lock()
+	for i, key := range keys {
+		b.dirty[key] = puts[i]
+	}
+	full := len(b.dirty) >= b.opts.BatchSize
+	b.mu.Unlock()
+	if full {
+		b.signal()
+	}
+}
+
+func (b *backing) signal() {
+	select {
+	case b.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// writeLoop writes the queue of write-through in order, until
+// it is closed and empty.
+func (b *backing) writeLoop() {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		batch, closed := b.queue, b.closed
+		b.queue = nil
+		b.mu.Unlock()
+		if len(batch) == 0 {
+			if closed {
+				return
+			}
+			<-b.trigger
+			continue
+		}
+		for _, w := range batch {
+			var err error
+			for i, key := range w.keys {
+				if putErr := b.write(key, w.puts[i]); err == nil {
+					err = putErr
+				}
+				b.finished(key)
+			}
+			if w.j != nil {
+				if w.j.res.err == nil {
+					w.j.res.err = err
+				}
+				close(w.j.done)
+			}
+		}
+	}
+}
+
+// write puts the current value of key, or deletes key if put is false.
+// A key which has expired from the cache meanwhile is left as it is.
+func (b *backing) write(key string, put bool) error {
+	var err error
+	backoff := b.opts.RetryBackoff
+	for i := 0; ; i++ {
+		if put {
+			val, found := b.c.get(key)
+			if !found {
+				return nil
+			}
+			b.callMu.Lock()
+			err = b.store.Put(key, val)
+			b.callMu.Unlock()
+		} else {
+			b.callMu.Lock()
+			err = b.store.Delete(key)
+			b.callMu.Unlock()
+		}
+		if err == nil || i >= b.opts.MaxRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff += b.opts.RetryBackoff
+	}
+	if err != nil {
+		atomic.AddUint64(&b.fails, 1)
+		if b.opts.OnError != nil {
+			b.opts.OnError(key, err)
+		}
+		return err
+	}
+	if put {
+		atomic.AddUint64(&b.puts, 1)
+	} else {
+		atomic.AddUint64(&b.deletes, 1)
+	}
+	return nil
+}
+
+// finished is called once a write of key is done with, stored or not.
+func (b *backing) finished(key string) {
+	b.mu.Lock()
+	if b.inflight[key]--; b.inflight[key] <= 0 {
+		delete(b.inflight, key)
+	}
+	b.mu.Unlock()
+}
+
+func (b *backing) flushLoop() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush(true)
+		case <-b.trigger:
+			b.flush(true)
+		case <-b.stop:
+			b.flush(false)
+			return
+		}
+	}
+}
+
+// flush writes the pending keys, the keys which failed are
+// kept for the next flush unless the backing is closing.
+func (b *backing) flush(keepFailed bool) {
+	b.mu.Lock()
+	batch := b.dirty
+	b.dirty = make(map[string]bool)
+	for key := range batch {
+		b.inflight[key]++
+	}
+	b.mu.Unlock()
+	for key, put := range batch {
+		err := b.write(key, put)
+		b.mu.Lock()
+		// a newer write of key wins over the failed one
+		if _, found := b.dirty[key]; err != nil && keepFailed && !found {
+			b.dirty[key] = put
+		}
+		b.mu.Unlock()
+		b.finished(key)
+	}
+}
+
+func (b *backing) load(key string) (interface{}, bool, error) {
+	b.callMu.Lock()
+	defer b.callMu.Unlock()
+	return b.store.Get(key)
+}
+
+// close flushes the pending writes of write-behind,
+// and writes the queue of write-through.
+func (b *backing) close() {
+	if b.opts.Mode == WriteBehind {
+		close(b.stop)
+	} else {
+		b.mu.Lock()
+		b.closed = true
+		b.mu.Unlock()
+		b.signal()
+	}
+	<-b.done
+}
+
+func (b *backing) stats() StoreStats {
+	stats := StoreStats{
+		Puts:    atomic.LoadUint64(&b.puts),
+		Deletes: atomic.LoadUint64(&b.deletes),
+		Fails:   atomic.LoadUint64(&b.fails),
+	}
+	if b.opts.Mode == WriteBehind {
+		b.mu.Lock()
+		stats.Pending = len(b.dirty)
+		b.mu.Unlock()
+	}
+	return stats
+}
+
+// pending reports whether a write of key is waiting
+// to be flushed or is being written.
+func (b *backing) pending(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, found := b.dirty[key]
+	return found || b.inflight[key] > 0
+}
+
+// beginFill is called before key is loaded from the store, so that
+// the writes of key reaching the serial write path from then on make
+// the loaded value stale.
+func (b *backing) beginFill(key string) *storeFill {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, found := b.fills[key]
+	if !found {
+		f = &storeFill{b: b}
+		b.fills[key] = f
+	}
+	f.refs++
+	return f
+}
+
+// endFill reports whether the value loaded by f may be set.
+func (b *backing) endFill(key string, f *storeFill) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if f.stale || f.b != b {
+		return false
+	}
+	if f.refs--; f.refs == 0 {
+		delete(b.fills, key)
+	}
+	return true
+}
+
+func (c *Cache) attachedStore() *backing {
+	c.storeMu.RLock()
+	defer c.storeMu.RUnlock()
+	return c.backing
+}
+
+// written tells the append-only file, the auto save and the attached
+// store about the changed keys.
+func (c *Cache) written(j *job, keys ...string) {
+	if len(keys) > 0 {
+		c.aof.logKeys(c.database, keys)
+		c.saves.changed(len(keys))
+	}
+	if b := c.attachedStore(); b != nil {
+		b.written(j, keys)
+	}
+}
+
+// writtenAs is written for a write of one key which the
+// append-only file logs as rec rather than as the state of the key.
+func (c *Cache) writtenAs(j *job, rec aofRecord) {
+	rec.DB = c.index
+	c.aof.log(rec)
+	c.saves.changed(1)
+	if b := c.attachedStore(); b != nil {
+		b.written(j, []string{rec.Key})
+	}
+}
+
+// storedKeys returns the keys of the database if a store is attached
+// to it, for bulkWritten once a flush, a swap or a load changed them.
+func (c *Cache) storedKeys() []string {
+	if c.attachedStore() == nil {
+		return nil
+	}
+	return c.keyList()
+}
+
+// bulkWritten tells the attached store about the keys which the serial
+// write path changed at once, without waiting for them to be stored.
+// The keys which are gone from the database are deleted from the store.
+func (c *Cache) bulkWritten(keys []string) {
+	if b := c.attachedStore(); b != nil && len(keys) > 0 {
+		b.written(nil, keys)
+	}
+}
+
+// storesThrough reports whether a write-through store is attached.
+func (c *Cache) storesThrough() bool {
+	b := c.attachedStore()
+	return b != nil && b.opts.Mode == WriteThrough
+}
+
+// loadFromStore loads a missed key if read fallback is enabled.
+// A key with a pending write is not loaded, as the store is behind.
+// The loaded value is set by the serial write path unless the key
+// was written meanwhile, which the store may not have seen when it
+// was read.
+func (c *Cache) loadFromStore(key string) (interface{}, bool) {
+	b := c.attachedStore()
+	if b == nil || !b.opts.ReadFallback {
+		return nil, false
+	}
+	f := b.beginFill(key)
+	if b.pending(key) {
+		b.endFill(key, f)
+		return nil, false
+	}
+	val, found, err := b.load(key)
+	if err != nil {
+		atomic.AddUint64(&b.fails, 1)
+		if b.opts.OnError != nil {
+			b.opts.OnError(key, err)
+		}
+	}
+	if err != nil || !found {
+		b.endFill(key, f)
+		return nil, false
+	}
+	newJob := &job{
+		op:   fill,
+		key:  key,
+		val:  fillArgs{val, f},
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+	if !newJob.res.ok {
+		// the value set meanwhile is the one to return
+		return c.get(key)
+	}
+	return val, true
+}
+
+// fill sets the value loaded by loadFromStore,
+// unless the key was written since it was loaded.
+func (c *Cache) fill(key string, args fillArgs) bool {
+	b := c.attachedStore()
+	if b == nil || !b.endFill(key, args.fill) {
+		return false
+	}
+	return c.setnx(key, args.val)
+}
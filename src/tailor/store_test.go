@@ -0,0 +1,388 @@
+package tailor
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testStore struct {
+	mu   sync.Mutex
+	vals map[string]interface{}
+	fail bool
+	// the next puts which fail
+	failPuts int
+	// the puts of each key which succeeded
+	puts map[string]int
+	// called by Get before it reads the key
+	onGet func(key string)
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		vals: make(map[string]interface{}),
+		puts: make(map[string]int),
+	}
+}
+
+func (s *testStore) Get(key string) (interface{}, bool, error) {
+	if s.onGet != nil {
+		s.onGet(key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, found := s.vals[key]
+	return val, found, nil
+}
+
+func (s *testStore) Put(key string, val interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("store is down")
+	}
+	if s.failPuts > 0 {
+		s.failPuts--
+		return errors.New("store is down")
+	}
+	s.vals[key] = val
+	s.puts[key]++
+	return nil
+}
+
+func (s *testStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("store is down")
+	}
+	delete(s.vals, key)
+	return nil
+}
+
+func (s *testStore) get(key string) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, found := s.vals[key]
+	return val, found
+}
+
+func (s *testStore) putsOf(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts[key]
+}
+
+func (s *testStore) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+func TestWriteThroughStoresBeforeReturn(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	store := newTestStore()
+	if err := c.AttachStore(store, DefaultStoreOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set("k", i)
+		if val, _ := store.get("k"); val != i {
+			t.Fatalf("store has %v after Set(%d) returned", val, i)
+		}
+	}
+	c.Del("k")
+	if _, found := store.get("k"); found {
+		t.Fatal("store has k after Del returned")
+	}
+}
+
+func TestWriteThroughError(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	store := newTestStore()
+	store.fail = true
+	opts := DefaultStoreOptions()
+	opts.MaxRetries = 2
+	opts.RetryBackoff = 200 * time.Millisecond
+	if err := c.AttachStore(store, opts); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("other", "v")
+	c.Set("n", "1")
+
+	done := make(chan error)
+	go func() {
+		done <- c.SetSync("k", "v")
+	}()
+	// the reads go on while the store writer retries
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if v, _ := c.Get("other"); v != "v" {
+		t.Fatalf("other = %v", v)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Get took %v during the retries", elapsed)
+	}
+	if err := <-done; err == nil {
+		t.Fatal("SetSync returned no error")
+	}
+	if err := c.Incr("n"); err == nil || err.Error() != "store is down" {
+		t.Fatalf("Incr returned %v", err)
+	}
+}
+
+func writeBehindOptions() StoreOptions {
+	opts := DefaultStoreOptions()
+	opts.Mode = WriteBehind
+	opts.FlushInterval = time.Hour
+	opts.RetryBackoff = time.Millisecond
+	return opts
+}
+
+func TestWriteBehindBatch(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	store := newTestStore()
+	opts := writeBehindOptions()
+	opts.BatchSize = 3
+	if err := c.AttachStore(store, opts); err != nil {
+		t.Fatal(err)
+	}
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.WaitWrites()
+	if _, found := store.get("a"); found {
+		t.Fatal("a was stored before the batch was full")
+	}
+	if n := c.Stats().Store.Pending; n != 2 {
+		t.Errorf("%d keys pending, want 2", n)
+	}
+	c.Set("c", 3)
+	waitFor(t, "the batch", func() bool {
+		_, found := store.get("c")
+		return found
+	})
+	for key, want := range map[string]int{"a": 1, "b": 2, "c": 3} {
+		if val, _ := store.get(key); val != want {
+			t.Errorf("store has %s = %v, want %d", key, val, want)
+		}
+	}
+}
+
+// The writes of a key pending meanwhile are flushed once, as the last one,
+// and the flush on Close writes the pending keys before it returns.
+func TestWriteBehindCoalesceAndClose(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	store := newTestStore()
+	if err := c.AttachStore(store, writeBehindOptions()); err != nil {
+		t.Fatal(err)
+	}
+	store.vals["gone"] = "old"
+	for i := 0; i < 100; i++ {
+		c.Set("k", i)
+	}
+	c.Set("gone", "v")
+	c.Del("gone")
+	c.WaitWrites()
+	if n := c.Stats().Store.Pending; n != 2 {
+		t.Errorf("%d keys pending, want 2", n)
+	}
+	c.Close()
+	if val, _ := store.get("k"); val != 99 {
+		t.Errorf("store has k = %v, want 99", val)
+	}
+	if n := store.putsOf("k"); n != 1 {
+		t.Errorf("k was put %d times, want once", n)
+	}
+	if _, found := store.get("gone"); found || store.putsOf("gone") != 0 {
+		t.Error("the deleted key was stored")
+	}
+}
+
+func TestStoreRetry(t *testing.T) {
+	t.Run("write-through", func(t *testing.T) {
+		c := newTestCache(time.Minute, 1)
+		defer c.Close()
+		store := newTestStore()
+		store.failPuts = 2
+		opts := DefaultStoreOptions()
+		opts.RetryBackoff = time.Millisecond
+		if err := c.AttachStore(store, opts); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.SetSync("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if val, _ := store.get("k"); val != "v" {
+			t.Errorf("store has %v", val)
+		}
+		if stats := c.Stats().Store; stats.Fails != 0 || stats.Puts != 1 {
+			t.Errorf("stats = %+v", stats)
+		}
+	})
+
+	t.Run("write-behind", func(t *testing.T) {
+		c := newTestCache(time.Minute, 1)
+		defer c.Close()
+		store := newTestStore()
+		store.setFail(true)
+		var failed int32
+		opts := writeBehindOptions()
+		opts.FlushInterval = 5 * time.Millisecond
+		opts.MaxRetries = 1
+		opts.OnError = func(key string, err error) {
+			atomic.AddInt32(&failed, 1)
+		}
+		if err := c.AttachStore(store, opts); err != nil {
+			t.Fatal(err)
+		}
+		c.Set("k", "v")
+		// the failed write is kept for the next flush
+		waitFor(t, "a failed flush", func() bool {
+			return atomic.LoadInt32(&failed) > 0
+		})
+		if n := c.Stats().Store.Pending; n != 1 {
+			t.Errorf("%d keys pending after the failure, want 1", n)
+		}
+		store.setFail(false)
+		waitFor(t, "the retried flush", func() bool {
+			val, _ := store.get("k")
+			return val == "v"
+		})
+		if n := c.Stats().Store.Pending; n != 0 {
+			t.Errorf("%d keys pending", n)
+		}
+	})
+}
+
+// A miss loads the key from the store, unless a write of the key reaches
+// the cache while the store is read, as the store may be behind it.
+func TestReadFallbackRacesWrite(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		write func(c *Cache)
+		want  interface{}
+	}{
+		{"set", func(c *Cache) { c.Set("k", "new") }, "new"},
+		{"del", func(c *Cache) { c.Del("k") }, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache(time.Minute, 1)
+			defer c.Close()
+			store := newTestStore()
+			store.vals["k"] = "old"
+			opts := DefaultStoreOptions()
+			opts.ReadFallback = true
+			if err := c.AttachStore(store, opts); err != nil {
+				t.Fatal(err)
+			}
+			b := c.attachedStore()
+			written := make(chan struct{})
+			store.onGet = func(key string) {
+				store.onGet = nil
+				go func() {
+					tt.write(c)
+					close(written)
+				}()
+				// the write has reached the serial write path once
+				// it made the load stale, the store is still behind
+				waitFor(t, "the write", func() bool {
+					b.mu.Lock()
+					defer b.mu.Unlock()
+					_, loading := b.fills[key]
+					return !loading
+				})
+			}
+			val, _ := c.Get("k")
+			<-written
+			if val != tt.want {
+				t.Errorf("Get = %v, want %v", val, tt.want)
+			}
+			cached, _ := c.Get("k")
+			stored, _ := store.get("k")
+			if cached != tt.want || stored != tt.want {
+				t.Errorf("cache has %v and store %v, want %v", cached, stored, tt.want)
+			}
+		})
+	}
+
+	t.Run("no write", func(t *testing.T) {
+		c := newTestCache(time.Minute, 1)
+		defer c.Close()
+		store := newTestStore()
+		store.vals["k"] = "old"
+		opts := DefaultStoreOptions()
+		opts.ReadFallback = true
+		if err := c.AttachStore(store, opts); err != nil {
+			t.Fatal(err)
+		}
+		if val, found := c.Get("k"); !found || val != "old" {
+			t.Fatalf("Get = %v, %v", val, found)
+		}
+		store.setFail(true)
+		if val, found := c.neCache.get("k"); !found || val != "old" {
+			t.Errorf("the loaded value was not set, cache has %v, %v", val, found)
+		}
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	fs, err := NewFileStore(tempDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("long key ", 100)
+	vals := map[string]interface{}{
+		"s":             "v",
+		"n":             42,
+		"bytes":         []byte{0, 1, 2},
+		"list":          []interface{}{"a", int64(1)},
+		"../a/b\\c\x00": "odd key",
+		"":              "empty key",
+		long:            "long",
+		long + "x":      "longer",
+	}
+	for key, val := range vals {
+		if err := fs.Put(key, val); err != nil {
+			t.Fatalf("Put(%.20q) = %v", key, err)
+		}
+	}
+	for key, want := range vals {
+		val, found, err := fs.Get(key)
+		if err != nil || !found || !reflect.DeepEqual(val, want) {
+			t.Errorf("Get(%.20q) = %v, %v, %v, want %v", key, val, found, err, want)
+		}
+	}
+	if err := fs.Put("s", "w"); err != nil {
+		t.Fatal(err)
+	}
+	if val, _, _ := fs.Get("s"); val != "w" {
+		t.Errorf("s = %v after the overwrite", val)
+	}
+	for _, key := range []string{"s", long, "missing"} {
+		if err := fs.Delete(key); err != nil {
+			t.Errorf("Delete(%.20q) = %v", key, err)
+		}
+		if _, found, err := fs.Get(key); found || err != nil {
+			t.Errorf("Get(%.20q) = %v, %v after Delete", key, found, err)
+		}
+	}
+	if val, _, _ := fs.Get(long + "x"); val != "longer" {
+		t.Errorf("the other long key = %v", val)
+	}
+	// every file is in the dir, none is left of the puts
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(vals)-2 {
+		t.Errorf("%d files, want %d", len(files), len(vals)-2)
+	}
+}
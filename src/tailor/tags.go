@@ -0,0 +1,149 @@
+package tailor
+
+import "time"
+
+// tagIndex maps each tag to the keys of a cache tagged with it,
+// it is guarded by the lock of the cache.
+type tagIndex map[string]map[string]struct{}
+
+func newTagIndex(items map[string]Item) tagIndex {
+	ti := make(tagIndex)
+	for k, v := range items {
+		ti.add(k, v.Tags)
+	}
+	return ti
+}
+
+func (ti tagIndex) add(key string, tags []string) {
+	for _, tag := range tags {
+		keys, found := ti[tag]
+		if !found {
+			keys = make(map[string]struct{})
+			ti[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (ti tagIndex) remove(key string, tags []string) {
+	for _, tag := range tags {
+		keys := ti[tag]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(ti, tag)
+		}
+	}
+}
+
+// tagged returns the keys tagged with any of tags which have not expired,
+// the expired ones are left to the cleaner. The caller must hold the lock.
+func (c *cache) tagged(tags []string) []string {
+	var res []string
+	seen := make(map[string]struct{})
+	for _, tag := range tags {
+		for key := range c.tags[tag] {
+			if c.items[key].Expired() {
+				continue
+			}
+			if _, found := seen[key]; !found {
+				seen[key] = struct{}{}
+				res = append(res, key)
+			}
+		}
+	}
+	return res
+}
+
+// invalidate removes the keys tagged with any of tags.
+func (db *database) invalidate(tags []string) []string {
+	return db.removeAll(func(c *cache) []string {
+		return c.tagged(tags)
+	})
+}
+
+// removeAll removes the keys which match returns for each cache. It holds
+// the locks of both caches meanwhile, so that a reader sees all of them
+// or none.
+func (db *database) removeAll(match func(*cache) []string) []string {
+	caches := []*cache{db.neCache}
+	if db.exCache != db.neCache {
+		caches = append(caches, db.exCache)
+	}
+	for _, c := range caches {
+		c.mu.Lock()
+	}
+	var keys []string
+	removed := make([][]KV, len(caches))
+	for i, c := range caches {
+		for _, key := range match(c) {
+			item, _ := c.removeItem(key)
+			keys = append(keys, key)
+			removed[i] = append(removed[i], KV{key, item.Data})
+		}
+	}
+	for i := len(caches) - 1; i >= 0; i-- {
+		caches[i].mu.Unlock()
+	}
+
+	for i, c := range caches {
+		c.mu.RLock()
+		afterDel := c.afterDel
+		c.mu.RUnlock()
+		for _, kv := range removed[i] {
+			c.notify.notify(EventDeleted, c.db, kv.key, "")
+			if afterDel != nil {
+				afterDel(kv.key, kv.val)
+			}
+		}
+	}
+	return keys
+}
+
+// SetTagged sets the value of key with tags, which Invalidate
+// removes it by. A later write without tags drops them.
+func (c *Cache) SetTagged(key string, val interface{}, tags ...string) {
+	newJob := &job{
+		op:   set,
+		key:  key,
+		val:  val,
+		tags: tags,
+	}
+	_ = c.write(newJob, false)
+}
+
+func (c *Cache) SetexTagged(key string, val interface{}, exp time.Duration, tags ...string) {
+	newJob := &job{
+		op:   setex,
+		key:  key,
+		val:  val,
+		exp:  exp,
+		tags: tags,
+	}
+	_ = c.write(newJob, false)
+}
+
+// Invalidate removes every key tagged with any of tags at once,
+// it returns how many keys were removed.
+func (c *Cache) Invalidate(tags ...string) int {
+	newJob := &job{
+		op:   invalidate,
+		val:  tags,
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return newJob.res.value.(int)
+}
+
+// TaggedKeys returns the keys tagged with tag.
+func (c *Cache) TaggedKeys(tag string) []string {
+	c.neCache.mu.RLock()
+	res := c.neCache.tagged([]string{tag})
+	c.neCache.mu.RUnlock()
+	if c.exCache != c.neCache {
+		c.exCache.mu.RLock()
+		res = append(res, c.exCache.tagged([]string{tag})...)
+		c.exCache.mu.RUnlock()
+	}
+	return res
+}
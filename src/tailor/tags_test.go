@@ -0,0 +1,188 @@
+package tailor
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func taggedKeys(c *Cache, tag string) []string {
+	keys := c.TaggedKeys(tag)
+	sort.Strings(keys)
+	return keys
+}
+
+func TestTagIndex(t *testing.T) {
+	ti := newTagIndex(map[string]Item{
+		"a": {Tags: []string{"x", "y"}},
+		"b": {Tags: []string{"y"}},
+		"c": {},
+	})
+	want := tagIndex{
+		"x": {"a": {}},
+		"y": {"a": {}, "b": {}},
+	}
+	if !reflect.DeepEqual(ti, want) {
+		t.Fatalf("index = %v, want %v", ti, want)
+	}
+	ti.remove("a", []string{"x", "y"})
+	ti.remove("c", []string{"z"})
+	if want = (tagIndex{"y": {"b": {}}}); !reflect.DeepEqual(ti, want) {
+		t.Fatalf("index = %v, want %v", ti, want)
+	}
+	ti.remove("b", []string{"y"})
+	if len(ti) != 0 {
+		t.Errorf("index = %v, want empty", ti)
+	}
+}
+
+// Invalidate removes the tagged keys of both caches, with
+// and without expiration, and leaves the others alone.
+func TestInvalidate(t *testing.T) {
+	c := newTestCache(time.Minute, 1)
+	defer c.Close()
+	sub, err := c.Subscribe(EventDeleted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	c.SetTagged("ne:a", 1, "user:1")
+	c.SetexTagged("ex:a", 2, time.Hour, "user:1", "page")
+	c.SetTagged("ne:b", 3, "user:2")
+	c.SetexTagged("ex:b", 4, time.Hour, "page")
+	c.Set("plain", 5)
+	c.WaitWrites()
+	if got := taggedKeys(c, "user:1"); !reflect.DeepEqual(got, []string{"ex:a", "ne:a"}) {
+		t.Fatalf("TaggedKeys(user:1) = %v", got)
+	}
+
+	if n := c.Invalidate("user:1", "unknown"); n != 2 {
+		t.Errorf("Invalidate(user:1) = %d, want 2", n)
+	}
+	for _, key := range []string{"ne:a", "ex:a"} {
+		if _, found := c.Get(key); found {
+			t.Errorf("%s is left", key)
+		}
+	}
+	deleted := map[string]bool{}
+	for len(deleted) < 2 {
+		select {
+		case ev := <-sub.C:
+			deleted[ev.Key] = true
+		case <-time.After(time.Second):
+			t.Fatalf("deleted events of %v, want ex:a and ne:a", deleted)
+		}
+	}
+	// the other tags of the removed keys are cleaned up
+	if got := taggedKeys(c, "page"); !reflect.DeepEqual(got, []string{"ex:b"}) {
+		t.Errorf("TaggedKeys(page) = %v", got)
+	}
+
+	if n := c.Invalidate("page", "user:2"); n != 2 {
+		t.Errorf("Invalidate(page, user:2) = %d, want 2", n)
+	}
+	if n := c.Invalidate("page"); n != 0 {
+		t.Errorf("Invalidate(page) = %d again", n)
+	}
+	if v, found := c.Get("plain"); !found || v != 5 {
+		t.Errorf("plain = %v, %v", v, found)
+	}
+}
+
+// The tags of a key go away with it, and a write replaces them.
+func TestTagCleanup(t *testing.T) {
+	c := newTestCache(5*time.Millisecond, 1)
+	defer c.Close()
+
+	t.Run("delete", func(t *testing.T) {
+		c.SetTagged("k", 1, "del")
+		c.Del("k")
+		c.WaitWrites()
+		if got := c.TaggedKeys("del"); len(got) != 0 {
+			t.Errorf("TaggedKeys = %v", got)
+		}
+	})
+
+	t.Run("overwrite", func(t *testing.T) {
+		c.SetTagged("k", 1, "old")
+		c.SetTagged("k", 2, "new")
+		c.WaitWrites()
+		if got := c.TaggedKeys("old"); len(got) != 0 {
+			t.Errorf("TaggedKeys(old) = %v", got)
+		}
+		if got := c.TaggedKeys("new"); !reflect.DeepEqual(got, []string{"k"}) {
+			t.Errorf("TaggedKeys(new) = %v", got)
+		}
+		// a write without tags drops them
+		c.Set("k", 3)
+		c.WaitWrites()
+		if got := c.TaggedKeys("new"); len(got) != 0 {
+			t.Errorf("TaggedKeys(new) = %v after an untagged write", got)
+		}
+	})
+
+	t.Run("move between caches", func(t *testing.T) {
+		c.SetTagged("k", 1, "ne")
+		c.SetexTagged("k", 2, time.Hour, "ex")
+		c.WaitWrites()
+		if got := c.TaggedKeys("ne"); len(got) != 0 {
+			t.Errorf("TaggedKeys(ne) = %v", got)
+		}
+		if n := c.Invalidate("ex"); n != 1 {
+			t.Errorf("Invalidate(ex) = %d, want 1", n)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		c.SetexTagged("k", 1, 10*time.Millisecond, "exp")
+		c.WaitWrites()
+		if got := c.TaggedKeys("exp"); len(got) != 1 {
+			t.Fatalf("TaggedKeys = %v", got)
+		}
+		waitFor(t, "the cleaner", func() bool {
+			return len(c.TaggedKeys("exp")) == 0
+		})
+		if n := c.Invalidate("exp"); n != 0 {
+			t.Errorf("Invalidate = %d after the expiry", n)
+		}
+	})
+}
+
+// A key which has expired but is not cleaned up yet is neither
+// returned by TaggedKeys nor counted or deleted by Invalidate.
+func TestTaggedExpired(t *testing.T) {
+	c := newTestCache(time.Hour, 1)
+	defer c.Close()
+	sub, err := c.Subscribe(EventDeleted, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	c.SetexTagged("gone", 1, time.Millisecond, "t")
+	c.SetexTagged("live", 2, time.Hour, "t")
+	c.SetTagged("forever", 3, "t")
+	c.WaitWrites()
+	time.Sleep(5 * time.Millisecond)
+	if got := taggedKeys(c, "t"); !reflect.DeepEqual(got, []string{"forever", "live"}) {
+		t.Errorf("TaggedKeys = %v", got)
+	}
+	if n := c.Invalidate("t"); n != 2 {
+		t.Errorf("Invalidate = %d, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case ev := <-sub.C:
+			if ev.Key == "gone" {
+				t.Error("the expired key was reported deleted")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("no deleted event")
+		}
+	}
+	select {
+	case ev := <-sub.C:
+		t.Errorf("deleted event of %s", ev.Key)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
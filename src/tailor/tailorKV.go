@@ -2,113 +2,277 @@ package tailor
 
 import (
 	"fmt"
+	"math"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Cache is a view of one of the databases, the views of
+// all the databases share the core which serves them.
 type Cache struct {
-	neCache  *cache
-	exCache  *cache
-	watcher  *watcher
+	*core
+	*database
+}
+
+type core struct {
+	dbs      []*database
+	jobs     *jobRegistry
 	cleaner  *cleaner
-	watchMu  sync.Mutex
-	wStopped bool
 	executor *executor
+	lazyFree *lazyFreer
+	notify   *notifier
+	broker   *broker
+	codec    *compressor
+	snapKeys keyring
+	aof      *appendOnlyFile
+	saves    *saver
+	loads    loadCounter
+	closing  sync.Once
+}
+
+type CacheOptions struct {
+	// the expiration of the items set without one,
+	// not greater than zero means they never expire
+	DefaultExpiration time.Duration
+	CleanCycle        time.Duration
+	// goroutines which free the unlinked values
+	LazyFreeWorkers int
+	// reads which run at the same time
+	Concurrency uint8
+	// number of databases, at least one
+	Databases int
+}
+
+// DefaultCacheOptions returns the defaults of the server.
+func DefaultCacheOptions() CacheOptions {
+	concurrency := 2 * runtime.NumCPU()
+	if concurrency > math.MaxUint8 {
+		concurrency = math.MaxUint8
+	}
+	return CacheOptions{
+		CleanCycle:      500 * time.Millisecond,
+		LazyFreeWorkers: runtime.NumCPU(),
+		Concurrency:     uint8(concurrency),
+		Databases:       1,
+	}
 }
 
+// NewCache creates one database filled with m and returns its view.
+// unlinkCycle is not used anymore, the unlinked values are freed
+// by one worker as soon as they are unlinked.
+// Deprecated: use NewCacheWithOptions.
 func NewCache(defaultExpiration, cleanCycle, unlinkCycle time.Duration, concurrency uint8, m map[string]Item) *Cache {
-	// if expiry time is not greater than zero, then make it NoExpiration
-	var nec, exc *cache
-	if defaultExpiration <= 0 {
-		nec = newCache(NoExpiration, unlinkCycle, m)
-		exc = newCache(NoExpiration, unlinkCycle, m)
-	} else {
-		exc = newCache(defaultExpiration, unlinkCycle, m)
-		nec = exc
+	return NewCacheWithOptions(CacheOptions{
+		DefaultExpiration: defaultExpiration,
+		CleanCycle:        cleanCycle,
+		LazyFreeWorkers:   1,
+		Concurrency:       concurrency,
+		Databases:         1,
+	}, m)
+}
+
+// NewCacheWithOptions creates the databases of opts and
+// returns the view of database 0, which is filled with m.
+func NewCacheWithOptions(opts CacheOptions, m map[string]Item) *Cache {
+	databases := opts.Databases
+	if databases < 1 {
+		databases = 1
+	}
+	// unlinked values of all caches are freed by the same workers
+	lf := newLazyFreer(opts.LazyFreeWorkers)
+	n := newNotifier()
+	cp := newCompressor()
+
+	dbs := make([]*database, databases)
+	for i := range dbs {
+		dbs[i] = newDatabase(i, opts.DefaultExpiration, lf, n, cp, m)
+		m = nil
 	}
 
 	// clean expired data twice each second
-	cl := defaultCleaner(cleanCycle)
+	cl := defaultCleaner(opts.CleanCycle)
 	C := &Cache{
-		neCache:  nec,
-		exCache:  exc,
-		cleaner:  cl,
-		wStopped: true,
+		core: &core{
+			dbs:      dbs,
+			cleaner:  cl,
+			jobs:     newJobRegistry(),
+			lazyFree: lf,
+			notify:   n,
+			broker:   newBroker(),
+			codec:    cp,
+			saves:    newSaver(),
+		},
+		database: dbs[0],
 	}
-
 	// create a new executor
-	exec := newExecutor(C, concurrency)
+	exec := newExecutor(opts.Concurrency)
 	C.executor = exec
+	C.aof = newAppendOnlyFile(dbs, &C.snapKeys, exec)
 
 	// start the daemon cleaner
-	go cl.run(exc)
+	go cl.run(C.exCaches())
 	// start the executor
 	go exec.server()
 	return C
 }
 
-// thread-safe
-func (c *Cache) ReplaceDaemonOp(wi time.Duration, f func(*Cache)) {
-	if c.watcher != nil {
-		_ = c.StopWatchingSync()
-		c.watcher.interval = wi
-		c.watcher.op = f
-	} else {
-		c.watchMu.Lock()
-		c.watcher = newWatcher(wi, f)
-		c.watchMu.Unlock()
+// AddJob registers a job which runs f on the given schedule and starts it.
+// Jobs run in their own goroutines, the errors they return are kept
+// in their JobInfo and passed to the handler set by SetJobErrHandler.
+func (c *Cache) AddJob(name string, sched Schedule, f func(*Cache) error) error {
+	j, err := c.jobs.add(name, sched, f)
+	if err != nil {
+		return err
+	}
+	return j.start(c)
+}
+
+// RemoveJob stops the job and waits for its running op to return.
+func (c *Cache) RemoveJob(name string) error {
+	j, err := c.jobs.remove(name)
+	if err != nil {
+		return err
+	}
+	if j.isRunning() {
+		return j.stopAndWait()
+	}
+	return nil
+}
+
+func (c *Cache) StartJob(name string) error {
+	j, err := c.jobs.get(name)
+	if err != nil {
+		return err
 	}
+	return j.start(c)
+}
+
+// StopJob waits for the running op of the job to return,
+// so a job must not stop itself with it.
+func (c *Cache) StopJob(name string) error {
+	j, err := c.jobs.get(name)
+	if err != nil {
+		return err
+	}
+	return j.stopAndWait()
+}
+
+func (c *Cache) Jobs() []JobInfo {
+	return c.jobs.list()
+}
+
+// SetJobErrHandler sets the handler of the errors returned by the jobs.
+func (c *Cache) SetJobErrHandler(f func(name string, err error)) {
+	c.jobs.mu.Lock()
+	c.jobs.onErr = f
+	c.jobs.mu.Unlock()
+}
+
+// ReplaceDaemonOp replaces the job named DaemonJob with a stopped
+// job which runs f every wi, use StartWatching to start it.
+// Deprecated: use AddJob.
+func (c *Cache) ReplaceDaemonOp(wi time.Duration, f func(*Cache)) {
+	_ = c.RemoveJob(DaemonJob)
+	_, _ = c.jobs.add(DaemonJob, Every(wi), func(c *Cache) error {
+		f(c)
+		return nil
+	})
 }
 
 // This func may cause blocking when the daemon op is very complicated.
 // Use StopWatchingAsync() if you don't want to get blocked.
+// Deprecated: use StopJob.
 func (c *Cache) StopWatchingSync() error {
-	c.watchMu.Lock()
-	if c.watcher == nil {
-		c.watchMu.Unlock()
-		return fmt.Errorf("there is no daemon watcher")
-	}
-	if c.wStopped {
-		c.watchMu.Unlock()
-		return fmt.Errorf("daemon watcher has stopped")
+	j, err := c.daemonJob()
+	if err != nil {
+		return err
 	}
-	c.watcher.stopAndWait()
-	c.wStopped = true
-	c.watchMu.Unlock()
-	return nil
+	return j.stopAndWait()
 }
 
+// Deprecated: use StopJob.
 func (c *Cache) StopWatchingAsync() error {
-	c.watchMu.Lock()
-	if c.watcher == nil {
-		c.watchMu.Unlock()
-		return fmt.Errorf("there is no daemon watcher")
+	j, err := c.daemonJob()
+	if err != nil {
+		return err
 	}
-	if c.wStopped {
-		c.watchMu.Unlock()
+	if !j.isRunning() {
 		return fmt.Errorf("daemon watcher has stopped")
 	}
 	go func() {
-		c.watcher.stopAndWait()
-		c.wStopped = true
-		c.watchMu.Unlock()
+		_ = j.stopAndWait()
 	}()
 	return nil
 }
 
+// Deprecated: use StartJob.
 func (c *Cache) StartWatching() error {
-	c.watchMu.Lock()
-	defer c.watchMu.Unlock()
-	if c.watcher != nil {
-		if !c.wStopped {
-			return fmt.Errorf("the daemon watcher has started")
-		} else {
-			go c.watcher.run(c)
-		}
+	j, err := c.daemonJob()
+	if err != nil {
+		return err
 	}
-	c.wStopped = false
-	return nil
+	return j.start(c)
+}
+
+func (c *Cache) daemonJob() (*cacheJob, error) {
+	j, err := c.jobs.get(DaemonJob)
+	if err != nil {
+		return nil, fmt.Errorf("there is no daemon watcher")
+	}
+	return j, nil
+}
+
+// SetCleanCycle changes how often the daemon cleaner
+// runs an active expiry cycle, it can be called at any time.
+func (c *Cache) SetCleanCycle(t time.Duration) error {
+	return c.cleaner.setInterval(t)
+}
+
+// SetActiveExpire changes the effort of the active expiry cycle,
+// it can be called at any time.
+func (c *Cache) SetActiveExpire(conf ActiveExpireConf) error {
+	return c.cleaner.setExpireConf(conf)
+}
+
+func (c *Cache) ActiveExpire() ActiveExpireConf {
+	return c.cleaner.expireConf()
+}
+
+// Subscribe starts to deliver the keyspace events of the given types
+// whose key matches the regular expression, an empty expression
+// matches every key. The subscription must be closed when it is
+// no longer used, events are dropped while its channel is full.
+func (c *Cache) Subscribe(types EventType, exp string) (*Subscription, error) {
+	if exp == "" {
+		return c.SubscribePattern(types, nil), nil
+	}
+	p, err := CompilePattern(exp, Regexp)
+	if err != nil {
+		return nil, err
+	}
+	return c.SubscribePattern(types, p), nil
+}
+
+// SubscribePattern is like Subscribe, for the keys matching p,
+// or for every key if p is nil.
+func (c *Cache) SubscribePattern(types EventType, p *Pattern) *Subscription {
+	return c.notify.subscribe(types, c.index, p)
+}
+
+// Publish sends the payload to every subscription of the channel, it
+// returns how many subscriptions received it. Messages are not stored,
+// they are dropped for the subscriptions whose channel is full.
+func (c *Cache) Publish(channel string, payload interface{}) int {
+	return c.broker.publish(channel, payload)
+}
+
+// NewChannelSubscription returns a subscription without any channel,
+// it must be closed when it is no longer used.
+func (c *Cache) NewChannelSubscription() *ChannelSubscription {
+	return c.broker.newSubscription()
 }
 
 func (c *Cache) AddDelHandler(f func(key string, val interface{})) {
@@ -116,10 +280,10 @@ func (c *Cache) AddDelHandler(f func(key string, val interface{})) {
 	c.exCache.addDelHandler(f)
 }
 
-func (c *Cache) set(key string, val interface{}) {
-	c.neCache.set(key, val, DefaultExpiration)
+func (c *Cache) set(key string, val interface{}, tags []string) {
+	c.neCache.set(key, val, DefaultExpiration, tags)
 	if c.exCache != c.neCache {
-		c.exCache.del(key)
+		c.exCache.discard(key)
 	}
 }
 
@@ -132,10 +296,10 @@ func (c *Cache) setnx(key string, val interface{}) bool {
 	return ok
 }
 
-func (c *Cache) setex(key string, val interface{}, t time.Duration) {
-	c.exCache.set(key, val, t)
+func (c *Cache) setex(key string, val interface{}, t time.Duration, tags []string) {
+	c.exCache.set(key, val, t, tags)
 	if c.neCache != c.exCache {
-		c.neCache.del(key)
+		c.neCache.discard(key)
 	}
 }
 
@@ -197,6 +361,27 @@ func (c *Cache) incrby(key string, s string) error {
 	return nil
 }
 
+func (c *Cache) rename(key, newKey string) error {
+	item, found := c.neCache.take(key)
+	if !found && c.exCache != c.neCache {
+		item, found = c.exCache.take(key)
+	}
+	if !found {
+		return fmt.Errorf("key '%s' does not exist", key)
+	}
+	c.neCache.discard(newKey)
+	if c.exCache != c.neCache {
+		c.exCache.discard(newKey)
+	}
+	if item.Expiration < 0 {
+		c.neCache.put(newKey, item)
+	} else {
+		c.exCache.put(newKey, item)
+	}
+	c.notify.notify(EventRenamed, c.index, key, newKey)
+	return nil
+}
+
 func incrErr(key string, info byte) error {
 	switch info {
 	case 1:
@@ -217,74 +402,148 @@ func (c *Cache) ttl(key string) (time.Duration, bool) {
  * functions below is exposed to users.
  */
 
-// Keys get all KVs which match the regular expression.
+// Keys returns the keys matching the regular expression.
 // The result may not contain the KV which was set into
 // the cache recently, as the Set operation is async.
 func (c *Cache) Keys(exp string) ([]KV, error) {
-	var res []KV
-	res, err := c.neCache.keys(exp)
+	p, err := CompilePattern(exp, Regexp)
 	if err != nil {
 		return nil, err
 	}
+	return c.KeysMatching(p), nil
+}
+
+// KeysMatching returns the keys matching p, holding the read lock
+// of each cache meanwhile. Prefer Scan for a large keyspace.
+func (c *Cache) KeysMatching(p *Pattern) []KV {
+	res := c.neCache.keys(p)
 	if c.exCache != c.neCache {
-		exKV, err := c.exCache.keys(exp)
-		if err != nil {
-			return nil, err
-		}
-		res = append(res, exKV...)
+		res = append(res, c.exCache.keys(p)...)
 	}
-	return res, nil
+	return res
 }
 
-// Save param ok must be a chan with length of 2
+// DelMatching deletes the keys matching p at once,
+// it returns how many keys were deleted.
+func (c *Cache) DelMatching(p *Pattern) int {
+	newJob := &job{
+		op:   delmatch,
+		val:  p,
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return newJob.res.value.(int)
+}
+
+func (c *Cache) delMatching(p *Pattern) []string {
+	return c.removeAll(func(ch *cache) []string {
+		return ch.matching(p)
+	})
+}
+
+// Save writes the snapshot file in the background and sends whether
+// it succeeded into ok twice, once for each of the files it used to
+// write, so ok must be a chan with length of 2, or nil.
+// Deprecated: use SaveFile.
 func (c *Cache) Save(filename string, ok chan bool) {
 	go func() {
-		err := c.neCache.saveFile(filename + "ne")
-		if err != nil {
-			ok <- false
+		err := c.SaveFile(filename)
+		if ok != nil {
+			ok <- err == nil
+			ok <- err == nil
 		}
-		ok <- true
 	}()
-	if c.exCache != c.neCache {
-		go func() {
-			err := c.exCache.saveFile(filename + "ex")
-			if err != nil {
-				ok <- false
-			}
-			ok <- true
-		}()
-	} else {
-		ok <- true
-	}
 }
 
+// SaveFile writes all the databases into one snapshot file. The file is
+// written aside and renamed over filename once it is synced, so a crash
+// never leaves a truncated file in place of the last good one.
+func (c *Cache) SaveFile(filename string) error {
+	return c.saves.save(c, filename, false)
+}
+
+// Load adds the keys of the snapshot file to the databases of the same
+// index, the keys which exist already are kept. Nothing is loaded unless
+// the checksum of the whole file matches. The files which the versions
+// before the snapshot format 2 saved, one per cache, are migrated.
 func (c *Cache) Load(filename string) error {
-	err := c.neCache.loadFile(filename + "ne")
-	if err != nil {
-		return err
-	}
-	if c.exCache != c.neCache {
-		err = c.exCache.loadFile(filename + "ex")
-		return err
-	}
-	return nil
+	_, err := c.loadFile(filename, LoadKeep)
+	return err
+}
+
+// LoadWithMode is Load with the mode telling what is done with the keys
+// which exist already. The keys which expired since the snapshot was
+// saved are not loaded. The whole snapshot is applied at once, after
+// the writes queued before it and before the ones queued after it.
+func (c *Cache) LoadWithMode(filename string, mode LoadMode) (LoadResult, error) {
+	return c.loadFile(filename, mode)
 }
 
+// Cls removes every key of all the databases.
+// Deprecated: use FlushAll or FlushDB.
 func (c *Cache) Cls() {
-	c.exCache.cls()
-	if c.neCache != c.exCache {
-		c.neCache.cls()
+	c.FlushAll()
+}
+
+type Stats struct {
+	Keys     int           `json:"keys"`
+	LazyFree LazyFreeStats `json:"lazyFree"`
+	Loads    LoadStats     `json:"loads"`
+	Store    *StoreStats   `json:"store,omitempty"`
+	AOF      *AOFStats     `json:"aof,omitempty"`
+	Saves    SaveStats     `json:"saves"`
+	// set once compression is turned on
+	Compression *CompressionStats `json:"compression,omitempty"`
+	Jobs        []JobInfo         `json:"jobs,omitempty"`
+	// the databases which have keys
+	Databases []DatabaseStats `json:"databases,omitempty"`
+}
+
+func (c *Cache) Stats() Stats {
+	stats := Stats{
+		Keys:     c.Cnt(),
+		LazyFree: c.lazyFree.stats(),
+		Loads:    c.loads.stats(),
+		Saves:    c.saves.stats(),
+		Jobs:     c.Jobs(),
+	}
+	for _, db := range c.dbs {
+		if n := db.cnt(); n > 0 {
+			stats.Databases = append(stats.Databases, DatabaseStats{DB: db.index, Keys: n})
+		}
+	}
+	if b := c.attachedStore(); b != nil {
+		storeStats := b.stats()
+		stats.Store = &storeStats
+	}
+	if aofStats, open := c.aof.stats(); open {
+		stats.AOF = &aofStats
 	}
+	if cs := c.codec.stats(); cs.Threshold > 0 || cs.Compressed > 0 {
+		stats.Compression = &cs
+	}
+	return stats
 }
 
+// Cnt counts the keys of the database of the view.
 func (c *Cache) Cnt() int {
-	// the result contains the expired items
-	// which are not cleaned when the func is called.
-	cnt := c.neCache.cnt()
-	if c.exCache != c.neCache {
-		cnt += c.exCache.cnt()
+	return c.cnt()
+}
+
+// write queues a write which returns before it is applied, unless the
+// writes must be synced before they return, see FsyncAlways, or stored,
+// see WriteThrough. It returns the error of the store then.
+func (c *Cache) write(j *job, wait bool) error {
+	if wait || c.aof.syncsEveryWrite() || c.storesThrough() {
+		j.done = make(chan struct{})
 	}
-	return cnt
+	c.execute(j)
+	if j.done == nil {
+		return nil
+	}
+	<-j.done
+	return j.res.err
 }
 
 func (c *Cache) Set(key string, val interface{}) {
@@ -293,7 +552,7 @@ func (c *Cache) Set(key string, val interface{}) {
 		key: key,
 		val: val,
 	}
-	c.executor.execute(newJob)
+	_ = c.write(newJob, false)
 }
 
 func (c *Cache) Setnx(key string, val interface{}) bool {
@@ -304,7 +563,7 @@ func (c *Cache) Setnx(key string, val interface{}) bool {
 		done: make(chan struct{}),
 		res:  response{},
 	}
-	c.executor.execute(newJob)
+	c.execute(newJob)
 	<-newJob.done
 	return newJob.res.value.(bool)
 }
@@ -316,7 +575,7 @@ func (c *Cache) Setex(key string, val interface{}, exp time.Duration) {
 		val: val,
 		exp: exp,
 	}
-	c.executor.execute(newJob)
+	_ = c.write(newJob, false)
 }
 
 func (c *Cache) Get(key string) (interface{}, bool) {
@@ -326,8 +585,12 @@ func (c *Cache) Get(key string) (interface{}, bool) {
 		done: make(chan struct{}),
 		res:  response{},
 	}
-	c.executor.execute(newJob)
+	c.execute(newJob)
 	<-newJob.done
+	if !newJob.res.ok {
+		return c.loadFromStore(key)
+	}
+	c.revalidate(key)
 	return newJob.res.value, newJob.res.ok
 }
 
@@ -336,7 +599,7 @@ func (c *Cache) Del(key string) {
 		op:  del,
 		key: key,
 	}
-	c.executor.execute(newJob)
+	_ = c.write(newJob, false)
 }
 
 func (c *Cache) Unlink(key string) {
@@ -344,7 +607,29 @@ func (c *Cache) Unlink(key string) {
 		op:  unlink,
 		key: key,
 	}
-	c.executor.execute(newJob)
+	_ = c.write(newJob, false)
+}
+
+// SetSync is SetTagged which returns once the write is applied, and
+// stored if a write-through store is attached. It returns the error
+// of the store.
+func (c *Cache) SetSync(key string, val interface{}, tags ...string) error {
+	return c.write(&job{op: set, key: key, val: val, tags: tags}, true)
+}
+
+// SetexSync is SetexTagged which returns as SetSync does.
+func (c *Cache) SetexSync(key string, val interface{}, exp time.Duration, tags ...string) error {
+	return c.write(&job{op: setex, key: key, val: val, exp: exp, tags: tags}, true)
+}
+
+// DelSync is Del which returns as SetSync does.
+func (c *Cache) DelSync(key string) error {
+	return c.write(&job{op: del, key: key}, true)
+}
+
+// UnlinkSync is Unlink which returns as SetSync does.
+func (c *Cache) UnlinkSync(key string) error {
+	return c.write(&job{op: unlink, key: key}, true)
 }
 
 func (c *Cache) Incr(key string) error {
@@ -354,7 +639,7 @@ func (c *Cache) Incr(key string) error {
 		done: make(chan struct{}),
 		res:  response{},
 	}
-	c.executor.execute(newJob)
+	c.execute(newJob)
 	<-newJob.done
 	return newJob.res.err
 }
@@ -367,7 +652,7 @@ func (c *Cache) Incrby(key, addition string) error {
 		done: make(chan struct{}),
 		res:  response{},
 	}
-	c.executor.execute(newJob)
+	c.execute(newJob)
 	<-newJob.done
 	return newJob.res.err
 }
@@ -379,7 +664,279 @@ func (c *Cache) Ttl(key string) (time.Duration, bool) {
 		done: make(chan struct{}),
 		res:  response{},
 	}
-	c.executor.execute(newJob)
+	c.execute(newJob)
 	<-newJob.done
 	return newJob.res.value.(time.Duration), newJob.res.ok
 }
+
+// Rename moves the value and expiration of key to newKey,
+// newKey is overwritten if it exists.
+func (c *Cache) Rename(key, newKey string) error {
+	newJob := &job{
+		op:   rename,
+		key:  key,
+		val:  newKey,
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return newJob.res.err
+}
+
+// GetOrLoad returns the value of key, on a miss it calls loader and
+// sets the loaded value with ttl, or with the default expiration if
+// ttl is not greater than zero. Concurrent misses of the same key
+// share a single call of loader. If negative caching is enabled by
+// SetNegativeTTL, an error of loader is returned to the misses of
+// key for that long without calling loader again.
+func (c *Cache) GetOrLoad(key string, ttl time.Duration, loader func() (interface{}, error)) (interface{}, error) {
+	if val, found := c.Get(key); found {
+		return val, nil
+	}
+	if err := c.negative.get(key); err != nil {
+		atomic.AddUint64(&c.loads.negativeHits, 1)
+		return nil, err
+	}
+	val, err, shared := c.flights.do(key, func(f *flight) (interface{}, error) {
+		// the key may have been loaded since the miss above
+		if val, found := c.Get(key); found {
+			return val, nil
+		}
+		atomic.AddUint64(&c.loads.loads, 1)
+		val, err := loader()
+		// SwapDB may have moved the key meanwhile
+		view := &Cache{core: c.core, database: f.database()}
+		if err != nil {
+			view.negative.put(key, err)
+			return nil, err
+		}
+		view.negative.del(key)
+		if ttl > 0 {
+			view.Setex(key, val, ttl)
+		} else {
+			view.Set(key, val)
+		}
+		return val, nil
+	})
+	if shared {
+		atomic.AddUint64(&c.loads.coalesced, 1)
+	}
+	return val, err
+}
+
+// AttachStore propagates the writes from now on to store, the store
+// attached before is detached first. It does not copy the existing keys.
+func (c *Cache) AttachStore(store Store, opts StoreOptions) error {
+	b, err := newBacking(c, store, opts)
+	if err != nil {
+		return err
+	}
+	c.DetachStore()
+	c.storeMu.Lock()
+	c.backing = b
+	c.storeMu.Unlock()
+	return nil
+}
+
+// DetachStore flushes the pending writes and detaches the store.
+func (c *Cache) DetachStore() {
+	c.storeMu.Lock()
+	b := c.backing
+	c.backing = nil
+	c.storeMu.Unlock()
+	if b != nil {
+		b.close()
+	}
+}
+
+// Close stops the jobs, the daemon cleaner and the lazy-free workers,
+// flushes the pending writes of the attached store and closes the
+// append-only file. The cache must not be used afterwards.
+func (c *Cache) Close() {
+	c.closing.Do(func() {
+		// the writes queued so far reach the store and the log
+		c.WaitWrites()
+		for _, info := range c.Jobs() {
+			_ = c.StopJob(info.Name)
+		}
+		c.cleaner.stopNow()
+		// the values unlinked so far are freed before it returns
+		c.lazyFree.stop()
+		c.saves.configure(c, "", 0, nil)
+		for _, db := range c.dbs {
+			view := &Cache{core: c.core, database: db}
+			view.DetachStore()
+		}
+		_ = c.aof.close()
+	})
+}
+
+// WaitWrites returns once the writes queued before it are applied, as
+// Set, Setex, Del and Unlink return before theirs are.
+func (c *Cache) WaitWrites() {
+	newJob := &job{
+		op:   barrier,
+		done: make(chan struct{}),
+	}
+	c.execute(newJob)
+	<-newJob.done
+}
+
+// SetNegativeTTL sets how long GetOrLoad keeps the errors of the
+// loaders, negative caching is disabled if t is not greater than zero.
+func (c *Cache) SetNegativeTTL(t time.Duration) {
+	c.negative.setTTL(t)
+}
+
+// LPush inserts vals at the head of the list of key, one after another,
+// the list is created if key does not exist. It returns the new length.
+func (c *Cache) LPush(key string, vals ...interface{}) (int, error) {
+	return c.pushJob(lpush, key, vals)
+}
+
+// RPush appends vals to the tail of the list of key,
+// the list is created if key does not exist. It returns the new length.
+func (c *Cache) RPush(key string, vals ...interface{}) (int, error) {
+	return c.pushJob(rpush, key, vals)
+}
+
+func (c *Cache) pushJob(op byte, key string, vals []interface{}) (int, error) {
+	newJob := &job{
+		op:   op,
+		key:  key,
+		val:  vals,
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+	if newJob.res.err != nil {
+		return 0, newJob.res.err
+	}
+	return newJob.res.value.(int), nil
+}
+
+// LPop removes and returns the head of the list of key,
+// the key is deleted once its list is empty.
+func (c *Cache) LPop(key string) (interface{}, bool, error) {
+	return c.popJob(lpop, key)
+}
+
+// RPop removes and returns the tail of the list of key,
+// the key is deleted once its list is empty.
+func (c *Cache) RPop(key string) (interface{}, bool, error) {
+	return c.popJob(rpop, key)
+}
+
+func (c *Cache) popJob(op byte, key string) (interface{}, bool, error) {
+	newJob := &job{
+		op:   op,
+		key:  key,
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+	return newJob.res.value, newJob.res.ok, newJob.res.err
+}
+
+func (c *Cache) LLen(key string) (int, error) {
+	newJob := &job{
+		op:   llen,
+		key:  key,
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+	if newJob.res.err != nil {
+		return 0, newJob.res.err
+	}
+	return newJob.res.value.(int), nil
+}
+
+// BLPop pops the head of the first non-empty list of keys. If all of
+// them are empty, it blocks until an element is pushed, the timeout
+// expires or cancel is closed, whichever happens first. A timeout
+// which is not greater than zero never expires, and a nil cancel is
+// never closed. Blocked pops of the same list are served in the order
+// they arrived. ok is false if nothing was popped. An element handed
+// over while the pop is cancelled is put back where it was popped,
+// for the next blocked pop.
+func (c *Cache) BLPop(keys []string, timeout time.Duration, cancel <-chan struct{}) (KV, bool, error) {
+	return c.blockingPop(blpop, keys, timeout, cancel)
+}
+
+// BRPop is BLPop which pops the tail of the lists.
+func (c *Cache) BRPop(keys []string, timeout time.Duration, cancel <-chan struct{}) (KV, bool, error) {
+	return c.blockingPop(brpop, keys, timeout, cancel)
+}
+
+func (c *Cache) blockingPop(op byte, keys []string, timeout time.Duration, cancel <-chan struct{}) (KV, bool, error) {
+	newJob := &job{
+		op:   op,
+		val:  keys,
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+	w, blocked := newJob.res.value.(*waiter)
+	if !blocked {
+		kv, _ := newJob.res.value.(KV)
+		return kv, newJob.res.ok, newJob.res.err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	cancelled := false
+	select {
+	case kv := <-w.res:
+		return popped(kv)
+	case <-expired:
+	case <-cancel:
+		cancelled = true
+	}
+	if !w.claim() {
+		// a pusher has claimed w, its element is on the way
+		kv := <-w.res
+		if cancelled && kv != nil {
+			c.requeue(*kv, op == blpop)
+			return KV{}, false, nil
+		}
+		return popped(kv)
+	}
+	c.waits.remove(w)
+	return KV{}, false, nil
+}
+
+type requeueArgs struct {
+	val  interface{}
+	left bool
+}
+
+// requeue pushes kv back to the end of the list it was popped from,
+// the waiters of the list are served again in the order they arrived.
+func (c *Cache) requeue(kv KV, left bool) {
+	newJob := &job{
+		op:   requeue,
+		key:  kv.key,
+		val:  requeueArgs{val: kv.val, left: left},
+		done: make(chan struct{}),
+		res:  response{},
+	}
+	c.execute(newJob)
+	<-newJob.done
+}
+
+func popped(kv *KV) (KV, bool, error) {
+	if kv == nil {
+		return KV{}, false, nil
+	}
+	return *kv, true, nil
+}
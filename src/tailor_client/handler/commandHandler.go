@@ -3,12 +3,17 @@ package handler
 import (
 	"TailorKV/src/protocol"
 	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -28,16 +33,58 @@ const (
 	cls
 	exit
 	quit
+	info
+	rename
+	watch
+	unwatch
+	publish
+	subscribe
+	psubscribe
+	unsubscribe
+	punsubscribe
+	lpush
+	rpush
+	lpop
+	rpop
+	llen
+	blpop
+	brpop
+	selectdb
+	flushdb
+	flushall
+	swapdb
+	invalidate
+	scan
+	delmatch
+	keyrange
+	keyprefix
+	jsonset
+	jsonget
+	jsondel
+	jsonnumincrby
+	jsonarrappend
+	createindex
+	dropindex
+	find
+	indexes
+	bgrewriteaof
+	bgsave
+	lastsave
+	exportkeys
+	importkeys
 )
 
 var errType = []string{"Success", "SyntaxErr", "NotFound", "Existed",
-	"NeSaveFailed", "ExSaveFailed", "LoadFailed"}
+	"NeSaveFailed", "ExSaveFailed", "LoadFailed", "WrongType"}
 
 type Command struct {
-	op  string
-	key string
-	val string
-	exp string
+	op   string
+	key  string
+	val  string
+	exp  string
+	args []string
+	// the patterns are regular expressions instead of globs
+	regexp bool
 }
 
 func HandleConn(conn net.Conn, ipAddr, port *string) {
@@ -102,7 +149,19 @@ func HandleConn(conn net.Conn, ipAddr, port *string) {
 				fmt.Println(err)
 			}
 		case "load":
-			err := handleCommandWithNoResp(conn, load, command, true)
+			err := handleLoad(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "bgsave":
+			handleCommandWithOneParam(conn, bgsave, command)
+		case "lastsave":
+			err := handleLastSave(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "export", "import":
+			err := handleTransfer(conn, command)
 			if err != nil {
 				fmt.Println(err)
 			}
@@ -111,6 +170,108 @@ func HandleConn(conn net.Conn, ipAddr, port *string) {
 			if err != nil {
 				fmt.Println(err)
 			}
+		case "rename":
+			handleCommandWithOneParam(conn, rename, command)
+		case "select":
+			handleCommandWithOneParam(conn, selectdb, command)
+		case "flushdb":
+			handleCommandWithOneParam(conn, flushdb, command)
+		case "flushall":
+			handleCommandWithOneParam(conn, flushall, command)
+		case "swapdb":
+			handleCommandWithOneParam(conn, swapdb, command)
+		case "delmatch":
+			res, err := handleCommandWithResult(conn, delmatch, command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("%s key(s) deleted\n", res)
+		case "range", "prefix":
+			err := handleRange(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "scan":
+			err := handleScan(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "invalidate":
+			res, err := handleCommandWithResult(conn, invalidate, command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("%s key(s) removed\n", res)
+		case "watch":
+			err := handleWatch(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "publish":
+			res, err := handlePublish(conn, command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("received by %s subscriber(s)\n", res)
+		case "subscribe":
+			err := handleSubscribe(conn, subscribe, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "psubscribe":
+			err := handleSubscribe(conn, psubscribe, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "lpush", "rpush", "lpop", "rpop", "llen":
+			res, err := handleCommandWithResult(conn, listOp(command.op), command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(res)
+		case "create":
+			handleCommandWithOneParam(conn, createindex, command)
+		case "drop":
+			handleCommandWithOneParam(conn, dropindex, command)
+		case "find":
+			err := handleFind(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "indexes":
+			err := handleIndexes(conn, command)
+			if err != nil {
+				fmt.Println(err)
+			}
+		case "bgrewriteaof":
+			handleCommandWithOneParam(conn, bgrewriteaof, command)
+		case "json.set":
+			handleCommandWithOneParam(conn, jsonset, command)
+		case "json.get", "json.del", "json.numincrby", "json.arrappend":
+			res, err := handleCommandWithResult(conn, jsonOp(command.op), command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(res)
+		case "blpop", "brpop":
+			res, err := handleBPop(conn, listOp(command.op), command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(res)
+		case "info":
+			res, err := handleInfo(conn, command)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Println(res)
 		case "exit", "quit":
 			_ = handleCommandWithNoResp(conn, exit, command, false)
 			return
@@ -196,6 +357,287 @@ func handleCnt(conn net.Conn, command *Command) (string, error) {
 	return string(count[:n]), nil
 }
 
+func handleInfo(conn net.Conn, command *Command) (string, error) {
+	sendDatagram(conn, info, command)
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return "", err
+	}
+	if msg[0] != 0 {
+		err = printErrMsg(conn)
+		return "", err
+	}
+	buf := make([]byte, 64*1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err = json.Indent(&out, buf[:n], "", "  "); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func handlePublish(conn net.Conn, command *Command) (string, error) {
+	sendDatagram(conn, publish, command)
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return "", err
+	}
+	received := make([]byte, 64)
+	n, err := conn.Read(received)
+	if err != nil {
+		return "", err
+	}
+	return string(received[:n]), nil
+}
+
+// handleCommandWithResult reads a status and, if it is Success, the
+// result prefixed by its length. Other errors come as a message.
+func handleCommandWithResult(conn net.Conn, op byte, command *Command) (string, error) {
+	sendDatagram(conn, op, command)
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return "", err
+	}
+	if int(msg[0]) >= len(errType) {
+		// the first byte of an error message
+		buf := make([]byte, 4096)
+		n, _ := conn.Read(buf)
+		return "", errors.New("errMsg: " + string(msg) + string(buf[:n]))
+	}
+	if msg[0] != 0 {
+		return "", errors.New(errType[msg[0]])
+	}
+	size := make([]byte, 4)
+	if _, err = io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	res := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err = io.ReadFull(conn, res); err != nil {
+		return "", err
+	}
+	return string(res), nil
+}
+
+func handleScan(conn net.Conn, command *Command) error {
+	res, err := handleCommandWithResult(conn, scan, command)
+	if err != nil {
+		return err
+	}
+	var step protocol.ScanDatagram
+	if err = json.Unmarshal([]byte(res), &step); err != nil {
+		return err
+	}
+	for _, k := range step.Keys {
+		fmt.Println(k)
+	}
+	fmt.Println("next cursor: " + step.Cursor)
+	return nil
+}
+
+// handleRange prints the keys streamed by the server as they arrive.
+func handleRange(conn net.Conn, command *Command) error {
+	op := keyrange
+	if command.op == "prefix" {
+		op = keyprefix
+	}
+	// "" is the end of a range without upper bound
+	if command.val == `""` {
+		command.val = ""
+	}
+	sendDatagram(conn, op, command)
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return err
+	}
+	if msg[0] != 0 {
+		return printErrMsg(conn)
+	}
+	reader := bufio.NewReader(conn)
+	cnt := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var batch protocol.RangeDatagram
+		if err = json.Unmarshal(line, &batch); err != nil {
+			return err
+		}
+		for _, k := range batch.Keys {
+			fmt.Println(k)
+		}
+		cnt += len(batch.Keys)
+		if batch.Done {
+			fmt.Printf("(%d keys)\n", cnt)
+			return nil
+		}
+	}
+}
+
+func listOp(op string) byte {
+	switch op {
+	case "lpush":
+		return lpush
+	case "rpush":
+		return rpush
+	case "lpop":
+		return lpop
+	case "rpop":
+		return rpop
+	case "blpop":
+		return blpop
+	case "brpop":
+		return brpop
+	default:
+		return llen
+	}
+}
+
+func handleFind(conn net.Conn, command *Command) error {
+	res, err := handleCommandWithResult(conn, find, command)
+	if err != nil {
+		return err
+	}
+	arr, err := protocol.GetKeys([]byte(res))
+	if err != nil {
+		return err
+	}
+	for _, k := range arr {
+		fmt.Println(k)
+	}
+	fmt.Printf("(%d keys)\n", len(arr))
+	return nil
+}
+
+func handleIndexes(conn net.Conn, command *Command) error {
+	res, err := handleCommandWithResult(conn, indexes, command)
+	if err != nil {
+		return err
+	}
+	var list protocol.IndexesDatagram
+	if err = json.Unmarshal([]byte(res), &list); err != nil {
+		return err
+	}
+	for _, info := range list.Indexes {
+		fmt.Printf("%s ON %s FIELD %s (%d keys)\n", info.Name, info.Prefix, info.Path, info.Keys)
+	}
+	return nil
+}
+
+func handleLoad(conn net.Conn, command *Command) error {
+	res, err := handleCommandWithResult(conn, load, command)
+	if err != nil {
+		return err
+	}
+	var loaded protocol.LoadDatagram
+	if err = json.Unmarshal([]byte(res), &loaded); err != nil {
+		return err
+	}
+	r := loaded.Result
+	fmt.Printf("loaded: %d, skipped: %d, expired: %d\n", r.Loaded, r.Skipped, r.Expired)
+	return nil
+}
+
+func handleTransfer(conn net.Conn, command *Command) error {
+	op, done := exportkeys, "exported"
+	if command.op == "import" {
+		op, done = importkeys, "imported"
+	}
+	sendDatagram(conn, op, command)
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return err
+	}
+	if msg[0] != 0 {
+		if int(msg[0]) < len(errType) {
+			return errors.New(errType[msg[0]])
+		}
+		buf := make([]byte, 4096)
+		n, _ := conn.Read(buf)
+		return errors.New("errMsg: " + string(msg) + string(buf[:n]))
+	}
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var status protocol.ExportDatagram
+		if err = json.Unmarshal(line, &status); err != nil {
+			return err
+		}
+		p := status.Progress
+		if status.Error != "" {
+			return fmt.Errorf("errMsg: %s (%s %d keys before it)", status.Error, done, p.Keys)
+		}
+		if p.Done {
+			fmt.Printf("%s %d keys, skipped %d\n", done, p.Keys, p.Skipped)
+			return nil
+		}
+		fmt.Printf("%d keys...\n", p.Keys)
+	}
+}
+
+func handleLastSave(conn net.Conn, command *Command) error {
+	res, err := handleCommandWithResult(conn, lastsave, command)
+	if err != nil {
+		return err
+	}
+	var status protocol.SaveDatagram
+	if err = json.Unmarshal([]byte(res), &status); err != nil {
+		return err
+	}
+	stats := status.Stats
+	if stats.LastSave == 0 {
+		fmt.Println("last save: never")
+	} else {
+		fmt.Printf("last save: %s (%d ms)\n", time.Unix(stats.LastSave, 0).Format(time.RFC3339), stats.LastSaveMillis)
+	}
+	fmt.Printf("changes since: %d\n", stats.Dirty)
+	if stats.InProgress {
+		fmt.Println("a background save is in progress")
+	}
+	if stats.LastError != "" {
+		fmt.Printf("last save failed: %s\n", stats.LastError)
+	}
+	return nil
+}
+
+func jsonOp(op string) byte {
+	switch op {
+	case "json.set":
+		return jsonset
+	case "json.get":
+		return jsonget
+	case "json.del":
+		return jsondel
+	case "json.numincrby":
+		return jsonnumincrby
+	default:
+		return jsonarrappend
+	}
+}
+
+func handleBPop(conn net.Conn, op byte, command *Command) (string, error) {
+	res, err := handleCommandWithResult(conn, op, command)
+	if err != nil {
+		return "", err
+	}
+	var popped protocol.PopDatagram
+	if err = json.Unmarshal([]byte(res), &popped); err != nil {
+		return "", err
+	}
+	return popped.Key + ": " + popped.Val, nil
+}
+
 func handleSave(conn net.Conn, command *Command) error {
 	sendDatagram(conn, save, command)
 	fmt.Print("NeCache: ")
@@ -227,10 +669,12 @@ func handleCommandWithOneParam(conn net.Conn, op byte, command *Command) {
 
 func sendDatagram(conn net.Conn, op byte, command *Command) {
 	data := &protocol.Protocol{
-		Op:  op,
-		Key: command.key,
-		Val: command.val,
-		Exp: command.exp,
+		Op:     op,
+		Key:    command.key,
+		Val:    command.val,
+		Exp:    command.exp,
+		Args:   command.args,
+		Regexp: command.regexp,
 	}
 	datagram, _ := data.GetJsonBytes()
 	_, err := conn.Write(datagram)
@@ -266,9 +710,6 @@ func readCommand() (*Command, error) {
 	command := &Command{}
 	length := len(paramArr)
 
-	if length < 1 || length > 4 {
-		return nil, errors.New("invalid input")
-	}
 	err = checkOp(paramArr[0])
 	if err != nil {
 		return nil, err
@@ -279,6 +720,171 @@ func readCommand() (*Command, error) {
 		return nil, errors.New("check TailorKV document for more info")
 	}
 
+	// "-r" makes the patterns of a command regular expressions
+	switch paramArr[0] {
+	case "keys", "scan", "watch", "psubscribe", "delmatch", "export", "import":
+		for i := 1; i < length; i++ {
+			if paramArr[i] == "-r" {
+				command.regexp = true
+				paramArr = append(paramArr[:i], paramArr[i+1:]...)
+				length--
+				break
+			}
+		}
+	}
+
+	// the tags of set and setex follow the keyword "tags"
+	if paramArr[0] == "set" || paramArr[0] == "setex" {
+		for i := range paramArr {
+			if paramArr[i] == "tags" && i < length-1 {
+				command.args = paramArr[i+1:]
+				paramArr = paramArr[:i]
+				length = i
+				break
+			}
+		}
+	}
+
+	// the limit of range and prefix follows the keyword "limit"
+	if paramArr[0] == "range" || paramArr[0] == "prefix" {
+		for i := range paramArr {
+			if paramArr[i] == "limit" && i == length-2 {
+				command.exp = paramArr[i+1]
+				paramArr = paramArr[:i]
+				length = i
+				break
+			}
+		}
+	}
+
+	// commands which take any number of params keep them in args
+	switch paramArr[0] {
+	case "export", "import":
+		if length < 2 || length%2 != 0 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		command.args = paramArr[2:]
+		return command, nil
+	case "scan":
+		if length < 2 || length%2 != 0 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		command.args = paramArr[2:]
+		return command, nil
+	case "invalidate":
+		if length < 2 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.args = paramArr[1:]
+		return command, nil
+	case "subscribe", "psubscribe":
+		if length < 2 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.args = paramArr[1:]
+		return command, nil
+	case "lpush", "rpush":
+		if length < 3 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		command.args = paramArr[2:]
+		return command, nil
+	case "create":
+		// create index [name] on [prefix] field [path]
+		if length != 7 || strings.ToLower(paramArr[1]) != "index" ||
+			strings.ToLower(paramArr[3]) != "on" || strings.ToLower(paramArr[5]) != "field" {
+			return nil, errors.New("invalid input, see create -h")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[2]
+		command.val = paramArr[4]
+		command.args = []string{paramArr[6]}
+		return command, nil
+	case "drop":
+		if length != 3 || strings.ToLower(paramArr[1]) != "index" {
+			return nil, errors.New("invalid input, see drop -h")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[2]
+		return command, nil
+	case "find":
+		if length < 3 {
+			return nil, errors.New("wrong number of params")
+		}
+		// the value may contain spaces
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		command.val = strings.Join(paramArr[2:], " ")
+		return command, nil
+	case "json.set":
+		if length < 4 {
+			return nil, errors.New("wrong number of params")
+		}
+		// the JSON value may contain spaces
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		command.val = paramArr[2]
+		command.args = []string{strings.Join(paramArr[3:], " ")}
+		return command, nil
+	case "json.get", "json.del":
+		if length < 2 || length > 3 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		if length == 3 {
+			command.val = paramArr[2]
+		}
+		return command, nil
+	case "json.numincrby", "json.arrappend":
+		if length < 4 || (paramArr[0] == "json.numincrby" && length > 4) {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.key = paramArr[1]
+		command.val = paramArr[2]
+		command.args = paramArr[3:]
+		return command, nil
+	case "load":
+		if length > 3 {
+			return nil, errors.New("wrong number of params")
+		}
+		// the mode is the last param, the filename defaults to the default filepath
+		command.op = paramArr[0]
+		if length == 3 {
+			command.key = paramArr[1]
+			command.val = paramArr[2]
+		} else if length == 2 {
+			switch paramArr[1] {
+			case "keep", "overwrite", "replace":
+				command.val = paramArr[1]
+			default:
+				command.key = paramArr[1]
+			}
+		}
+		return command, nil
+	case "blpop", "brpop":
+		if length < 3 {
+			return nil, errors.New("wrong number of params")
+		}
+		command.op = paramArr[0]
+		command.args = paramArr[1 : length-1]
+		command.exp = paramArr[length-1]
+		return command, nil
+	}
+
+	if length < 1 || length > 4 {
+		return nil, errors.New("invalid input")
+	}
+
 	if length == 1 {
 		err = checkCommand(paramArr[0], 0)
 		if err != nil {
@@ -317,7 +923,13 @@ func checkOp(op string) error {
 	switch op {
 	case "set", "setex", "setnx", "auth",
 		"get", "del", "unlink", "incr", "incrby",
-		"ttl", "keys", "cnt", "save", "load", "cls", "exit", "quit":
+		"ttl", "keys", "cnt", "save", "load", "cls", "exit", "quit",
+		"info", "rename", "watch", "publish", "subscribe", "psubscribe",
+		"lpush", "rpush", "lpop", "rpop", "llen", "blpop", "brpop",
+		"select", "flushdb", "flushall", "swapdb", "invalidate", "scan", "delmatch",
+		"range", "prefix", "json.set", "json.get", "json.del",
+		"json.numincrby", "json.arrappend", "create", "drop", "find", "indexes",
+		"bgrewriteaof", "bgsave", "lastsave", "export", "import":
 		return nil
 	default:
 		return errors.New("illegal command: " + op)
@@ -327,15 +939,17 @@ func checkOp(op string) error {
 func checkCommand(op string, size int) error {
 	lenErr := errors.New("wrong number of params")
 	switch op {
-	case "cnt", "cls", "exit", "quit":
+	case "cnt", "cls", "exit", "quit", "info", "flushdb", "flushall", "indexes",
+		"bgrewriteaof", "lastsave":
 		if size != 0 {
 			return lenErr
 		}
-	case "get", "del", "unlink", "incr", "ttl", "keys", "auth":
+	case "get", "del", "unlink", "incr", "ttl", "keys", "auth",
+		"lpop", "rpop", "llen", "select", "delmatch", "prefix":
 		if size != 1 {
 			return lenErr
 		}
-	case "set", "setnx", "incrby":
+	case "set", "setnx", "incrby", "rename", "publish", "swapdb", "range":
 		if size != 2 {
 			return lenErr
 		}
@@ -343,10 +957,14 @@ func checkCommand(op string, size int) error {
 		if size != 3 {
 			return lenErr
 		}
-	case "save", "load":
+	case "save", "bgsave":
 		if size > 1 {
 			return lenErr
 		}
+	case "watch":
+		if size > 2 {
+			return lenErr
+		}
 	}
 	return nil
 }
@@ -356,20 +974,112 @@ func printUsage(op string) {
 	switch op {
 	case "auth":
 		fmt.Println("auth [password]")
-	case "cnt", "cls", "exit", "quit":
+	case "cnt", "exit", "quit", "info":
 		fmt.Printf("%s\n", op)
-	case "get", "del", "unlink", "incr", "ttl":
+	case "flushdb":
+		fmt.Println("flushdb  ## remove every key of the current database")
+	case "flushall", "cls":
+		fmt.Printf("%s  ## remove every key of all the databases\n", op)
+	case "select":
+		fmt.Println("select [index]  ## switch the database of this connection")
+	case "swapdb":
+		fmt.Println("swapdb [index] [index]")
+	case "get", "del", "unlink", "incr", "ttl", "lpop", "rpop", "llen":
 		fmt.Printf("%s [key]\n", op)
-	case "keys":
-		fmt.Println("keys [regular expression]")
-	case "set", "setnx":
+	case "lpush", "rpush":
+		fmt.Printf("%s [key] [val] [val...]\n", op)
+	case "blpop", "brpop":
+		fmt.Printf("%s [key] [key...] [timeout]  ## timeout is millisecond, 0 blocks forever\n", op)
+	case "keys", "delmatch":
+		fmt.Printf("%s [pattern]\n", op)
+		printPatternUsage()
+	case "set":
+		fmt.Println("set [key] [val] [tags tag...]")
+	case "setnx":
 		fmt.Printf("%s [key] [val]\n", op)
+	case "scan":
+		fmt.Println("scan [cursor] [match pattern] [count n] [type string|list|json]")
+		printPatternUsage()
+		fmt.Println("start with cursor 0 and go on with the next cursor until it is 0")
+	case "range":
+		fmt.Println("range [start] [end] [limit n]  ## the keys from start up to but not including end in order")
+		fmt.Println("use \"\" as end for no upper bound, the server needs orderedIndex enabled")
+	case "prefix":
+		fmt.Println("prefix [prefix] [limit n]  ## the keys which start with prefix in order")
+		fmt.Println("the server needs orderedIndex enabled")
+	case "create":
+		fmt.Println("create index [name] on [prefix] field [path]  ## index the field of the JSON documents of the keys with the prefix")
+		printPathUsage()
+	case "drop":
+		fmt.Println("drop index [name]")
+	case "find":
+		fmt.Println("find [index] [value]  ## the keys whose field equals the value, e.g. find byUser 42")
+	case "indexes":
+		fmt.Println("indexes  ## list the indexes of the current database")
+	case "bgrewriteaof":
+		fmt.Println("bgrewriteaof  ## compact the append-only file in the background")
+	case "bgsave":
+		fmt.Println("bgsave [filename]  ## save in the background, the filename defaults to the default filepath")
+	case "lastsave":
+		fmt.Println("lastsave  ## when the last save succeeded, and whether one is in progress")
+	case "export":
+		fmt.Println("export [filename] [format jsonl|csv] [match pattern]  ## write the keys of the current database into the file in the Dir")
+		fmt.Println("the format defaults to csv for a .csv file and to jsonl for any other")
+		printPatternUsage()
+	case "import":
+		fmt.Println("import [filename] [format jsonl|csv] [match pattern]  ## set the keys of the file in the Dir, the keys which exist are replaced")
+		fmt.Println("the format defaults to csv for a .csv file and to jsonl for any other")
+		printPatternUsage()
+	case "json.set":
+		fmt.Println("json.set [key] [path] [JSON value]  ## a new document is set at the root path $")
+		printPathUsage()
+	case "json.get", "json.del":
+		fmt.Printf("%s [key] [path]  ## the path defaults to the root $\n", op)
+		printPathUsage()
+	case "json.numincrby":
+		fmt.Println("json.numincrby [key] [path] [number]")
+		printPathUsage()
+	case "json.arrappend":
+		fmt.Println("json.arrappend [key] [path] [JSON value] [JSON value...]")
+		printPathUsage()
+	case "invalidate":
+		fmt.Println("invalidate [tag] [tag...]  ## remove every key with any of the tags")
 	case "incrby":
 		fmt.Println("incrby [key] [addition(Integer)]")
 	case "setex":
-		fmt.Println("setex [key] [val] [expiration]")
-	case "save", "load":
+		fmt.Println("setex [key] [val] [expiration] [tags tag...]")
+	case "rename":
+		fmt.Println("rename [key] [new key]")
+	case "watch":
+		fmt.Println("watch [events] [pattern]")
+		printPatternUsage()
+		fmt.Println("events: all or a comma separated list of written,deleted,expired,evicted,renamed,incr")
+		fmt.Println("press Ctrl-C to stop watching")
+	case "publish":
+		fmt.Println("publish [channel] [message]")
+	case "subscribe":
+		fmt.Println("subscribe [channel] [channel...]")
+		fmt.Println("press Ctrl-C to unsubscribe")
+	case "psubscribe":
+		fmt.Println("psubscribe [pattern] [pattern...]")
+		printPatternUsage()
+		fmt.Println("press Ctrl-C to unsubscribe")
+	case "save":
 		fmt.Printf("\n%s ## use default filepath\n", op)
 		fmt.Printf("%s [filename]  ## use the given filename(doesn't change the Dir)\n", op)
+	case "load":
+		fmt.Println("\nload [mode]  ## use default filepath")
+		fmt.Println("load [filename] [mode]  ## use the given filename(doesn't change the Dir)")
+		fmt.Println("modes: keep (the default) keeps the keys which exist, overwrite replaces them,")
+		fmt.Println("replace removes every key of all the databases first")
 	}
 }
+
+func printPatternUsage() {
+	fmt.Println("patterns are globs: * matches anything, ? one char, [abc] [a-z] [^a] a class, \\ escapes")
+	fmt.Println("add -r to use regular expressions instead")
+}
+
+func printPathUsage() {
+	fmt.Println("paths are a subset of JSONPath: $.a.b, $['a.b'], $.arr[0] and $.arr[-1] for the last element")
+}
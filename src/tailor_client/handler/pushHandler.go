@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"TailorKV/src/protocol"
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+)
+
+func handleWatch(conn net.Conn, command *Command) error {
+	// the server expects the pattern as key and the events as val
+	sendDatagram(conn, watch, &Command{key: command.val, val: command.key, regexp: command.regexp})
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return err
+	}
+	if msg[0] != 0 {
+		return printErrMsg(conn)
+	}
+	fmt.Println("watching keyspace events, press Ctrl-C to stop")
+	return receivePush(conn, unwatch)
+}
+
+func handleSubscribe(conn net.Conn, op byte, command *Command) error {
+	sendDatagram(conn, op, command)
+	msg := make([]byte, 1)
+	_, err := conn.Read(msg)
+	if err != nil {
+		return err
+	}
+	if msg[0] != 0 {
+		return printErrMsg(conn)
+	}
+	fmt.Println("press Ctrl-C to unsubscribe")
+	// unsubscribe without params leaves every channel and pattern
+	return receivePush(conn, unsubscribe)
+}
+
+// receivePush prints the messages pushed by the server until the
+// user interrupts, then sends op to make the server leave push mode
+// and returns once the end of the stream is received.
+func receivePush(conn net.Conn, op byte) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-interrupt:
+			sendDatagram(conn, op, &Command{})
+		case <-done:
+		}
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		msg, err := protocol.GetPushMessage(line)
+		if err != nil {
+			return err
+		}
+		if msg.Kind == protocol.PushEnd {
+			fmt.Println()
+			return nil
+		}
+		printPush(msg)
+	}
+}
+
+func printPush(msg *protocol.PushMessage) {
+	t := time.Unix(0, msg.Time*int64(time.Millisecond)).Format("15:04:05.000")
+	switch msg.Kind {
+	case protocol.PushMessageKind:
+		if msg.Pattern != "" {
+			fmt.Printf("%s [%s via %s] %s\n", t, msg.Channel, msg.Pattern, msg.Payload)
+		} else {
+			fmt.Printf("%s [%s] %s\n", t, msg.Channel, msg.Payload)
+		}
+	case protocol.PushSubscribe, protocol.PushPSubscribe,
+		protocol.PushUnsubscribe, protocol.PushPUnsubscribe:
+		fmt.Printf("%s: %s (%d subscribed)\n", msg.Kind, msg.Channel, msg.Count)
+	case protocol.PushError:
+		fmt.Printf("errMsg: %s\n", msg.Payload)
+	case protocol.PushEvent:
+		if msg.NewKey != "" {
+			fmt.Printf("%s %s: %s -> %s\n", t, msg.Event, msg.Key, msg.NewKey)
+		} else {
+			fmt.Printf("%s %s: %s\n", t, msg.Event, msg.Key)
+		}
+	}
+}
@@ -8,18 +8,53 @@ import (
 )
 
 type TailorConfig struct {
-	XMLName           xml.Name `xml:"config"`
-	MaxSizeofDatagram string   `xml:"maxSizeOfDatagram"`
-	DefaultExpiration string   `xml:"defaultExpiration"`
-	CleanCycle        string   `xml:"cleanCycle"`
-	AsyncCleanCycle   string   `xml:"asyncCleanCycle"`
-	Concurrency       string   `xml:"concurrency"`
-	SavingDir         string   `xml:"savingDir"`
-	FileName          string   `xml:"fileName"`
-	Auth              string   `xml:"auth"`
-	Password          string   `xml:"password"`
-	AESKey            string   `xml:"AESKey"`
-	Port              string   `xml:"port"`
+	XMLName           xml.Name    `xml:"config"`
+	MaxSizeofDatagram string      `xml:"maxSizeOfDatagram"`
+	DefaultExpiration string      `xml:"defaultExpiration"`
+	CleanCycle        string      `xml:"cleanCycle"`
+	LazyFreeWorkers   string      `xml:"lazyFreeWorkers"`
+	ExpireSampleSize  string      `xml:"expireSampleSize"`
+	ExpireThreshold   string      `xml:"expireThreshold"`
+	ExpireMaxCost     string      `xml:"expireMaxCost"`
+	Concurrency       string      `xml:"concurrency"`
+	Databases         string      `xml:"databases"`
+	OrderedIndex      string      `xml:"orderedIndex"`
+	CompressThreshold string      `xml:"compressThreshold"`
+	CompressLevel     string      `xml:"compressLevel"`
+	StoreDir          string      `xml:"storeDir"`
+	StoreMode         string      `xml:"storeMode"`
+	StoreReadFallback string      `xml:"storeReadFallback"`
+	SnapshotKey       string      `xml:"snapshotKey"`
+	SnapshotKeyFile   string      `xml:"snapshotKeyFile"`
+	SnapshotPlain     string      `xml:"snapshotAcceptPlain"`
+	AppendOnly        string      `xml:"appendOnly"`
+	AppendFileName    string      `xml:"appendFileName"`
+	AppendFsync       string      `xml:"appendFsync"`
+	AOFRewritePercent string      `xml:"aofRewritePercentage"`
+	AOFRewriteMinSize string      `xml:"aofRewriteMinSize"`
+	Saves             []SaveRule  `xml:"save"`
+	Indexes           []IndexRule `xml:"index"`
+	SaveInterval      string      `xml:"saveInterval"`
+	SavingDir         string      `xml:"savingDir"`
+	FileName          string      `xml:"fileName"`
+	Auth              string      `xml:"auth"`
+	Password          string      `xml:"password"`
+	AESKey            string      `xml:"AESKey"`
+	Port              string      `xml:"port"`
+}
+
+// SaveRule is <save seconds="900" changes="1"/>
+type SaveRule struct {
+	Seconds string `xml:"seconds,attr"`
+	Changes string `xml:"changes,attr"`
+}
+
+// IndexRule is <index database="0" name="byUser" prefix="session:" path="$.user_id"/>
+type IndexRule struct {
+	Database string `xml:"database,attr"`
+	Name     string `xml:"name,attr"`
+	Prefix   string `xml:"prefix,attr"`
+	Path     string `xml:"path,attr"`
 }
 
 func GetConfig(path string) *TailorConfig {
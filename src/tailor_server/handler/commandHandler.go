@@ -3,8 +3,12 @@ package handler
 import (
 	"TailorKV/src/protocol"
 	"TailorKV/src/tailor"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +20,7 @@ const (
 	NeSaveFailed
 	ExSaveFailed
 	LoadFailed
+	WrongType
 )
 
 func doSetex(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
@@ -27,8 +32,9 @@ func doSetex(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 		_, _ = conn.Write(errMsg)
 		return
 	}
-	cache.Setex(key, val, time.Duration(exp)*time.Millisecond)
-	_, _ = conn.Write([]byte{Success})
+	// the args are the tags of the key
+	err = cache.SetexSync(key, val, time.Duration(exp)*time.Millisecond, datagram.Args...)
+	writeResult(conn, err)
 }
 
 func doSetnx(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
@@ -45,16 +51,37 @@ func doSetnx(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 func doSet(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 	key := datagram.Key
 	val := datagram.Val
-	cache.Set(key, val)
+	writeResult(conn, cache.SetSync(key, val, datagram.Args...))
+}
+
+// writeResult writes Success, or the message of err,
+// such as the one of the write-through store.
+func writeResult(conn net.Conn, err error) {
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
 	_, _ = conn.Write([]byte{Success})
 }
 
+// writeReply writes Success and the result of a command, which is
+// prefixed by its length as a large result takes more than one read.
+func writeReply(conn net.Conn, res []byte) {
+	buf := make([]byte, 5, 5+len(res))
+	buf[0] = Success
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(res)))
+	_, _ = conn.Write(append(buf, res...))
+}
+
 func doGet(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 	key := datagram.Key
 	val, found := cache.Get(key)
 	if !found {
 		_, _ = conn.Write([]byte{NotFound})
 		return
+	} else if _, ok := val.(string); !ok {
+		_, _ = conn.Write([]byte{WrongType})
+		return
 	} else {
 		_, err := conn.Write([]byte{Success})
 		if err != nil {
@@ -66,14 +93,12 @@ func doGet(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 
 func doDel(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 	key := datagram.Key
-	cache.Del(key)
-	_, _ = conn.Write([]byte{Success})
+	writeResult(conn, cache.DelSync(key))
 }
 
 func doUnlink(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 	key := datagram.Key
-	cache.Unlink(key)
-	_, _ = conn.Write([]byte{Success})
+	writeResult(conn, cache.UnlinkSync(key))
 }
 
 func doIncr(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
@@ -109,9 +134,16 @@ func doTtl(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 	_, _ = conn.Write([]byte(ttl.String()))
 }
 
+// patternMode returns the mode of the patterns of a command, glob by default.
+func patternMode(datagram *protocol.Protocol) tailor.PatternMode {
+	if datagram.Regexp {
+		return tailor.Regexp
+	}
+	return tailor.Glob
+}
+
 func doKeys(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
-	expr := datagram.Key
-	kvs, err := cache.Keys(expr)
+	p, err := tailor.CompilePattern(datagram.Key, patternMode(datagram))
 	if err != nil {
 		_, _ = conn.Write([]byte{SyntaxErr})
 		_, _ = conn.Write([]byte(err.Error()))
@@ -119,24 +151,77 @@ func doKeys(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
 	} else {
 		_, _ = conn.Write([]byte{Success})
 		kd := &protocol.KeysDatagram{}
-		jsonBytes, _ := kd.GetKeysJson(kvs)
+		jsonBytes, _ := kd.GetKeysJson(cache.KeysMatching(p))
 		_, _ = conn.Write(jsonBytes)
 	}
 }
 
+// doScan takes the cursor as the key and the
+// options as pairs of args, like "match user:.* count 100".
+func doScan(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	cursor, err := strconv.ParseUint(datagram.Key, 10, 64)
+	if err != nil || len(datagram.Args)%2 != 0 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	opts := tailor.ScanOptions{Mode: patternMode(datagram)}
+	for i := 0; i < len(datagram.Args); i += 2 {
+		val := datagram.Args[i+1]
+		switch strings.ToLower(datagram.Args[i]) {
+		case "match":
+			opts.Match = val
+		case "count":
+			opts.Count, err = strconv.Atoi(val)
+		case "type":
+			opts.Type = val
+		default:
+			err = fmt.Errorf("unknown option '%s'", datagram.Args[i])
+		}
+		if err != nil {
+			_, _ = conn.Write([]byte{SyntaxErr})
+			return
+		}
+	}
+	next, keys, err := cache.Scan(cursor, opts)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	jsonBytes, _ := json.Marshal(&protocol.ScanDatagram{
+		Cursor: strconv.FormatUint(next, 10),
+		Keys:   keys,
+	})
+	writeReply(conn, jsonBytes)
+}
+
 func doCnt(cache *tailor.Cache, conn net.Conn) {
 	cnt := strconv.Itoa(cache.Cnt())
 	_, _ = conn.Write([]byte{Success})
 	_, _ = conn.Write([]byte(cnt))
 }
 
+// fileInDir returns the path of the file name in dir,
+// the name must not lead out of dir.
+func fileInDir(dir, name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("invalid file name '%s'", name)
+	}
+	return dir + name, nil
+}
+
 func doSave(dir string, datagram *protocol.Protocol, path string, cache *tailor.Cache, conn net.Conn) {
-	status := make(chan bool, 2)
-	if datagram.Key == "" {
-		cache.Save(path, status)
-	} else {
-		cache.Save(dir+datagram.Key, status)
+	if datagram.Key != "" {
+		var err error
+		if path, err = fileInDir(dir, datagram.Key); err != nil {
+			_, _ = conn.Write([]byte{NeSaveFailed, ExSaveFailed})
+			return
+		}
 	}
+	status := make(chan bool, 2)
+	cache.Save(path, status)
 	if neOk := <-status; !neOk {
 		_, _ = conn.Write([]byte{NeSaveFailed})
 	} else {
@@ -150,15 +235,113 @@ func doSave(dir string, datagram *protocol.Protocol, path string, cache *tailor.
 	}
 }
 
+func doBgSave(dir string, datagram *protocol.Protocol, path string, cache *tailor.Cache, conn net.Conn) {
+	if datagram.Key != "" {
+		var err error
+		if path, err = fileInDir(dir, datagram.Key); err != nil {
+			_, _ = conn.Write([]byte(err.Error()))
+			return
+		}
+	}
+	if err := cache.BgSave(path); err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+	} else {
+		_, _ = conn.Write([]byte{Success})
+	}
+}
+
+func doLastSave(cache *tailor.Cache, conn net.Conn) {
+	jsonBytes, _ := json.Marshal(&protocol.SaveDatagram{Stats: cache.SaveStats()})
+	writeReply(conn, jsonBytes)
+}
+
 func doLoad(dir string, datagram *protocol.Protocol, path string, cache *tailor.Cache, conn net.Conn) {
-	var err error
-	if datagram.Key == "" {
-		err = cache.Load(path)
+	if datagram.Key != "" {
+		var err error
+		if path, err = fileInDir(dir, datagram.Key); err != nil {
+			_, _ = conn.Write([]byte(err.Error()))
+			return
+		}
+	}
+	mode := tailor.LoadKeep
+	if datagram.Val != "" {
+		var err error
+		if mode, err = tailor.ParseLoadMode(datagram.Val); err != nil {
+			_, _ = conn.Write([]byte(err.Error()))
+			return
+		}
+	}
+	res, err := cache.LoadWithMode(path, mode)
+	if err != nil {
+		// such as a wrong snapshot key
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	jsonBytes, _ := json.Marshal(&protocol.LoadDatagram{Result: res})
+	writeReply(conn, jsonBytes)
+}
+
+// doTransfer exports the keys of the current database into the file of the
+// key, or imports them from it. The options follow as pairs in the args:
+// format jsonl or csv, which defaults to csv for a ".csv" file and to jsonl
+// for any other, and match [pattern]. The progress is streamed as JSON lines
+// of ExportDatagram, the last one has Done or Error set.
+func doTransfer(dir string, datagram *protocol.Protocol, cache *tailor.Cache, conn net.Conn, isImport bool) {
+	if datagram.Key == "" || len(datagram.Args)%2 != 0 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	path, err := fileInDir(dir, datagram.Key)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	opts := tailor.ExportOptions{Mode: patternMode(datagram)}
+	if strings.HasSuffix(strings.ToLower(datagram.Key), ".csv") {
+		opts.Format = tailor.ExportCSV
+	}
+	for i := 0; i < len(datagram.Args); i += 2 {
+		val := datagram.Args[i+1]
+		switch strings.ToLower(datagram.Args[i]) {
+		case "format":
+			opts.Format, err = tailor.ParseExportFormat(strings.ToLower(val))
+		case "match":
+			opts.Match = val
+		default:
+			err = fmt.Errorf("unknown option '%s'", datagram.Args[i])
+		}
+		if err != nil {
+			_, _ = conn.Write([]byte(err.Error()))
+			return
+		}
+	}
+	_, _ = conn.Write([]byte{Success})
+
+	opts.Progress = func(progress tailor.ExportProgress) {
+		_ = writeTransfer(conn, &protocol.ExportDatagram{Progress: progress})
+	}
+	if isImport {
+		_, err = cache.ImportFile(path, opts)
 	} else {
-		err = cache.Load(dir + datagram.Key)
+		_, err = cache.ExportFile(path, opts)
+	}
+	if err != nil {
+		_ = writeTransfer(conn, &protocol.ExportDatagram{Error: err.Error()})
 	}
+}
+
+func writeTransfer(conn net.Conn, line *protocol.ExportDatagram) error {
+	data, err := json.Marshal(line)
 	if err != nil {
-		_, _ = conn.Write([]byte{LoadFailed})
+		return err
+	}
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+func doBgRewriteAOF(cache *tailor.Cache, conn net.Conn) {
+	if err := cache.RewriteAOF(); err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
 	} else {
 		_, _ = conn.Write([]byte{Success})
 	}
@@ -168,3 +351,372 @@ func doCls(cache *tailor.Cache, conn net.Conn) {
 	cache.Cls()
 	_, _ = conn.Write([]byte{Success})
 }
+
+// doSelect returns the view of the selected database,
+// or the current one if the index is invalid.
+func doSelect(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) *tailor.Cache {
+	n, err := strconv.Atoi(datagram.Key)
+	if err != nil {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return cache
+	}
+	selected, err := cache.Select(n)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return cache
+	}
+	_, _ = conn.Write([]byte{Success})
+	return selected
+}
+
+func doFlushDB(cache *tailor.Cache, conn net.Conn) {
+	cache.FlushDB()
+	_, _ = conn.Write([]byte{Success})
+}
+
+func doFlushAll(cache *tailor.Cache, conn net.Conn) {
+	cache.FlushAll()
+	_, _ = conn.Write([]byte{Success})
+}
+
+func doSwapDB(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	a, err := strconv.Atoi(datagram.Key)
+	if err != nil {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	b, err := strconv.Atoi(datagram.Val)
+	if err != nil {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	if err = cache.SwapDB(a, b); err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+}
+
+func doDelMatch(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	p, err := tailor.CompilePattern(datagram.Key, patternMode(datagram))
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	deleted := strconv.Itoa(cache.DelMatching(p))
+	writeReply(conn, []byte(deleted))
+}
+
+// the keys of RANGE and PREFIX are written this many per line
+const rangeLine = 128
+
+// doRange takes the start or the prefix as the key, the end as the val
+// and the limit as the exp. It streams the keys as JSON lines of
+// RangeDatagram, so a large range is never held in memory at once.
+func doRange(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn, prefix bool) {
+	limit := 0
+	if datagram.Exp != "" {
+		var err error
+		limit, err = strconv.Atoi(datagram.Exp)
+		if err != nil || limit < 0 {
+			_, _ = conn.Write([]byte{SyntaxErr})
+			return
+		}
+	}
+	if !cache.OrderedIndex() {
+		_, _ = conn.Write([]byte(tailor.ErrNoOrderedIndex.Error()))
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+
+	batch := &protocol.RangeDatagram{Keys: make([]string, 0, rangeLine)}
+	var err error
+	fn := func(key string) bool {
+		batch.Keys = append(batch.Keys, key)
+		if len(batch.Keys) < rangeLine {
+			return true
+		}
+		err = writeRange(conn, batch)
+		batch.Keys = batch.Keys[:0]
+		return err == nil
+	}
+	if prefix {
+		_ = cache.PrefixKeys(datagram.Key, limit, fn)
+	} else {
+		_ = cache.RangeKeys(datagram.Key, datagram.Val, limit, fn)
+	}
+	if err != nil {
+		return
+	}
+	batch.Done = true
+	_ = writeRange(conn, batch)
+}
+
+func writeRange(conn net.Conn, batch *protocol.RangeDatagram) error {
+	line, err := batch.GetJsonLine()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(line)
+	return err
+}
+
+func doInvalidate(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	removed := strconv.Itoa(cache.Invalidate(datagram.Args...))
+	writeReply(conn, []byte(removed))
+}
+
+func doRename(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	err := cache.Rename(datagram.Key, datagram.Val)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+}
+
+func doPublish(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	received := strconv.Itoa(cache.Publish(datagram.Key, datagram.Val))
+	_, _ = conn.Write([]byte{Success})
+	_, _ = conn.Write([]byte(received))
+}
+
+func doPush(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn, left bool) {
+	vals := make([]interface{}, len(datagram.Args))
+	for i := range datagram.Args {
+		vals[i] = datagram.Args[i]
+	}
+	var n int
+	var err error
+	if left {
+		n, err = cache.LPush(datagram.Key, vals...)
+	} else {
+		n, err = cache.RPush(datagram.Key, vals...)
+	}
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	writeReply(conn, []byte(strconv.Itoa(n)))
+}
+
+func doPop(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn, left bool) {
+	var val interface{}
+	var found bool
+	var err error
+	if left {
+		val, found, err = cache.LPop(datagram.Key)
+	} else {
+		val, found, err = cache.RPop(datagram.Key)
+	}
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	if !found {
+		_, _ = conn.Write([]byte{NotFound})
+		return
+	}
+	writeReply(conn, []byte(fmt.Sprint(val)))
+}
+
+func doLlen(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	n, err := cache.LLen(datagram.Key)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	writeReply(conn, []byte(strconv.Itoa(n)))
+}
+
+// the JSON commands take the path as the val and the JSON values as the args
+
+func doJSONSet(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	if len(datagram.Args) != 1 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	err := cache.JSONSet(datagram.Key, datagram.Val, datagram.Args[0])
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+}
+
+func doJSONGet(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	val, found, err := cache.JSONGet(datagram.Key, datagram.Val)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	if !found {
+		_, _ = conn.Write([]byte{NotFound})
+		return
+	}
+	writeReply(conn, []byte(val))
+}
+
+func doJSONDel(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	n, err := cache.JSONDel(datagram.Key, datagram.Val)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	writeReply(conn, []byte(strconv.Itoa(n)))
+}
+
+func doJSONNumIncrBy(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	if len(datagram.Args) != 1 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	n, err := cache.JSONNumIncrBy(datagram.Key, datagram.Val, datagram.Args[0])
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	writeReply(conn, []byte(n))
+}
+
+func doJSONArrAppend(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	if len(datagram.Args) == 0 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	n, err := cache.JSONArrAppend(datagram.Key, datagram.Val, datagram.Args...)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	writeReply(conn, []byte(strconv.Itoa(n)))
+}
+
+// doCreateIndex takes the name as the key, the prefix as the val and the path as the arg.
+func doCreateIndex(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	if len(datagram.Args) != 1 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return
+	}
+	err := cache.CreateIndex(datagram.Key, datagram.Val, datagram.Args[0])
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+}
+
+func doDropIndex(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	if !cache.DropIndex(datagram.Key) {
+		_, _ = conn.Write([]byte{NotFound})
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+}
+
+// doFind takes the index as the key and the value of the field as the val.
+func doFind(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn) {
+	keys, err := cache.Find(datagram.Key, datagram.Val)
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	jsonBytes, _ := json.Marshal(&protocol.KeysDatagram{Keys: keys})
+	writeReply(conn, jsonBytes)
+}
+
+func doIndexes(cache *tailor.Cache, conn net.Conn) {
+	jsonBytes, _ := json.Marshal(&protocol.IndexesDatagram{Indexes: cache.Indexes()})
+	writeReply(conn, jsonBytes)
+}
+
+// maxQueued is how many datagrams are queued while a client is
+// blocked, the connection is not read any further past it.
+const maxQueued = 64
+
+// doBPop blocks until an element is popped from one of the lists in
+// datagram.Args or the timeout (millisecond) in datagram.Exp expires.
+// The pop is cancelled if the client goes away or sends exit or quit
+// meanwhile. The other
+// datagrams sent meanwhile are returned to be handled after the pop,
+// so the replies keep the order of the requests.
+// It returns false if the connection should be closed.
+func doBPop(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn, datagrams <-chan *protocol.Protocol, left bool) ([]*protocol.Protocol, bool) {
+	timeout, err := strconv.ParseInt(datagram.Exp, 10, 64)
+	if err != nil || len(datagram.Args) == 0 {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		return nil, true
+	}
+
+	type popRes struct {
+		kv  tailor.KV
+		ok  bool
+		err error
+	}
+	cancel := make(chan struct{})
+	resCh := make(chan popRes, 1)
+	go func() {
+		var res popRes
+		t := time.Duration(timeout) * time.Millisecond
+		if left {
+			res.kv, res.ok, res.err = cache.BLPop(datagram.Args, t, cancel)
+		} else {
+			res.kv, res.ok, res.err = cache.BRPop(datagram.Args, t, cancel)
+		}
+		resCh <- res
+	}()
+
+	var res popRes
+	var queued []*protocol.Protocol
+	incoming := datagrams
+wait:
+	for {
+		select {
+		case res = <-resCh:
+			break wait
+		case d, ok := <-incoming:
+			if !ok || d.Op == exit || d.Op == quit {
+				// the cancelled pop gives back what is handed to it
+				// meanwhile, a pop done before is still answered
+				close(cancel)
+				if res = <-resCh; res.ok {
+					writePopped(conn, res.kv)
+				}
+				return nil, false
+			}
+			if queued = append(queued, d); len(queued) == maxQueued {
+				incoming = nil
+			}
+		}
+	}
+
+	if res.err != nil {
+		_, _ = conn.Write([]byte(res.err.Error()))
+		return queued, true
+	}
+	if !res.ok {
+		_, _ = conn.Write([]byte{NotFound})
+		return queued, true
+	}
+	writePopped(conn, res.kv)
+	return queued, true
+}
+
+func writePopped(conn net.Conn, kv tailor.KV) {
+	jsonBytes, _ := json.Marshal(&protocol.PopDatagram{
+		Key: kv.Key(),
+		Val: fmt.Sprint(kv.Val()),
+	})
+	writeReply(conn, jsonBytes)
+}
+
+func doInfo(cache *tailor.Cache, conn net.Conn) {
+	jsonBytes, err := json.Marshal(cache.Stats())
+	if err != nil {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		_, _ = conn.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = conn.Write([]byte{Success})
+	_, _ = conn.Write(jsonBytes)
+}
@@ -3,7 +3,6 @@ package handler
 import (
 	"TailorKV/src/protocol"
 	"TailorKV/src/tailor"
-	"fmt"
 	"net"
 )
 
@@ -24,6 +23,45 @@ const (
 	cls
 	exit
 	quit
+	info
+	rename
+	watch
+	unwatch
+	publish
+	subscribe
+	psubscribe
+	unsubscribe
+	punsubscribe
+	lpush
+	rpush
+	lpop
+	rpop
+	llen
+	blpop
+	brpop
+	selectdb
+	flushdb
+	flushall
+	swapdb
+	invalidate
+	scan
+	delmatch
+	keyrange
+	keyprefix
+	jsonset
+	jsonget
+	jsondel
+	jsonnumincrby
+	jsonarrappend
+	createindex
+	dropindex
+	find
+	indexes
+	bgrewriteaof
+	bgsave
+	lastsave
+	exportkeys
+	importkeys
 )
 
 type AESLogin struct {
@@ -40,19 +78,21 @@ func HandleConn(conn net.Conn, cache *tailor.Cache, savingDir, defaultSavingPath
 		return
 	}
 
-	defer func() {
-		kvs, _ := cache.Keys("[A-z]+")
-		for i := range kvs {
-			fmt.Printf("key: %s, val: %v\n", kvs[i].Key(), kvs[i].Val())
-		}
-	}()
-
+	done := make(chan struct{})
+	defer close(done)
+	datagrams := readDatagrams(conn, maxSizeOfDatagram, done)
+	// the datagrams which arrived while the client was blocked
+	var queued []*protocol.Protocol
 	for {
-		datagram, err := readDatagram(conn, maxSizeOfDatagram)
-		if err != nil {
-			break
+		var datagram *protocol.Protocol
+		if len(queued) > 0 {
+			datagram, queued = queued[0], queued[1:]
+		} else {
+			var ok bool
+			if datagram, ok = <-datagrams; !ok {
+				return
+			}
 		}
-
 		switch datagram.Op {
 		case setex:
 			doSetex(cache, datagram, conn)
@@ -80,14 +120,104 @@ func HandleConn(conn net.Conn, cache *tailor.Cache, savingDir, defaultSavingPath
 			doSave(savingDir, datagram, defaultSavingPath, cache, conn)
 		case load:
 			doLoad(savingDir, datagram, defaultSavingPath, cache, conn)
+		case bgsave:
+			doBgSave(savingDir, datagram, defaultSavingPath, cache, conn)
+		case lastsave:
+			doLastSave(cache, conn)
+		case exportkeys, importkeys:
+			doTransfer(savingDir, datagram, cache, conn, datagram.Op == importkeys)
 		case cls:
 			doCls(cache, conn)
+		case selectdb:
+			cache = doSelect(cache, datagram, conn)
+		case flushdb:
+			doFlushDB(cache, conn)
+		case flushall:
+			doFlushAll(cache, conn)
+		case swapdb:
+			doSwapDB(cache, datagram, conn)
+		case invalidate:
+			doInvalidate(cache, datagram, conn)
+		case scan:
+			doScan(cache, datagram, conn)
+		case delmatch:
+			doDelMatch(cache, datagram, conn)
+		case keyrange, keyprefix:
+			doRange(cache, datagram, conn, datagram.Op == keyprefix)
+		case jsonset:
+			doJSONSet(cache, datagram, conn)
+		case jsonget:
+			doJSONGet(cache, datagram, conn)
+		case jsondel:
+			doJSONDel(cache, datagram, conn)
+		case jsonnumincrby:
+			doJSONNumIncrBy(cache, datagram, conn)
+		case jsonarrappend:
+			doJSONArrAppend(cache, datagram, conn)
+		case createindex:
+			doCreateIndex(cache, datagram, conn)
+		case dropindex:
+			doDropIndex(cache, datagram, conn)
+		case find:
+			doFind(cache, datagram, conn)
+		case indexes:
+			doIndexes(cache, conn)
+		case bgrewriteaof:
+			doBgRewriteAOF(cache, conn)
+		case info:
+			doInfo(cache, conn)
+		case rename:
+			doRename(cache, datagram, conn)
+		case watch:
+			if !doWatch(cache, datagram, conn, datagrams) {
+				return
+			}
+		case publish:
+			doPublish(cache, datagram, conn)
+		case lpush, rpush:
+			doPush(cache, datagram, conn, datagram.Op == lpush)
+		case lpop, rpop:
+			doPop(cache, datagram, conn, datagram.Op == lpop)
+		case llen:
+			doLlen(cache, datagram, conn)
+		case blpop, brpop:
+			more, alive := doBPop(cache, datagram, conn, datagrams, datagram.Op == blpop)
+			if !alive {
+				return
+			}
+			queued = append(queued, more...)
+		case subscribe, psubscribe:
+			if !doSubscribe(cache, datagram, conn, datagrams) {
+				return
+			}
 		case exit, quit:
 			return
 		}
 	}
 }
 
+// readDatagrams reads the datagrams in the background, so that the
+// connection is still watched while a command keeps it busy.
+// The channel is closed once the connection is closed or broken.
+func readDatagrams(conn net.Conn, maxSize int, done <-chan struct{}) <-chan *protocol.Protocol {
+	datagrams := make(chan *protocol.Protocol)
+	go func() {
+		defer close(datagrams)
+		for {
+			datagram, err := readDatagram(conn, maxSize)
+			if err != nil {
+				return
+			}
+			select {
+			case datagrams <- datagram:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return datagrams
+}
+
 func readDatagram(conn net.Conn, maxSize int) (*protocol.Protocol, error) {
 	buf := make([]byte, maxSize)
 	n, err := conn.Read(buf)
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"TailorKV/src/protocol"
+	"TailorKV/src/tailor"
+	"fmt"
+	"net"
+)
+
+// doWatch switches the connection into push mode and writes the
+// keyspace events of the types in datagram.Val whose key matches
+// datagram.Key, until the client sends unwatch.
+// It returns false if the connection should be closed.
+func doWatch(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn, datagrams <-chan *protocol.Protocol) bool {
+	types, err := tailor.ParseEventType(datagram.Val)
+	if err != nil {
+		_, _ = conn.Write([]byte{SyntaxErr})
+		_, _ = conn.Write([]byte(err.Error()))
+		return true
+	}
+	var p *tailor.Pattern
+	if datagram.Key != "" {
+		p, err = tailor.CompilePattern(datagram.Key, patternMode(datagram))
+		if err != nil {
+			_, _ = conn.Write([]byte{SyntaxErr})
+			_, _ = conn.Write([]byte(err.Error()))
+			return true
+		}
+	}
+	sub := cache.SubscribePattern(types, p)
+	defer sub.Close()
+	if _, err = conn.Write([]byte{Success}); err != nil {
+		return false
+	}
+
+	for {
+		select {
+		case ev := <-sub.C:
+			msg := &protocol.PushMessage{
+				Kind:   protocol.PushEvent,
+				Event:  ev.Type.String(),
+				Key:    ev.Key,
+				NewKey: ev.NewKey,
+				Time:   ev.Time.UnixNano() / 1e6,
+			}
+			if writePush(conn, msg) != nil {
+				return false
+			}
+		case d, ok := <-datagrams:
+			if !ok {
+				return false
+			}
+			switch d.Op {
+			case unwatch:
+				return writePush(conn, &protocol.PushMessage{Kind: protocol.PushEnd}) == nil
+			case exit, quit:
+				return false
+			}
+		}
+	}
+}
+
+// doSubscribe switches the connection into push mode and writes the
+// messages of the subscribed channels and patterns. The client may
+// (p)subscribe and (p)unsubscribe meanwhile, the connection leaves
+// push mode once nothing is subscribed. unsubscribe without params
+// leaves every channel and pattern.
+// It returns false if the connection should be closed.
+func doSubscribe(cache *tailor.Cache, datagram *protocol.Protocol, conn net.Conn, datagrams <-chan *protocol.Protocol) bool {
+	sub := cache.NewChannelSubscription()
+	defer sub.Close()
+	if _, err := conn.Write([]byte{Success}); err != nil {
+		return false
+	}
+
+	d := datagram
+	for {
+		if d != nil {
+			switch d.Op {
+			case subscribe, psubscribe, unsubscribe, punsubscribe:
+				if updateSubscription(sub, d, conn) != nil {
+					return false
+				}
+				if sub.Count() == 0 {
+					return writePush(conn, &protocol.PushMessage{Kind: protocol.PushEnd}) == nil
+				}
+			case exit, quit:
+				return false
+			}
+		}
+
+		var ok bool
+		select {
+		case msg := <-sub.C:
+			push := &protocol.PushMessage{
+				Kind:    protocol.PushMessageKind,
+				Channel: msg.Channel,
+				Pattern: msg.Pattern,
+				Payload: fmt.Sprint(msg.Payload),
+				Time:    msg.Time.UnixNano() / 1e6,
+			}
+			if writePush(conn, push) != nil {
+				return false
+			}
+			d = nil
+		case d, ok = <-datagrams:
+			if !ok {
+				return false
+			}
+		}
+	}
+}
+
+// updateSubscription applies a (p)(un)subscribe datagram to sub
+// and confirms every channel or pattern with a push message.
+func updateSubscription(sub *tailor.ChannelSubscription, d *protocol.Protocol, conn net.Conn) error {
+	var channels, patterns []string
+	var chKind, patKind string
+	switch d.Op {
+	case subscribe:
+		sub.Subscribe(d.Args...)
+		channels, chKind = d.Args, protocol.PushSubscribe
+	case psubscribe:
+		if err := sub.PSubscribeMode(patternMode(d), d.Args...); err != nil {
+			return writePush(conn, &protocol.PushMessage{Kind: protocol.PushError, Payload: err.Error()})
+		}
+		patterns, patKind = d.Args, protocol.PushPSubscribe
+	case unsubscribe:
+		channels, chKind = d.Args, protocol.PushUnsubscribe
+		if len(d.Args) == 0 {
+			channels = sub.Channels()
+			patterns, patKind = sub.Patterns(), protocol.PushPUnsubscribe
+			sub.PUnsubscribe()
+		}
+		sub.Unsubscribe(d.Args...)
+	case punsubscribe:
+		patterns, patKind = d.Args, protocol.PushPUnsubscribe
+		if len(d.Args) == 0 {
+			patterns = sub.Patterns()
+		}
+		sub.PUnsubscribe(d.Args...)
+	}
+
+	count := sub.Count()
+	for _, channel := range channels {
+		err := writePush(conn, &protocol.PushMessage{Kind: chKind, Channel: channel, Count: count})
+		if err != nil {
+			return err
+		}
+	}
+	for _, pattern := range patterns {
+		err := writePush(conn, &protocol.PushMessage{Kind: patKind, Channel: pattern, Count: count})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePush(conn net.Conn, msg *protocol.PushMessage) error {
+	line, err := msg.GetJsonLine()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(line)
+	return err
+}
@@ -4,22 +4,45 @@ import (
 	"TailorKV/src/tailor"
 	"TailorKV/src/tailor_server/config"
 	"TailorKV/src/tailor_server/handler"
+	"compress/flate"
 	"errors"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// how long the connections may take to finish on shutdown
+const drainTimeout = 5 * time.Second
+
 var (
 	maxSizeOfDatagram int
 	defaultExpiration time.Duration
 	cleanCycle        time.Duration
-	asyncCleanCycle   time.Duration
+	lazyFreeWorkers   int
+	activeExpire      tailor.ActiveExpireConf
 	concurrency       uint8
+	databases         int
+	orderedIndex      bool
+	compressThreshold int
+	compressLevel     int
+	snapshotKeys      []tailor.SnapshotKey
+	snapshotPlain     bool
+	appendOnly        bool
+	aofPath           string
+	aofOpts           tailor.AOFOptions
+	storeDir          string
+	storeOpts         tailor.StoreOptions
 	savingPath        string
+	savePolicies      []tailor.SavePolicy
+	indexes           []config.IndexRule
+	saveInterval      time.Duration
 	auth              bool
 	password          string
 	aesKey            string
@@ -38,22 +61,259 @@ func main() {
 	}
 
 	// start tailor
-	cache := tailor.NewCache(defaultExpiration, cleanCycle, asyncCleanCycle, concurrency, nil)
+	cache := tailor.NewCacheWithOptions(tailor.CacheOptions{
+		DefaultExpiration: defaultExpiration,
+		CleanCycle:        cleanCycle,
+		LazyFreeWorkers:   lazyFreeWorkers,
+		Concurrency:       concurrency,
+		Databases:         databases,
+	}, nil)
+	if err := cache.SetActiveExpire(activeExpire); err != nil {
+		log.Fatal(err)
+	}
+	if orderedIndex {
+		cache.EnableOrderedIndex()
+	}
+	if err := cache.SetCompression(compressThreshold, compressLevel); err != nil {
+		log.Fatal(err)
+	}
+	if err := cache.SetSnapshotKeys(snapshotKeys...); err != nil {
+		log.Fatal(err)
+	}
+	cache.AcceptPlainFiles(snapshotPlain)
+	// the keys are restored before any client connects
+	restore(cache)
+	if storeDir != "" {
+		attachStores(cache)
+	}
+	createIndexes(cache)
+
+	if err := cache.SetAutoSave(savingPath, saveInterval, savePolicies...); err != nil {
+		log.Fatal(err)
+	}
 
 	// start server
 	listener, err := net.Listen("tcp", "0.0.0.0:"+port)
 	if err != nil {
 		log.Fatal(err)
 	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	conns := newConnSet()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(listener, conns, func(conn net.Conn) {
+			handler.HandleConn(conn, cache, conf.SavingDir, savingPath, maxSizeOfDatagram, login)
+		})
+	}()
+
+	status := 0
+	select {
+	case sig := <-signals:
+		log.Printf("received %v, shutting down", sig)
+	case err := <-serveErr:
+		// still saved and closed, but the server did not stop as asked
+		log.Printf("cannot accept connections: %v, shutting down", err)
+		status = 1
+	}
+	if shutdown(listener, cache, conns) != 0 {
+		status = 1
+	}
+	os.Exit(status)
+}
+
+// attachStores attaches a store to every database, each one keeps its
+// keys apart: database 0 in storeDir and database n in storeDir/db-n,
+// which no key file is named like since their names are hex encoded
+// or, for long and empty keys, start with "sha256-".
+func attachStores(cache *tailor.Cache) {
+	for i := 0; i < cache.Databases(); i++ {
+		dir := storeDir
+		if i > 0 {
+			dir = filepath.Join(storeDir, "db-"+strconv.Itoa(i))
+		}
+		store, err := tailor.NewFileStore(dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		db, err := cache.Select(i)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = db.AttachStore(store, storeOpts); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// createIndexes creates the indexes of config.xml, which are not saved
+// with the keys, so that they are there again after every restart.
+func createIndexes(cache *tailor.Cache) {
+	for _, rule := range indexes {
+		i := 0
+		if rule.Database != "" {
+			i = int(parseStr(rule.Database))
+		}
+		db, err := cache.Select(i)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = db.CreateIndex(rule.Name, rule.Prefix, rule.Path); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// restore loads the keys of the last run: the append-only file if there is
+// one, otherwise the last snapshot, which goes into the new append-only file.
+// It does not start with no keys if a file is there but cannot be loaded,
+// so that it is not saved over.
+func restore(cache *tailor.Cache) {
+	if appendOnly {
+		info, err := os.Stat(aofPath)
+		existed := err == nil && info.Size() > 0
+		if err = cache.OpenAOF(aofPath, aofOpts); err != nil {
+			log.Fatal(err)
+		}
+		if existed {
+			stats := cache.Stats().AOF
+			log.Printf("replayed %d records of %s", stats.Replayed, aofPath)
+			if stats.TruncatedBytes > 0 {
+				log.Printf("cut off %d bytes of a torn record at the end of %s", stats.TruncatedBytes, aofPath)
+			}
+			return
+		}
+	}
+	err := cache.Load(savingPath)
+	if os.IsNotExist(err) {
+		log.Printf("no snapshot at %s, starting with no keys", savingPath)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	keys := 0
+	for _, db := range cache.Stats().Databases {
+		keys += db.Keys
+	}
+	log.Printf("loaded %d keys from %s", keys, savingPath)
+}
+
+// serve accepts the connections until the listener is closed, it backs
+// off on temporary errors like running out of file descriptors.
+func serve(listener net.Listener, conns *connSet, handle func(net.Conn)) error {
+	var backoff time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			cache.Save(savingPath, nil)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				log.Printf("accept error: %v, retrying in %v", err, backoff)
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		if !conns.add(conn) {
+			_ = conn.Close()
+			continue
 		}
-		go handler.HandleConn(conn, cache, conf.SavingDir, savingPath, maxSizeOfDatagram, login)
+		go func() {
+			defer conns.remove(conn)
+			handle(conn)
+		}()
 	}
 }
 
+// shutdown stops accepting, drains the connections, writes the final
+// snapshot and closes the cache. It returns the exit status.
+func shutdown(listener net.Listener, cache *tailor.Cache, conns *connSet) int {
+	_ = listener.Close()
+	if n := conns.drain(drainTimeout); n > 0 {
+		log.Printf("closed %d connection(s) still busy after %v", n, drainTimeout)
+	}
+	status := 0
+	cache.WaitWrites()
+	if err := cache.SaveFile(savingPath); err != nil {
+		log.Printf("cannot save the final snapshot: %v", err)
+		status = 1
+	} else {
+		log.Printf("saved the final snapshot to %s", savingPath)
+	}
+	cache.Close()
+	log.Printf("tailorKV stopped")
+	return status
+}
+
+// connSet keeps the open connections, so that they can be drained.
+type connSet struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[net.Conn]struct{})}
+}
+
+// add returns false once the set is drained.
+func (s *connSet) add(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *connSet) remove(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// drain stops reading from the connections, so that each one ends once
+// it has answered its current command. The connections still open after
+// timeout are closed, it returns how many.
+func (s *connSet) drain(timeout time.Duration) int {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			_ = tcp.CloseRead()
+		} else {
+			_ = conn.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(timeout):
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	return len(s.conns)
+}
+
 func resolveConfig(conf config.TailorConfig) {
 	maxSizeOfDatagram = int(parseStr(conf.MaxSizeofDatagram))
 
@@ -70,11 +330,94 @@ func resolveConfig(conf config.TailorConfig) {
 	}
 	cleanCycle = time.Duration(i) * time.Millisecond
 
-	i = parseStr(conf.AsyncCleanCycle)
-	if i <= 0 {
-		log.Fatal("async clean cycle must be greater than zero")
+	if conf.LazyFreeWorkers == "default" || conf.LazyFreeWorkers == "" {
+		lazyFreeWorkers = runtime.NumCPU()
+	} else {
+		i = parseStr(conf.LazyFreeWorkers)
+		if i <= 0 {
+			log.Fatal("number of lazy-free workers must be greater than zero")
+		}
+		lazyFreeWorkers = int(i)
+	}
+
+	activeExpire = tailor.DefaultActiveExpireConf()
+	if conf.ExpireSampleSize != "" {
+		activeExpire.SampleSize = int(parseStr(conf.ExpireSampleSize))
+	}
+	if conf.ExpireThreshold != "" {
+		activeExpire.Threshold = float64(parseStr(conf.ExpireThreshold)) / 100
+	}
+	if conf.ExpireMaxCost != "" {
+		activeExpire.MaxCost = time.Duration(parseStr(conf.ExpireMaxCost)) * time.Millisecond
+	}
+
+	databases = 16
+	if conf.Databases != "" {
+		i = parseStr(conf.Databases)
+		if i <= 0 {
+			log.Fatal("number of databases must be greater than zero")
+		}
+		databases = int(i)
 	}
-	asyncCleanCycle = time.Duration(i) * time.Millisecond
+
+	orderedIndex = conf.OrderedIndex == "true"
+
+	if conf.CompressThreshold != "" {
+		compressThreshold = int(parseStr(conf.CompressThreshold))
+	}
+	compressLevel = flate.BestSpeed
+	if conf.CompressLevel != "" {
+		compressLevel = int(parseStr(conf.CompressLevel))
+	}
+
+	// the key in config.xml encrypts, the keys of the file only decrypt
+	// unless there is none in config.xml, then the first of them encrypts
+	if conf.SnapshotKey != "" {
+		key, err := tailor.ParseSnapshotKey(conf.SnapshotKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		snapshotKeys = append(snapshotKeys, key)
+	}
+	if conf.SnapshotKeyFile != "" {
+		keys, err := tailor.ReadSnapshotKeyFile(conf.SnapshotKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		snapshotKeys = append(snapshotKeys, keys...)
+	}
+	snapshotPlain = conf.SnapshotPlain == "true"
+
+	appendOnly = conf.AppendOnly == "true"
+	aofOpts = tailor.DefaultAOFOptions()
+	if conf.AppendFsync != "" {
+		policy, err := tailor.ParseFsyncPolicy(conf.AppendFsync)
+		if err != nil {
+			log.Fatal(err)
+		}
+		aofOpts.Fsync = policy
+	}
+	if conf.AOFRewritePercent != "" {
+		aofOpts.RewritePercentage = int(parseStr(conf.AOFRewritePercent))
+	}
+	if conf.AOFRewriteMinSize != "" {
+		aofOpts.RewriteMinSize = parseStr(conf.AOFRewriteMinSize)
+	}
+
+	storeDir = conf.StoreDir
+	storeOpts = tailor.DefaultStoreOptions()
+	storeOpts.OnError = func(key string, err error) {
+		log.Printf("error writing key '%s' to the store: %v", key, err)
+	}
+	switch conf.StoreMode {
+	case "through", "":
+		storeOpts.Mode = tailor.WriteThrough
+	case "behind":
+		storeOpts.Mode = tailor.WriteBehind
+	default:
+		log.Fatal(errors.New("value of 'storeMode' in config.xml is invalid"))
+	}
+	storeOpts.ReadFallback = conf.StoreReadFallback == "true"
 
 	cc := conf.Concurrency
 	if cc == "default" {
@@ -98,6 +441,20 @@ func resolveConfig(conf config.TailorConfig) {
 	password = conf.Password
 	aesKey = conf.AESKey
 	savingPath = conf.SavingDir + conf.FileName
+	for _, rule := range conf.Saves {
+		savePolicies = append(savePolicies, tailor.SavePolicy{
+			Seconds: int(parseStr(rule.Seconds)),
+			Changes: uint64(parseStr(rule.Changes)),
+		})
+	}
+	indexes = conf.Indexes
+	if conf.SaveInterval != "" {
+		saveInterval = time.Duration(parseStr(conf.SaveInterval)) * time.Second
+	}
+	aofPath = conf.SavingDir + conf.AppendFileName
+	if conf.AppendFileName == "" {
+		aofPath = savingPath + ".aof"
+	}
 }
 
 func parseStr(str string) int64 {